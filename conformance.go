@@ -0,0 +1,104 @@
+package netdicom
+
+import (
+	"github.com/yasushi-saito/go-dicom"
+	"github.com/yasushi-saito/go-dicom/dicomio"
+	"github.com/yasushi-saito/go-netdicom/sopclass"
+)
+
+// ConformanceInfo is the machine-readable core of a DICOM conformance
+// statement (P3.2), derived from the ServiceProviderParams. It can be
+// serialized with encoding/json.
+type ConformanceInfo struct {
+	AETitle                   string `json:"aeTitle"`
+	ImplementationClassUID    string `json:"implementationClassUID"`
+	ImplementationVersionName string `json:"implementationVersionName"`
+
+	// Maximum length of a P-DATA-TF PDU that the provider receives.
+	MaxPDUSize int `json:"maxPDUSize"`
+
+	// SOP classes the provider supports, in the order of verification,
+	// storage, Query/Retrieve, and N-GET classes.
+	SOPClasses []SOPClassConformance `json:"sopClasses"`
+
+	// Query/Retrieve features accepted through SOP class extended
+	// negotiation.
+	QRExtendedNegotiation QRExtendedNegotiation `json:"qrExtendedNegotiation"`
+
+	// True if the provider accepts SCP/SCU role selection, which a C-GET
+	// requestor needs to receive the instances.
+	RoleSelection bool `json:"roleSelection"`
+}
+
+// SOPClassConformance describes the support for one SOP class.
+type SOPClassConformance struct {
+	Name string `json:"name"`
+	UID  string `json:"uid"`
+
+	// "SCP" if the provider serves requests for the class. "SCU" if it
+	// issues them, e.g., C-STOREs to send instances for C-MOVE and C-GET.
+	Roles []string `json:"roles"`
+
+	// The standard transfer syntaxes accepted for the class. If
+	// ServiceProviderParams.AcceptTransferSyntax is nil, any proposed
+	// syntax is accepted, and this lists only the standard ones.
+	TransferSyntaxUIDs []string `json:"transferSyntaxUIDs"`
+}
+
+// ConformanceStatement reports the SOP classes, roles, transfer syntaxes, and
+// negotiation options that the provider is configured with. A SOP class is
+// listed only if the callback that serves it is set, e.g., the storage classes
+// require ServiceProviderParams.CStore.
+func (sp *ServiceProvider) ConformanceStatement() ConformanceInfo {
+	params := sp.params
+	info := ConformanceInfo{
+		AETitle:                   params.AETitle,
+		ImplementationClassUID:    dicom.GoDICOMImplementationClassUID,
+		ImplementationVersionName: dicom.GoDICOMImplementationVersionName,
+		MaxPDUSize:                DefaultMaxPDUSize,
+		QRExtendedNegotiation:     params.QRExtendedNegotiation,
+		RoleSelection:             true,
+	}
+	add := func(classes []sopclass.SOPUID, role string) {
+	nextClass:
+		for _, sop := range classes {
+			for i := range info.SOPClasses {
+				if c := &info.SOPClasses[i]; c.UID == sop.UID {
+					c.Roles = append(c.Roles, role)
+					continue nextClass
+				}
+			}
+			c := SOPClassConformance{Name: sop.Name, UID: sop.UID, Roles: []string{role}}
+			for _, uid := range dicomio.StandardTransferSyntaxes {
+				if params.AcceptTransferSyntax == nil || params.AcceptTransferSyntax(sop.UID, uid) {
+					c.TransferSyntaxUIDs = append(c.TransferSyntaxUIDs, uid)
+				}
+			}
+			info.SOPClasses = append(info.SOPClasses, c)
+		}
+	}
+	if params.CEcho != nil {
+		add(sopclass.VerificationClasses, "SCP")
+	}
+	if params.CStore != nil {
+		add(sopclass.StorageClasses, "SCP")
+	}
+	if params.CMove != nil || params.CGet != nil {
+		// C-MOVE and C-GET send the instances through C-STORE.
+		add(sopclass.StorageClasses, "SCU")
+	}
+	if params.cfindCallback() != nil {
+		add(sopclass.QRFindClasses, "SCP")
+	}
+	if params.CMove != nil {
+		add(sopclass.QRMoveClasses, "SCP")
+	}
+	if params.CGet != nil {
+		add(sopclass.QRGetClasses, "SCP")
+	}
+	if params.NGet != nil {
+		add(sopclass.DisplaySystemClasses, "SCP")
+		add(sopclass.PrinterClasses, "SCP")
+	}
+	return info
+}
@@ -0,0 +1,54 @@
+package netdicom_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/yasushi-saito/go-dicom/dicomuid"
+	"github.com/yasushi-saito/go-netdicom"
+	"github.com/yasushi-saito/go-netdicom/dimse"
+	"github.com/yasushi-saito/go-netdicom/sopclass"
+)
+
+func TestConformanceStatement(t *testing.T) {
+	sp, err := netdicom.NewServiceProvider(netdicom.ServiceProviderParams{
+		AETitle: "testscp",
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			return dimse.Success
+		},
+		CGet: func(req netdicom.CMoveRequest, ch chan netdicom.CMoveResult) {
+			close(ch)
+		},
+		AcceptTransferSyntax: func(sopClassUID, transferSyntaxUID string) bool {
+			return transferSyntaxUID == dicomuid.ImplicitVRLittleEndian
+		},
+	}, ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Shutdown(context.Background())
+	info := sp.ConformanceStatement()
+	if info.AETitle != "testscp" || info.MaxPDUSize != netdicom.DefaultMaxPDUSize {
+		t.Errorf("Wrong info: %+v", info)
+	}
+	if n := len(sopclass.StorageClasses) + len(sopclass.QRGetClasses); len(info.SOPClasses) != n {
+		t.Errorf("Expect %d SOP classes, got %d", n, len(info.SOPClasses))
+	}
+	storage := info.SOPClasses[0]
+	if storage.UID != sopclass.StorageClasses[0].UID || len(storage.Roles) != 2 ||
+		len(storage.TransferSyntaxUIDs) != 1 || storage.TransferSyntaxUIDs[0] != dicomuid.ImplicitVRLittleEndian {
+		t.Errorf("Wrong storage class: %+v", storage)
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded netdicom.ConformanceInfo
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.SOPClasses[0].Roles[1] != "SCU" {
+		t.Errorf("Wrong JSON round trip: %s", data)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/yasushi-saito/go-dicom/dicomuid"
 	"github.com/yasushi-saito/go-netdicom/pdu"
 	"github.com/yasushi-saito/go-netdicom/sopclass"
+	"strings"
 	"v.io/x/lib/vlog"
 )
 
@@ -39,6 +40,19 @@ type contextManager struct {
 	// Implementation version, virtually meaningless since its format isn't standardiszed.
 	peerImplementationVersionName string
 
+	// AE titles found in the A-ASSOCIATE-RQ pdu.
+	callingAETitle string
+	calledAETitle  string
+
+	// Result of the SOP class extended negotiation for Query/Retrieve SOP
+	// classes, keyed by SOP class UID. It only contains classes for which
+	// some feature was accepted by the provider.
+	qrExtendedNegotiation map[string]QRExtendedNegotiation
+
+	// SOP class common extended negotiation proposed by the requestor,
+	// keyed by SOP class UID. Used only on the provider side.
+	commonExtendedNegotiation map[string]CommonExtendedNegotiation
+
 	// tmpRequests used only on the client (requestor) side. It holds the
 	// contextid->presentationcontext mapping generated from the
 	// A_ASSOCIATE_RQ PDU. Once an A_ASSOCIATE_AC PDU arrives, tmpRequests
@@ -55,22 +69,70 @@ func newContextManager(label string) *contextManager {
 		abstractSyntaxNameToContextIDMap: make(map[string]*contextManagerEntry),
 		peerMaxPDUSize:                   16384, // The default value used by Osirix & pynetdicom.
 		tmpRequests:                      make(map[byte]*pdu.PresentationContextItem),
+		qrExtendedNegotiation:            make(map[string]QRExtendedNegotiation),
+		commonExtendedNegotiation:        make(map[string]CommonExtendedNegotiation),
 	}
 	return c
 }
 
+// Presentation context IDs are odd numbers between 1 and 255, and they must be
+// unique within an association (P3.8 9.3.2.2), so an association can carry at
+// most 128 presentation contexts.
+const maxPresentationContexts = 128
+
+func checkPresentationContextCount(n int) error {
+	if n > maxPresentationContexts {
+		return fmt.Errorf("Too many presentation contexts: %d proposed, but at most %d are allowed in an association", n, maxPresentationContexts)
+	}
+	return nil
+}
+
 // Called by the user (client) to produce a list to be embedded in an
 // A_REQUEST_RQ.Items. The PDU is sent when running as a service user (client).
 // maxPDUSize is the maximum PDU size, in bytes, that the clients is willing to
-// receive. maxPDUSize is encoded in one of the items.
+// receive. maxPDUSize is encoded in one of the items. qrExtendedNegotiation
+// is the set of features to propose for the Query/Retrieve classes in
+// services. commonExtendedNegotiation, keyed by SOP class UID, is sent for the
+// proposed classes that it contains. extraContexts are proposed after the
+// contexts for services. It returns an error if there are too many contexts to
+// assign distinct IDs.
 func (m *contextManager) generateAssociateRequest(
-	services []sopclass.SOPUID, transferSyntaxUIDs []string) []pdu.SubItem {
+	services []sopclass.SOPUID, transferSyntaxUIDs []string,
+	qrExtendedNegotiation QRExtendedNegotiation,
+	commonExtendedNegotiation map[string]CommonExtendedNegotiation,
+	extraContexts []PresentationContext) ([]pdu.SubItem, error) {
+	if err := checkPresentationContextCount(len(services) + len(extraContexts)); err != nil {
+		return nil, err
+	}
+	transferSyntaxUIDs = withDefaultTransferSyntax(transferSyntaxUIDs)
 	items := []pdu.SubItem{
 		&pdu.ApplicationContextItem{
 			Name: pdu.DICOMApplicationContextItemName,
 		}}
+	userInfoItems := []pdu.SubItem{
+		&pdu.UserInformationMaximumLengthItem{uint32(DefaultMaxPDUSize)},
+		&pdu.ImplementationClassUIDSubItem{dicom.GoDICOMImplementationClassUID},
+		&pdu.ImplementationVersionNameSubItem{dicom.GoDICOMImplementationVersionName}}
+	// C-GET sends the instances back over the same association, so the
+	// requestor must also play the C-STORE SCP role (P3.4 C.4.3.1).
+	proposeSCPRole := false
+	for _, sop := range services {
+		if sopUIDListContains(sopclass.QRGetClasses, sop.UID) {
+			proposeSCPRole = true
+		}
+	}
 	var contextID byte = 1
 	for _, sop := range services {
+		if item := qrExtendedNegotiation.encode(sop.UID); item != nil {
+			userInfoItems = append(userInfoItems, item)
+		}
+		if proposeSCPRole && sopUIDListContains(sopclass.StorageClasses, sop.UID) {
+			userInfoItems = append(userInfoItems, &pdu.RoleSelectionSubItem{
+				SOPClassUID: sop.UID,
+				SCURole:     1,
+				SCPRole:     1,
+			})
+		}
 		syntaxItems := []pdu.SubItem{
 			&pdu.AbstractSyntaxSubItem{Name: sop.UID},
 		}
@@ -87,24 +149,56 @@ func (m *contextManager) generateAssociateRequest(
 		m.tmpRequests[contextID] = item
 		contextID += 2 // must be odd.
 	}
-	items = append(items,
-		&pdu.UserInformationItem{
-			Items: []pdu.SubItem{
-				&pdu.UserInformationMaximumLengthItem{uint32(DefaultMaxPDUSize)},
-				&pdu.ImplementationClassUIDSubItem{dicom.GoDICOMImplementationClassUID},
-				&pdu.ImplementationVersionNameSubItem{dicom.GoDICOMImplementationVersionName}}})
-
-	return items
+	// Send at most one item per SOP class, even if it appears in multiple
+	// contexts.
+	commonSent := make(map[string]bool)
+	addCommonExtendedNegotiation := func(sopClassUID string) {
+		if n, ok := commonExtendedNegotiation[sopClassUID]; ok && !commonSent[sopClassUID] {
+			commonSent[sopClassUID] = true
+			userInfoItems = append(userInfoItems, n.encode(sopClassUID))
+		}
+	}
+	for _, sop := range services {
+		addCommonExtendedNegotiation(sop.UID)
+	}
+	for _, c := range extraContexts {
+		addCommonExtendedNegotiation(c.AbstractSyntaxUID)
+		syntaxItems := []pdu.SubItem{
+			&pdu.AbstractSyntaxSubItem{Name: c.AbstractSyntaxUID},
+		}
+		for _, syntaxUID := range c.TransferSyntaxUIDs {
+			syntaxItems = append(syntaxItems, &pdu.TransferSyntaxSubItem{Name: syntaxUID})
+		}
+		item := &pdu.PresentationContextItem{
+			Type:      pdu.ItemTypePresentationContextRequest,
+			ContextID: contextID,
+			Result:    0, // must be zero for request
+			Items:     syntaxItems,
+		}
+		items = append(items, item)
+		m.tmpRequests[contextID] = item
+		contextID += 2
+	}
+	items = append(items, &pdu.UserInformationItem{Items: userInfoItems})
+	return items, nil
 }
 
 // Called when A_ASSOCIATE_RQ pdu arrives, on the provider side. Returns a list of items to be sent in
-// the A_ASSOCIATE_AC pdu.
-func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.SubItem, error) {
+// the A_ASSOCIATE_AC pdu. qrExtendedNegotiation is the set of features that
+// the provider supports for Query/Retrieve classes.
+//
+// acceptTransferSyntax, if non-nil, decides whether a transfer syntax may be
+// used for a SOP class. See ServiceProviderParams.AcceptTransferSyntax.
+func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem,
+	qrExtendedNegotiation QRExtendedNegotiation,
+	acceptTransferSyntax func(sopClassUID, transferSyntaxUID string) bool) ([]pdu.SubItem, error) {
 	responses := []pdu.SubItem{
 		&pdu.ApplicationContextItem{
 			Name: pdu.DICOMApplicationContextItemName,
 		},
 	}
+	var extendedNegotiationRequests []*pdu.SOPClassExtendedNegotiationSubItem
+	var roleSelectionRequests []*pdu.RoleSelectionSubItem
 	for _, requestItem := range requestItems {
 		switch ri := requestItem.(type) {
 		case *pdu.ApplicationContextItem:
@@ -114,7 +208,7 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 			}
 		case *pdu.PresentationContextItem:
 			var sopUID string
-			var pickedTransferSyntaxUID string
+			var transferSyntaxUIDs []string
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
 				case *pdu.AbstractSyntaxSubItem:
@@ -124,28 +218,53 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 					}
 					sopUID = c.Name
 				case *pdu.TransferSyntaxSubItem:
-					// Just pick the first syntax UID proposed by the client.
-					if pickedTransferSyntaxUID == "" {
-						pickedTransferSyntaxUID = c.Name
-					}
+					// UIDs may be padded with NUL to even
+					// length. P3.5 9.1.
+					transferSyntaxUIDs = append(transferSyntaxUIDs, strings.TrimRight(c.Name, "\x00"))
 				default:
 					return nil, fmt.Errorf("Unknown subitem in PresentationContext: %s",
 						subItem.String())
 				}
 			}
-			if sopUID == "" || pickedTransferSyntaxUID == "" {
-				return nil, fmt.Errorf("SOP or transfersyntax not found in PresentationContext: %v",
+			if sopUID == "" {
+				return nil, fmt.Errorf("SOP not found in PresentationContext: %v",
 					ri.String())
 			}
+			// Pick the first syntax UID proposed by the client that the
+			// provider accepts for the SOP class. A context without
+			// any syntax is rejected.
+			result := pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported
+			pickedTransferSyntaxUID := dicomuid.ImplicitVRLittleEndian
+			if len(transferSyntaxUIDs) > 0 {
+				pickedTransferSyntaxUID = transferSyntaxUIDs[0]
+			}
+			for _, uid := range transferSyntaxUIDs {
+				if acceptTransferSyntax == nil || acceptTransferSyntax(sopUID, uid) {
+					result = pdu.PresentationContextAccepted
+					pickedTransferSyntaxUID = uid
+					break
+				}
+			}
+			// Every AE must support the default syntax. P3.5 10.1.
+			if result != pdu.PresentationContextAccepted && stringListContains(transferSyntaxUIDs, dicomuid.ImplicitVRLittleEndian) {
+				result = pdu.PresentationContextAccepted
+				pickedTransferSyntaxUID = dicomuid.ImplicitVRLittleEndian
+			}
+			if result != pdu.PresentationContextAccepted {
+				vlog.Infof("Provider(%p): rejecting context %d for %v; no acceptable transfer syntax in %v",
+					m, ri.ContextID, dicomuid.UIDString(sopUID), transferSyntaxUIDs)
+			}
+			// For a rejected context, the transfer syntax in the
+			// response is not significant. P3.8 9.3.3.2.
 			responses = append(responses, &pdu.PresentationContextItem{
 				Type:      pdu.ItemTypePresentationContextResponse,
 				ContextID: ri.ContextID,
-				Result:    0, // accepted
+				Result:    result,
 				Items:     []pdu.SubItem{&pdu.TransferSyntaxSubItem{Name: pickedTransferSyntaxUID}}})
 			vlog.VI(2).Infof("Provider(%p): addmapping %v %v %v",
 				m, sopUID, pickedTransferSyntaxUID, ri.ContextID)
 			// TODO(saito) Callback the service provider instead of accepting the sopclass blindly.
-			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, pdu.PresentationContextAccepted)
+			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, result)
 		case *pdu.UserInformationItem:
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
@@ -155,14 +274,49 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 					m.peerImplementationClassUID = c.Name
 				case *pdu.ImplementationVersionNameSubItem:
 					m.peerImplementationVersionName = c.Name
-
+				case *pdu.SOPClassExtendedNegotiationSubItem:
+					extendedNegotiationRequests = append(extendedNegotiationRequests, c)
+				case *pdu.RoleSelectionSubItem:
+					roleSelectionRequests = append(roleSelectionRequests, c)
+				case *pdu.SOPClassCommonExtendedNegotiationSubItem:
+					// There's nothing to respond with. P3.7 D.3.3.6.
+					m.commonExtendedNegotiation[c.SOPClassUID] = decodeCommonExtendedNegotiation(c)
 				}
 			}
 		}
 	}
-	responses = append(responses,
-		&pdu.UserInformationItem{
-			Items: []pdu.SubItem{&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(DefaultMaxPDUSize)}}})
+	userInfoItems := []pdu.SubItem{&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(DefaultMaxPDUSize)}}
+	for _, item := range extendedNegotiationRequests {
+		if _, ok := m.abstractSyntaxNameToContextIDMap[item.SOPClassUID]; !ok {
+			vlog.Errorf("Extended negotiation for SOP class %v that's not in any presentation context",
+				dicomuid.UIDString(item.SOPClassUID))
+			continue
+		}
+		requested, ok := decodeQRExtendedNegotiation(item)
+		if !ok {
+			vlog.VI(1).Infof("Ignoring extended negotiation for %v", dicomuid.UIDString(item.SOPClassUID))
+			continue
+		}
+		// Omitting the item in the response means that none of the
+		// features are supported.
+		accepted := requested.intersect(qrExtendedNegotiation)
+		if response := accepted.encode(item.SOPClassUID); response != nil {
+			m.qrExtendedNegotiation[item.SOPClassUID] = accepted
+			userInfoItems = append(userInfoItems, response)
+		}
+	}
+	for _, item := range roleSelectionRequests {
+		// Accept whatever roles the requestor proposes. The
+		// provider can both send and receive any SOP class.
+		if _, ok := m.abstractSyntaxNameToContextIDMap[item.SOPClassUID]; ok {
+			userInfoItems = append(userInfoItems, &pdu.RoleSelectionSubItem{
+				SOPClassUID: item.SOPClassUID,
+				SCURole:     item.SCURole,
+				SCPRole:     item.SCPRole,
+			})
+		}
+	}
+	responses = append(responses, &pdu.UserInformationItem{Items: userInfoItems})
 	vlog.VI(1).Infof("Received associate request, #contexts:%v, maxPDU:%v, implclass:%v, version:%v",
 		len(m.contextIDToAbstractSyntaxNameMap),
 		m.peerMaxPDUSize, m.peerImplementationClassUID, m.peerImplementationVersionName)
@@ -237,7 +391,10 @@ func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 					m.peerImplementationClassUID = c.Name
 				case *pdu.ImplementationVersionNameSubItem:
 					m.peerImplementationVersionName = c.Name
-
+				case *pdu.SOPClassExtendedNegotiationSubItem:
+					if accepted, ok := decodeQRExtendedNegotiation(c); ok {
+						m.qrExtendedNegotiation[c.SOPClassUID] = accepted
+					}
 				}
 			}
 		}
@@ -269,9 +426,29 @@ func addContextMapping(
 		result:            result,
 	}
 	m.contextIDToAbstractSyntaxNameMap[contextID] = e
+	// A SOP class is often proposed in several contexts, one per transfer
+	// syntax. Lookups by the SOP class use the first accepted one.
+	if prev, ok := m.abstractSyntaxNameToContextIDMap[abstractSyntaxUID]; ok &&
+		prev.result == pdu.PresentationContextAccepted {
+		return
+	}
 	m.abstractSyntaxNameToContextIDMap[abstractSyntaxUID] = e
 }
 
+// List the accepted contexts, in the order of their IDs.
+func (m *contextManager) acceptedContexts() []PresentationContext {
+	var contexts []PresentationContext
+	for id := 1; id < 256; id += 2 {
+		if e, ok := m.contextIDToAbstractSyntaxNameMap[byte(id)]; ok && e.result == pdu.PresentationContextAccepted {
+			contexts = append(contexts, PresentationContext{
+				AbstractSyntaxUID:  e.abstractSyntaxUID,
+				TransferSyntaxUIDs: []string{e.transferSyntaxUID},
+			})
+		}
+	}
+	return contexts
+}
+
 func (m *contextManager) checkContextRejection(e *contextManagerEntry) error {
 	if e.result != pdu.PresentationContextAccepted {
 		return fmt.Errorf("contextmanager(%v): Trying to use rejected context <%v, %v>: %s",
@@ -283,6 +460,23 @@ func (m *contextManager) checkContextRejection(e *contextManagerEntry) error {
 	return nil
 }
 
+// Find an accepted context for the given pair of abstract and transfer
+// syntaxes. If there are many, the one with the smallest ID is returned.
+func (m *contextManager) lookupByAbstractAndTransferSyntaxUIDs(abstractSyntaxUID, transferSyntaxUID string) (contextManagerEntry, error) {
+	var found *contextManagerEntry
+	for _, e := range m.contextIDToAbstractSyntaxNameMap {
+		if e.abstractSyntaxUID == abstractSyntaxUID && e.transferSyntaxUID == transferSyntaxUID &&
+			e.result == pdu.PresentationContextAccepted && (found == nil || e.contextID < found.contextID) {
+			found = e
+		}
+	}
+	if found == nil {
+		return contextManagerEntry{}, fmt.Errorf("contextmanager(%v): No accepted context for syntax %s, transfer syntax %s",
+			m.label, dicomuid.UIDString(abstractSyntaxUID), dicomuid.UIDString(transferSyntaxUID))
+	}
+	return *found, nil
+}
+
 // Convert an UID to a context ID.
 func (m *contextManager) lookupByAbstractSyntaxUID(name string) (contextManagerEntry, error) {
 	e, ok := m.abstractSyntaxNameToContextIDMap[name]
@@ -308,3 +502,21 @@ func (m *contextManager) lookupByContextID(contextID byte) (contextManagerEntry,
 	}
 	return *e, nil
 }
+
+// Return "uids" with Implicit VR Little Endian, the default transfer syntax
+// (P3.5 10.1), appended if missing.
+func withDefaultTransferSyntax(uids []string) []string {
+	if stringListContains(uids, dicomuid.ImplicitVRLittleEndian) {
+		return uids
+	}
+	return append(append([]string{}, uids...), dicomuid.ImplicitVRLittleEndian)
+}
+
+func stringListContains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,7 +1,9 @@
 package netdicom
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/yasushi-saito/go-dicom"
 	"github.com/yasushi-saito/go-dicom/dicomio"
@@ -10,31 +12,105 @@ import (
 	"v.io/x/lib/vlog"
 )
 
-func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEvent,
-	cm *contextManager,
-	messageID uint16,
-	ds *dicom.DataSet) error {
+// Returned by runCStoreOnAssociation when the association closes before the
+// response arrives.
+var errCStoreConnectionClosed = errors.New("Connection closed while waiting for C-STORE response")
+
+// Return the SOP class UID of "ds", or "" if it's missing.
+func dataSetSOPClassUID(ds *dicom.DataSet) string {
+	sopClassUID, _ := dataSetStringWithFallback(ds, dicom.TagMediaStorageSOPClassUID, dicom.TagSOPClassUID)
+	return sopClassUID
+}
+
+// Extract the SOP class and instance UIDs of "ds". They are read from the file
+// meta information, or from the dataset proper if "ds" has no meta group,
+// e.g., in a legacy file that was stored without a part-10 header.
+func dataSetSOPUIDs(ds *dicom.DataSet) (sopClassUID, sopInstanceUID string, err error) {
+	sopInstanceUID, err = dataSetStringWithFallback(ds, dicom.TagMediaStorageSOPInstanceUID, dicom.TagSOPInstanceUID)
+	if err != nil {
+		return "", "", fmt.Errorf("C-STORE data lacks SOPInstanceUID: %v", err)
+	}
+	sopClassUID, err = dataSetStringWithFallback(ds, dicom.TagMediaStorageSOPClassUID, dicom.TagSOPClassUID)
+	if err != nil {
+		return "", "", fmt.Errorf("C-STORE data lacks SOPClassUID: %v", err)
+	}
+	return sopClassUID, sopInstanceUID, nil
+}
+
+// Return the string value of element "metaTag" of "ds", or of "tag" if the
+// former is missing or empty.
+func dataSetStringWithFallback(ds *dicom.DataSet, metaTag, tag dicom.Tag) (string, error) {
 	var getElement = func(tag dicom.Tag) (string, error) {
 		elem, err := ds.FindElementByTag(tag)
-		if err != nil {
-			return "", fmt.Errorf("C-STORE data lacks %s: %v", tag.String(), err)
-		}
-		s, err := elem.GetString()
 		if err != nil {
 			return "", err
 		}
+		return elem.GetString()
+	}
+	if s, err := getElement(metaTag); err == nil && s != "" {
 		return s, nil
 	}
-	sopInstanceUID, err := getElement(dicom.TagMediaStorageSOPInstanceUID)
+	s, err := getElement(tag)
+	if err == nil && s == "" {
+		err = fmt.Errorf("%s is empty", tag.String())
+	}
+	return s, err
+}
+
+// Return the transfer syntax of "ds", taken from its file meta information,
+// if it is an encapsulated one, e.g., JPEG. Return "" otherwise.
+func dataSetEncapsulatedTransferSyntaxUID(ds *dicom.DataSet) string {
+	elem, err := ds.FindElementByTag(dicom.TagTransferSyntaxUID)
+	if err != nil {
+		return ""
+	}
+	uid, err := elem.GetString()
 	if err != nil {
-		return fmt.Errorf("C-STORE data lacks SOPInstanceUID: %v", err)
+		return ""
 	}
-	sopClassUID, err := getElement(dicom.TagMediaStorageSOPClassUID)
+	ts, err := ParseTransferSyntax(uid)
+	if err != nil || !ts.IsEncapsulated {
+		return ""
+	}
+	return ts.UID
+}
+
+// If contextID is nonzero, the request is sent on that presentation context.
+// Otherwise, the context is chosen by the SOP class of "ds". If timeout>0, it
+// bounds the wait for the response.
+func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEvent,
+	cm *contextManager,
+	messageID uint16,
+	contextID byte,
+	ds *dicom.DataSet,
+	timeout time.Duration) error {
+	sopClassUID, sopInstanceUID, err := dataSetSOPUIDs(ds)
 	if err != nil {
-		return fmt.Errorf("C-STORE data lacks MediaStorageSOPClassUID: %v", err)
+		return err
 	}
 	vlog.VI(1).Infof("DICOM abstractsyntax: %s, sopinstance: %s", dicomuid.UIDString(sopClassUID), sopInstanceUID)
-	context, err := cm.lookupByAbstractSyntaxUID(sopClassUID)
+	var context contextManagerEntry
+	if contextID != 0 {
+		context, err = cm.lookupByContextID(contextID)
+		if err == nil && context.abstractSyntaxUID != sopClassUID {
+			err = fmt.Errorf("C-STORE: context %d is for %v, but the data is %v", contextID,
+				dicomuid.UIDString(context.abstractSyntaxUID), dicomuid.UIDString(sopClassUID))
+		}
+	} else {
+		context, err = cm.lookupByAbstractSyntaxUID(sopClassUID)
+		// Compressed pixel data isn't transcoded, so send the dataset in
+		// its own transfer syntax if the provider accepted it.
+		// Otherwise the provider would read, and store, the data as if
+		// encoded in the syntax of the default context.
+		if uid := dataSetEncapsulatedTransferSyntaxUID(ds); err == nil && uid != "" && uid != context.transferSyntaxUID {
+			if c, err := cm.lookupByAbstractAndTransferSyntaxUIDs(sopClassUID, uid); err == nil {
+				context = c
+			} else {
+				vlog.Errorf("C-STORE: %v is encoded in %v, but sent in %v: %v", sopInstanceUID,
+					dicomuid.UIDString(uid), dicomuid.UIDString(context.transferSyntaxUID), err)
+			}
+		}
+	}
 	if err != nil {
 		vlog.Errorf("C-STORE: sop class %v not found in context %v", sopClassUID, err)
 		return err
@@ -58,6 +134,7 @@ func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEven
 		event: evt09,
 		dimsePayload: &stateEventDIMSEPayload{
 			abstractSyntaxName: sopClassUID,
+			contextID:          context.contextID,
 			command: &dimse.C_STORE_RQ{
 				AffectedSOPClassUID:    sopClassUID,
 				MessageID:              messageID,
@@ -69,9 +146,12 @@ func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEven
 	}
 	for {
 		vlog.Infof("Start reading resp w/ messageID:%v", messageID)
-		event, ok := <-upcallCh
+		event, ok, err := receiveUpcall(upcallCh, timeout)
+		if err != nil {
+			return err
+		}
 		if !ok {
-			return fmt.Errorf("Connection closed while waiting for C-STORE response")
+			return errCStoreConnectionClosed
 		}
 		vlog.VI(1).Infof("C-STORE resp event: %v", event.command)
 		doassert(event.eventType == upcallEventData)
@@ -0,0 +1,76 @@
+package netdicom
+
+import (
+	"fmt"
+
+	"github.com/yasushi-saito/go-dicom"
+)
+
+// CStoreBatchFailure describes an instance that CStoreBatch couldn't store.
+type CStoreBatchFailure struct {
+	// Index of the instance in the datasets passed to CStoreBatch.
+	Index int
+	Err   error
+}
+
+// CStoreBatchResult is the checkpoint of CStoreBatch. The indexes refer to the
+// datasets passed to CStoreBatch.
+type CStoreBatchResult struct {
+	// The instances that the provider stored, in the order sent.
+	Stored []int
+
+	// The instances that the provider rejected, or that couldn't be sent,
+	// e.g., because the provider didn't accept their SOP class, in the order
+	// sent. Resuming doesn't retry them.
+	Failed []CStoreBatchFailure
+
+	// The first instance not yet known to be stored or rejected. It is
+	// len(datasets) once the batch is done. If the association drops, pass
+	// it as "start" to CStoreBatch on a new association to resume. The
+	// instance at Next may have been stored already, if the association
+	// dropped before the response arrived.
+	Next int
+}
+
+// CStoreBatch sends datasets[start:] by C-STORE, one at a time, in the order of
+// the slice: each instance is sent only after the response to the previous one
+// arrives. Instances are never reordered or sent in parallel, e.g., grouped by
+// SOP class, so that the caller can send the instances that others reference,
+// e.g., the images of a presentation state, first. An instance that the
+// provider rejects is recorded in CStoreBatchResult.Failed, and the batch goes
+// on; the order of the rest is kept. It stops when the association closes or a
+// response times out (see ServiceUserParams.DIMSETimeout), and returns the
+// error along with the checkpoint reached. The caller can then resume from
+// CStoreBatchResult.Next on a new association, rather than restart.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStoreBatch(datasets []*dicom.DataSet, start int) (CStoreBatchResult, error) {
+	result := CStoreBatchResult{Next: start}
+	if start < 0 || start > len(datasets) {
+		return result, fmt.Errorf("CStoreBatch: start %d out of range [0, %d]", start, len(datasets))
+	}
+	for i := start; i < len(datasets); i++ {
+		err := su.CStore(datasets[i])
+		if err != nil && !su.associationActive(err) {
+			return result, err
+		}
+		if err != nil {
+			result.Failed = append(result.Failed, CStoreBatchFailure{Index: i, Err: err})
+		} else {
+			result.Stored = append(result.Stored, i)
+		}
+		result.Next = i + 1
+	}
+	return result, nil
+}
+
+// Check if the association is still usable after a request failed with
+// "err". If not, the request's outcome is unknown.
+func (su *ServiceUser) associationActive(err error) bool {
+	if err == ErrDIMSETimeout || err == ErrReleased {
+		return false
+	}
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	return su.status == serviceUserAssociationActive && su.abortErr == nil
+}
@@ -0,0 +1,207 @@
+package netdicom
+
+// Implements range matching of DA and DT attributes, as defined in P3.4
+// C.2.2.2.5, with time-zone adjustment (P3.4 C.4.1.1.3.1).
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MatchDateTimeRange reports whether "value", a DA or DT string stored in a
+// dataset, matches "filter", a C-FIND matching key. The filter is either a
+// single value, or a range of form "<from>-<to>", "-<to>", or "<from>-".  A
+// value with partial precision (e.g., "2017" or "20170102") covers the whole
+// period it denotes, so "20170102" matches the filter "20170102120000".
+//
+// tzOffset is the TimezoneOffsetFromUTC (0008,0201) sent with the query, in
+// form "+HHMM" or "-HHMM". It applies to the filter values that don't carry
+// their own offset suffix.  The value is taken to be in UTC unless it carries
+// its own offset suffix, so an SCP that stores local times should append its
+// offset (e.g., "20170102093000+0900") before calling this function.  If
+// tzOffset is empty and neither side has an offset suffix, the two are
+// compared as is.
+//
+// An empty filter matches anything. A malformed filter, value, or tzOffset
+// never matches.
+func MatchDateTimeRange(filter, value string, tzOffset string) bool {
+	filter = strings.TrimSpace(filter)
+	value = strings.TrimSpace(value)
+	if filter == "" {
+		return true
+	}
+	if value == "" {
+		return false
+	}
+	filterLoc := time.UTC
+	if tzOffset = strings.TrimSpace(tzOffset); tzOffset != "" {
+		var err error
+		if filterLoc, err = parseUTCOffset(tzOffset); err != nil {
+			return false
+		}
+	}
+	from, to, err := parseDateTimeRange(filter, filterLoc)
+	if err != nil {
+		return false
+	}
+	valueStart, valueEnd, err := parseDateTime(value, time.UTC)
+	if err != nil {
+		return false
+	}
+	if !from.IsZero() && valueEnd.Before(from) {
+		return false
+	}
+	if !to.IsZero() && valueStart.After(to) {
+		return false
+	}
+	return true
+}
+
+// Parse a range matching key. An open end of the range is reported as a zero
+// time.Time.
+func parseDateTimeRange(filter string, loc *time.Location) (from, to time.Time, err error) {
+	lower, upper, isRange := splitDateTimeRange(filter)
+	if !isRange {
+		return parseDateTime(filter, loc)
+	}
+	if lower == "" && upper == "" {
+		return from, to, fmt.Errorf("Empty date-time range '%s'", filter)
+	}
+	if lower != "" {
+		if from, _, err = parseDateTime(lower, loc); err != nil {
+			return from, to, err
+		}
+	}
+	if upper != "" {
+		if _, to, err = parseDateTime(upper, loc); err != nil {
+			return from, to, err
+		}
+	}
+	return from, to, nil
+}
+
+// Split "<from>-<to>" into its components. The '-' is ambiguous since it also
+// starts a negative UTC offset suffix, e.g., "20170102093000-0500". A
+// four-digit component is taken as an offset iff it follows a value that has
+// at least an hour component.
+func splitDateTimeRange(filter string) (lower, upper string, isRange bool) {
+	parts := strings.Split(filter, "-")
+	var merged []string
+	for i, part := range parts {
+		if i > 0 && len(part) == 4 && len(merged) > 0 && len(merged[len(merged)-1]) >= 10 &&
+			!strings.ContainsAny(merged[len(merged)-1], "+-") {
+			merged[len(merged)-1] += "-" + part
+			continue
+		}
+		merged = append(merged, part)
+	}
+	switch len(merged) {
+	case 1:
+		return merged[0], "", false
+	case 2:
+		return merged[0], merged[1], true
+	default:
+		// Malformed. Let parseDateTime report the error.
+		return filter, "", false
+	}
+}
+
+// Parse a "+HHMM" or "-HHMM" string.
+func parseUTCOffset(s string) (*time.Location, error) {
+	if len(s) != 5 || (s[0] != '+' && s[0] != '-') {
+		return nil, fmt.Errorf("Malformed UTC offset '%s'", s)
+	}
+	hours, err := strconv.Atoi(s[1:3])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed UTC offset '%s': %v", s, err)
+	}
+	minutes, err := strconv.Atoi(s[3:5])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed UTC offset '%s': %v", s, err)
+	}
+	if hours > 14 || minutes > 59 {
+		return nil, fmt.Errorf("UTC offset '%s' out of range", s)
+	}
+	offset := hours*3600 + minutes*60
+	if s[0] == '-' {
+		offset = -offset
+	}
+	return time.FixedZone(s, offset), nil
+}
+
+// Parse a DA or DT value of form YYYY[MM[DD[HH[MM[SS[.F{1-6}]]]]]][&ZZXX].
+// Returns the first and the last instants of the period the value denotes.
+// "loc" is used when the value lacks the offset suffix.
+func parseDateTime(s string, loc *time.Location) (start, end time.Time, err error) {
+	if n := len(s); n > 5 && (s[n-5] == '+' || s[n-5] == '-') {
+		if loc, err = parseUTCOffset(s[n-5:]); err != nil {
+			return start, end, err
+		}
+		s = s[:n-5]
+	}
+	var fraction string
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		fraction = s[i+1:]
+		s = s[:i]
+		if len(s) != 14 || len(fraction) == 0 || len(fraction) > 6 {
+			return start, end, fmt.Errorf("Malformed fractional seconds in '%s'", s)
+		}
+	}
+	if len(s) < 4 || len(s) > 14 || len(s)%2 != 0 {
+		return start, end, fmt.Errorf("Malformed date-time '%s'", s)
+	}
+	// Components in order: year, month, day, hour, minute, second.
+	fields := []int{0, 1, 1, 0, 0, 0}
+	for i, pos := 0, 0; pos < len(s); i++ {
+		width := 2
+		if i == 0 {
+			width = 4
+		}
+		v, err := strconv.Atoi(s[pos : pos+width])
+		if err != nil || v < 0 {
+			return start, end, fmt.Errorf("Malformed date-time '%s'", s)
+		}
+		fields[i] = v
+		pos += width
+	}
+	var nsec int
+	if fraction != "" {
+		v, err := strconv.Atoi(fraction)
+		if err != nil || v < 0 {
+			return start, end, fmt.Errorf("Malformed fractional seconds in '%s'", s)
+		}
+		nsec = v * int(pow10(9-len(fraction)))
+	}
+	start = time.Date(fields[0], time.Month(fields[1]), fields[2], fields[3], fields[4], fields[5], nsec, loc)
+	if start.Month() != time.Month(fields[1]) || start.Day() != fields[2] ||
+		start.Hour() != fields[3] || start.Minute() != fields[4] || start.Second() != fields[5] {
+		return start, end, fmt.Errorf("Date-time '%s' out of range", s)
+	}
+	switch {
+	case fraction != "":
+		end = start.Add(time.Duration(pow10(9 - len(fraction))))
+	case len(s) == 4:
+		end = start.AddDate(1, 0, 0)
+	case len(s) == 6:
+		end = start.AddDate(0, 1, 0)
+	case len(s) == 8:
+		end = start.AddDate(0, 0, 1)
+	case len(s) == 10:
+		end = start.Add(time.Hour)
+	case len(s) == 12:
+		end = start.Add(time.Minute)
+	default:
+		end = start.Add(time.Second)
+	}
+	return start, end.Add(-time.Nanosecond), nil
+}
+
+func pow10(n int) int64 {
+	v := int64(1)
+	for i := 0; i < n; i++ {
+		v *= 10
+	}
+	return v
+}
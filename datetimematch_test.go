@@ -0,0 +1,45 @@
+package netdicom_test
+
+import (
+	"testing"
+
+	"github.com/yasushi-saito/go-netdicom"
+)
+
+func TestMatchDateTimeRange(t *testing.T) {
+	tests := []struct {
+		filter, value, tzOffset string
+		match                   bool
+	}{
+		{"", "20170102", "", true},
+		{"20170102", "", "", false},
+		{"20170102", "20170102", "", true},
+		{"20170102", "20170103", "", false},
+		{"20170101-20170131", "20170115", "", true},
+		{"20170101-20170131", "20170201", "", false},
+		{"-20170131", "20161231", "", true},
+		{"20170101-", "20161231", "", false},
+		// A partial-precision bound covers the whole period.
+		{"2016-2017", "20171231235959", "", true},
+		{"201701-", "20170101000000", "", true},
+		// The query is in UTC+0900. Its 2017-01-02 spans 2017-01-01T15:00Z to
+		// 2017-01-02T15:00Z.
+		{"20170102", "20170101160000", "+0900", true},
+		{"20170102", "20170102160000", "+0900", false},
+		{"20170102000000-20170102060000", "20170101180000", "+0900", true},
+		// Both the filter and the value carry their own offsets.
+		{"20170102090000+0900-20170102100000+0900", "20170101190000-0500", "", true},
+		{"20170102090000-0500-20170102100000-0500", "20170102140000", "+0900", true},
+		{"20170102090000-0500-", "20170102135959", "", false},
+		// Malformed inputs never match.
+		{"2017010", "20170102", "", false},
+		{"20170102", "20170230", "", false},
+		{"20170102", "20170102", "0900", false},
+	}
+	for _, test := range tests {
+		if m := netdicom.MatchDateTimeRange(test.filter, test.value, test.tzOffset); m != test.match {
+			t.Errorf("MatchDateTimeRange(%q, %q, %q): got %v, expect %v",
+				test.filter, test.value, test.tzOffset, m, test.match)
+		}
+	}
+}
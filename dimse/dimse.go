@@ -39,7 +39,25 @@ type Status struct {
 type messageDecoder struct {
 	elems  []*dicom.Element
 	parsed []bool // true if this element was parsed into a message field.
-	err    error
+	// Index in elems of the first element with each tag. Built once, so
+	// that the getters don't scan elems, which can be long, e.g., for a
+	// C-FIND command with many attributes.
+	index map[dicom.Tag]int
+	err   error
+}
+
+func newMessageDecoder(elems []*dicom.Element) *messageDecoder {
+	d := &messageDecoder{
+		elems:  elems,
+		parsed: make([]bool, len(elems)),
+		index:  make(map[dicom.Tag]int, len(elems)),
+	}
+	for i, elem := range elems {
+		if _, ok := d.index[elem.Tag]; !ok {
+			d.index[elem.Tag] = i
+		}
+	}
+	return d
 }
 
 type isOptionalElement int
@@ -58,12 +76,11 @@ func (d *messageDecoder) setError(err error) {
 // Find an element with the given tag. If optional==OptionalElement, returns nil
 // if not found.  If optional==RequiredElement, sets d.err and return nil if not found.
 func (d *messageDecoder) findElement(tag dicom.Tag, optional isOptionalElement) *dicom.Element {
-	for i, elem := range d.elems {
-		if elem.Tag == tag {
-			vlog.VI(3).Infof("Return %v for %s", elem, tag.String())
-			d.parsed[i] = true
-			return elem
-		}
+	if i, ok := d.index[tag]; ok {
+		elem := d.elems[i]
+		vlog.VI(3).Infof("Return %v for %s", elem, tag.String())
+		d.parsed[i] = true
+		return elem
 	}
 	if optional == RequiredElement {
 		d.setError(fmt.Errorf("Element %s not found during DIMSE decoding", dicom.TagString(tag)))
@@ -84,6 +101,9 @@ func (d *messageDecoder) unparsedElements() (unparsed []*dicom.Element) {
 func (d *messageDecoder) getStatus() (s Status) {
 	s.Status = StatusCode(d.getUInt16(dicom.TagStatus, RequiredElement))
 	s.ErrorComment = d.getString(dicom.TagErrorComment, OptionalElement)
+	if d.err == nil && s.IsUnknown() {
+		vlog.VI(1).Infof("DIMSE status 0x%04x is outside the ranges defined in P3.7", uint16(s.Status))
+	}
 	return s
 }
 
@@ -95,7 +115,7 @@ func (d *messageDecoder) getString(tag dicom.Tag, optional isOptionalElement) st
 	}
 	v, err := e.GetString()
 	if err != nil {
-		d.setError(err)
+		d.setError(elementTypeError(tag, "string", err))
 	}
 	return v
 }
@@ -108,7 +128,7 @@ func (d *messageDecoder) getUInt32(tag dicom.Tag, optional isOptionalElement) ui
 	}
 	v, err := e.GetUInt32()
 	if err != nil {
-		d.setError(err)
+		d.setError(elementTypeError(tag, "UL", err))
 	}
 	return v
 }
@@ -121,11 +141,36 @@ func (d *messageDecoder) getUInt16(tag dicom.Tag, optional isOptionalElement) ui
 	}
 	v, err := e.GetUInt16()
 	if err != nil {
-		d.setError(err)
+		d.setError(elementTypeError(tag, "US", err))
 	}
 	return v
 }
 
+// Create an error for an element whose value isn't a single value of the
+// expected type, e.g., a string where a US is expected.
+func elementTypeError(tag dicom.Tag, expected string, err error) error {
+	return fmt.Errorf("Element %s: expect a single %s value during DIMSE decoding: %v", dicom.TagString(tag), expected, err)
+}
+
+// Find an element with "tag", and extract a list of attribute tags (AT) from
+// it. Errors are reported in d.err.
+func (d *messageDecoder) getTags(tag dicom.Tag, optional isOptionalElement) []dicom.Tag {
+	e := d.findElement(tag, optional)
+	if e == nil {
+		return nil
+	}
+	var tags []dicom.Tag
+	for _, v := range e.Value {
+		t, ok := v.(dicom.Tag)
+		if !ok {
+			d.setError(fmt.Errorf("Element %s: found %v, expect an attribute tag", dicom.TagString(tag), v))
+			return nil
+		}
+		tags = append(tags, t)
+	}
+	return tags
+}
+
 // Encode a DIMSE field with the given tag, given value "v"
 func encodeField(e *dicomio.Encoder, tag dicom.Tag, v interface{}) {
 	elem := dicom.Element{
@@ -137,6 +182,21 @@ func encodeField(e *dicomio.Encoder, tag dicom.Tag, v interface{}) {
 	dicom.WriteElement(e, &elem)
 }
 
+// Encode a DIMSE field of attribute tags (AT). dicom.WriteElement can't encode
+// AT values, so the element is written by hand: a command is always in
+// implicit VR little endian, so it is the tag, the 4-byte length, then a
+// (group, element) pair per tag. dicom.ReadElement decodes it back to a list
+// of dicom.Tag.
+func encodeTagsField(e *dicomio.Encoder, tag dicom.Tag, tags []dicom.Tag) {
+	e.WriteUInt16(tag.Group)
+	e.WriteUInt16(tag.Element)
+	e.WriteUInt32(uint32(4 * len(tags)))
+	for _, t := range tags {
+		e.WriteUInt16(t.Group)
+		e.WriteUInt16(t.Element)
+	}
+}
+
 // CommandDataSetTypeNull for dicom.TagCommandDataSetType indicates that the
 // DIMSE message has no data payload. Any other value indicates the existence of
 // a payload.
@@ -158,21 +218,107 @@ const (
 	StatusInvalidObjectInstance StatusCode = 0x0117
 	StatusUnrecognizedOperation StatusCode = 0x0211
 	StatusNotAuthorized         StatusCode = 0x0124
+	StatusDuplicateSOPInstance  StatusCode = 0x0111
+	StatusProcessingFailure     StatusCode = 0x0110
 	StatusPending               StatusCode = 0xff00
 
 	// C-STORE-specific status codes. P3.4 GG4-1
 	CStoreStatusOutOfResources              StatusCode = 0xa700
 	CStoreStatusDataSetDoesNotMatchSOPClass StatusCode = 0xa900
 	CStoreStatusCannotUnderstand            StatusCode = 0xc000
+	// Warning: the instance was already stored on this association, and
+	// was not stored again. P3.4 defines no such code; any 0xBxxx code is
+	// a warning (P3.7 C).
+	CStoreStatusDuplicateInstance StatusCode = 0xb111
+
+	// C-FIND-specific status codes. C-MOVE and C-GET use the same values.
+	CFindUnableToProcess                StatusCode = 0xc000
+	CFindIdentifierDoesNotMatchSOPClass StatusCode = 0xa900
 
-	// C-FIND-specific status codes.
-	CFindUnableToProcess StatusCode = 0xc000
+	// C-MOVE-specific status codes. P3.4 C.4.2.1.5
+	CMoveMoveDestinationUnknown StatusCode = 0xa801
 
 	// Warning codes.
 	StatusAttributeValueOutOfRange StatusCode = 0x0116
 	StatusAttributeListError       StatusCode = 0x0107
 )
 
+// StatusCategory is the class of a status code, as defined in P3.7 C.
+type StatusCategory int
+
+const (
+	// The code is outside the ranges defined by P3.7.
+	StatusCategoryUnknown StatusCategory = iota
+	StatusCategorySuccess
+	StatusCategoryPending
+	StatusCategoryCancel
+	StatusCategoryWarning
+	StatusCategoryFailure
+)
+
+func (c StatusCategory) String() string {
+	switch c {
+	case StatusCategorySuccess:
+		return "Success"
+	case StatusCategoryPending:
+		return "Pending"
+	case StatusCategoryCancel:
+		return "Cancel"
+	case StatusCategoryWarning:
+		return "Warning"
+	case StatusCategoryFailure:
+		return "Failure"
+	}
+	return "Unknown"
+}
+
+// Category classifies the code, per P3.7 C. Service-specific codes are
+// classified by their high nibble, e.g., any 0xBxxx code is a warning, so
+// vendor-specific subcodes fall in the right category.
+func (c StatusCode) Category() StatusCategory {
+	switch {
+	case c == StatusSuccess:
+		return StatusCategorySuccess
+	case c == StatusPending || c == 0xff01:
+		// 0xFF01: pending, with optional keys unsupported.
+		return StatusCategoryPending
+	case c == StatusCancel:
+		return StatusCategoryCancel
+	case c == 0x0001 || c == StatusAttributeListError || c == StatusAttributeValueOutOfRange ||
+		c&0xf000 == 0xb000:
+		return StatusCategoryWarning
+	case c&0xff00 == 0x0100 || c&0xff00 == 0x0200 ||
+		c&0xf000 == 0xa000 || c&0xf000 == 0xc000:
+		return StatusCategoryFailure
+	}
+	return StatusCategoryUnknown
+}
+
+// Category classifies the status. See StatusCode.Category.
+func (s Status) Category() StatusCategory { return s.Status.Category() }
+
+// IsSuccess checks if the status is in category Success.
+func (s Status) IsSuccess() bool { return s.Category() == StatusCategorySuccess }
+
+// IsPending checks if the status is in category Pending, i.e., more responses
+// will follow.
+func (s Status) IsPending() bool { return s.Category() == StatusCategoryPending }
+
+// IsCancel checks if the status is in category Cancel.
+func (s Status) IsCancel() bool { return s.Category() == StatusCategoryCancel }
+
+// IsWarning checks if the status is in category Warning. The operation
+// completed, but possibly not as requested, e.g., a C-STORE provider coerced
+// some elements.
+func (s Status) IsWarning() bool { return s.Category() == StatusCategoryWarning }
+
+// IsFailure checks if the status is in category Failure. It returns false for
+// an unknown status code.
+func (s Status) IsFailure() bool { return s.Category() == StatusCategoryFailure }
+
+// IsUnknown checks if the status code is outside the ranges defined by P3.7.
+func (s Status) IsUnknown() bool { return s.Category() == StatusCategoryUnknown }
+
 func encodeStatus(e *dicomio.Encoder, s Status) {
 	encodeField(e, dicom.TagStatus, uint16(s.Status))
 	if s.ErrorComment != "" {
@@ -180,6 +326,109 @@ func encodeStatus(e *dicomio.Encoder, s Status) {
 	}
 }
 
+// DefaultMaxSequenceDepth is the default maximum nesting of sequence (SQ)
+// elements accepted in a DIMSE command or a query identifier. See
+// CheckSequenceDepth.
+const DefaultMaxSequenceDepth = 16
+
+const undefinedLength uint32 = 0xffffffff
+
+// CheckSequenceDepth returns an error if the dataset encoded in "data" in
+// "transferSyntaxUID" has sequences nested deeper than maxDepth. A sequence
+// that isn't inside another sequence has depth 1, and so does an item that
+// isn't inside a sequence. If maxDepth <= 0, DefaultMaxSequenceDepth is used.
+//
+// It only reads the element headers, and skips the values, so it should be
+// called before dicom.ReadElement, which builds the whole tree of elements,
+// recursing once per level, before the caller can look at it. Malformed data
+// is left for ReadElement to report.
+func CheckSequenceDepth(data []byte, transferSyntaxUID string, maxDepth int) error {
+	return checkSequenceDepth(dicomio.NewBytesDecoderWithTransferSyntax(data, transferSyntaxUID), maxDepth)
+}
+
+func checkSequenceDepth(d *dicomio.Decoder, maxDepth int) error {
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxSequenceDepth
+	}
+	return scanElements(d, 0, maxDepth, nil, false)
+}
+
+// Read the header of the next element. It mirrors dicom.ReadElement.
+func scanElementHeader(d *dicomio.Decoder) (tag dicom.Tag, vr string, vl uint32) {
+	tag = dicom.Tag{Group: d.ReadUInt16(), Element: d.ReadUInt16()}
+	// Items and delimiters are always implicit. P3.5 7.5.
+	if _, implicit := d.TransferSyntax(); implicit == dicomio.ImplicitVR || tag.Group == dicom.TagItem.Group {
+		vr = "UN"
+		if info, err := dicom.FindTag(tag); err == nil {
+			vr = info.VR
+		}
+		return tag, vr, d.ReadUInt32()
+	}
+	vr = d.ReadString(2)
+	switch vr {
+	case "NA", "OB", "OD", "OF", "OL", "OW", "SQ", "UN", "UC", "UR", "UT":
+		d.Skip(2)
+		vl = d.ReadUInt32()
+	default:
+		vl = uint32(d.ReadUInt16())
+		if vl == 0xffff {
+			vl = undefinedLength
+		}
+	}
+	return tag, vr, vl
+}
+
+// Skip the elements until the end of "d", or until the one tagged "*end".
+// "items" is true if the elements are the items of a sequence, at "depth".
+func scanElements(d *dicomio.Decoder, depth, maxDepth int, end *dicom.Tag, items bool) error {
+	for d.Len() > 0 && d.Error() == nil {
+		tag, vr, vl := scanElementHeader(d)
+		if d.Error() != nil || (end != nil && tag == *end) {
+			break
+		}
+		switch {
+		case tag == dicom.TagPixelData && vl == undefinedLength:
+			// Encapsulated pixel data: fragments up to the
+			// sequence delimiter. They contain no elements.
+			for d.Len() > 0 && d.Error() == nil {
+				tag, _, vl := scanElementHeader(d)
+				if tag == dicom.TagSequenceDelimitationItem || vl == undefinedLength {
+					break
+				}
+				d.Skip(int(vl))
+			}
+		case vr == "SQ" || tag == dicom.TagItem:
+			childDepth, childEnd, childItems := depth, dicom.TagItemDelimitationItem, false
+			if vr == "SQ" {
+				childDepth++
+				childEnd, childItems = dicom.TagSequenceDelimitationItem, true
+			} else if !items {
+				childDepth++
+			}
+			if childDepth > maxDepth {
+				return fmt.Errorf("element %v: sequences nested deeper than %d", tag, maxDepth)
+			}
+			var err error
+			if vl == undefinedLength {
+				err = scanElements(d, childDepth, maxDepth, &childEnd, childItems)
+			} else {
+				d.PushLimit(int64(vl))
+				err = scanElements(d, childDepth, maxDepth, nil, childItems)
+				d.PopLimit()
+			}
+			if err != nil {
+				return err
+			}
+		case vl == undefinedLength:
+			// dicom.ReadElement rejects it.
+			return nil
+		default:
+			d.Skip(int(vl))
+		}
+	}
+	return nil
+}
+
 // ReadMessage constructs a typed dimse.Message object, given a set of
 // dicom.Elements,
 func ReadMessage(d *dicomio.Decoder) Message {
@@ -195,21 +444,34 @@ func ReadMessage(d *dicomio.Decoder) Message {
 		if d.Error() != nil {
 			break
 		}
+		if elem.Tag == dicom.TagCommandGroupLength && len(elems) == 0 {
+			// The group length covers the rest of the command. A
+			// mismatch means that the command is truncated or followed
+			// by garbage, so don't try to make sense of it.
+			groupLength, err := elem.GetUInt32()
+			if err != nil {
+				d.SetError(err)
+				return nil
+			}
+			if int64(groupLength) != d.Len() {
+				d.SetError(fmt.Errorf("DIMSE CommandGroupLength is %d, but the command has %d bytes after it", groupLength, d.Len()))
+				return nil
+			}
+			// EncodeMessage recomputes the group length, so don't
+			// keep it in Extra.
+			continue
+		}
 		elems = append(elems, elem)
 	}
 
 	// Convert elems[] into a golang struct.
-	dd := messageDecoder{
-		elems:  elems,
-		parsed: make([]bool, len(elems)),
-		err:    nil,
-	}
+	dd := newMessageDecoder(elems)
 	commandField := dd.getUInt16(dicom.TagCommandField, RequiredElement)
 	if dd.err != nil {
 		d.SetError(dd.err)
 		return nil
 	}
-	v := decodeMessageForType(&dd, commandField)
+	v := decodeMessageForType(dd, commandField)
 	if dd.err != nil {
 		d.SetError(dd.err)
 		return nil
@@ -233,9 +495,44 @@ func EncodeMessage(e *dicomio.Encoder, v Message) {
 	e.WriteBytes(bytes)
 }
 
+// EncodeMessageToBytes serializes the given message, including the leading
+// CommandGroupLength element, into the bytes carried by the command PDVs of
+// P_DATA_TF PDUs.
+func EncodeMessageToBytes(v Message) ([]byte, error) {
+	e := dicomio.NewBytesEncoder(binary.LittleEndian, dicomio.ImplicitVR)
+	EncodeMessage(e, v)
+	if err := e.Error(); err != nil {
+		return nil, err
+	}
+	return e.Bytes(), nil
+}
+
+// DecodeMessage is the inverse of EncodeMessageToBytes. It parses the given
+// command bytes into a typed dimse.Message. It returns an error if the bytes
+// don't form exactly one message.
+func DecodeMessage(data []byte) (Message, error) {
+	d := dicomio.NewBytesDecoder(data, binary.LittleEndian, dicomio.ImplicitVR)
+	v := ReadMessage(d)
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
 // CommandAssembler is a helper that assembles a DIMSE command message and data
 // payload from a sequence of P_DATA_TF PDUs.
 type CommandAssembler struct {
+	// Strict controls the handling of data PDVs that arrive before the
+	// command of a message, e.g., padding after the previous message, or
+	// data for a command that carries no data. If false, they are logged
+	// and discarded. If true, AddDataPDU or NextMessage returns an error.
+	Strict bool
+
+	// MaxSequenceDepth is the maximum nesting of sequences accepted in a
+	// command. A command nested deeper is rejected before it's decoded.
+	// If zero, DefaultMaxSequenceDepth is used.
+	MaxSequenceDepth int
+
 	contextID      byte
 	commandBytes   []byte
 	command        Message
@@ -243,14 +540,44 @@ type CommandAssembler struct {
 	readAllCommand bool
 
 	readAllData bool
+
+	// PDVs received but not yet consumed, i.e., those that follow a
+	// complete message in the same P_DATA_TF PDU.
+	pending []pdu.PresentationDataValueItem
+}
+
+// Checks if the command and all of its data have been received.
+func (a *CommandAssembler) complete() bool {
+	return a.command != nil && (!a.command.HasData() || a.readAllData)
 }
 
 // AddDataPDU is to be called for each P_DATA_TF PDU received from the
 // network. If the fragment is marked as the last one, AddDataPDU returns
 // <SOPUID, TransferSyntaxUID, payload, nil>.  If it needs more fragments, it
 // returns <"", "", nil, nil>.  On error, it returns a non-nil error.
+//
+// A PDU may carry more than one message. After AddDataPDU returns a message,
+// call NextMessage until it returns a nil message to collect the rest.
 func (a *CommandAssembler) AddDataPDU(pdu *pdu.P_DATA_TF) (byte, Message, []byte, error) {
-	for _, item := range pdu.Items {
+	a.pending = append(a.pending, pdu.Items...)
+	return a.NextMessage()
+}
+
+// NextMessage assembles the next message from the PDVs that AddDataPDU
+// received after the last message it returned. Its results are the same as
+// AddDataPDU's. If the PDVs don't complete a message, they are kept for the
+// next AddDataPDU call.
+func (a *CommandAssembler) NextMessage() (byte, Message, []byte, error) {
+	for len(a.pending) > 0 && !a.complete() {
+		item := a.pending[0]
+		a.pending = a.pending[1:]
+		if !item.Command && a.contextID == 0 {
+			if a.Strict {
+				return 0, nil, nil, fmt.Errorf("P_DATA_TF: found a data fragment before the command")
+			}
+			vlog.VI(1).Infof("P_DATA_TF: ignoring a data fragment of %d bytes before the command", len(item.Value))
+			continue
+		}
 		if a.contextID == 0 {
 			a.contextID = item.ContextID
 		} else if a.contextID != item.ContextID {
@@ -263,6 +590,15 @@ func (a *CommandAssembler) AddDataPDU(pdu *pdu.P_DATA_TF) (byte, Message, []byte
 					return 0, nil, nil, fmt.Errorf("P_DATA_TF: found >1 command chunks with the Last bit set")
 				}
 				a.readAllCommand = true
+				d := dicomio.NewBytesDecoder(a.commandBytes, binary.LittleEndian, dicomio.ImplicitVR)
+				if err := checkSequenceDepth(d, a.MaxSequenceDepth); err != nil {
+					return 0, nil, nil, err
+				}
+				command, err := DecodeMessage(a.commandBytes)
+				if err != nil {
+					return 0, nil, nil, err
+				}
+				a.command = command
 			}
 		} else {
 			a.dataBytes = append(a.dataBytes, item.Value...)
@@ -274,25 +610,14 @@ func (a *CommandAssembler) AddDataPDU(pdu *pdu.P_DATA_TF) (byte, Message, []byte
 			}
 		}
 	}
-	if !a.readAllCommand {
-		return 0, nil, nil, nil
-	}
-	if a.command == nil {
-		d := dicomio.NewBytesDecoder(a.commandBytes, nil, dicomio.UnknownVR)
-		a.command = ReadMessage(d)
-		if err := d.Finish(); err != nil {
-			return 0, nil, nil, err
-		}
-	}
-	if a.command.HasData() && !a.readAllData {
+	if !a.complete() {
 		return 0, nil, nil, nil
 	}
 	contextID := a.contextID
 	command := a.command
 	dataBytes := a.dataBytes
-	*a = CommandAssembler{}
+	*a = CommandAssembler{Strict: a.Strict, MaxSequenceDepth: a.MaxSequenceDepth, pending: a.pending}
 	return contextID, command, dataBytes, nil
-	// TODO(saito) Verify that there's no unread items after the last command&data.
 }
 
 // Generate a new message ID that's unique within the "su".
@@ -240,16 +240,16 @@ func (v* C_GET_RSP) Encode(e *dicomio.Encoder) {
 	encodeField(e, dicom.TagAffectedSOPClassUID, v.AffectedSOPClassUID)
 	encodeField(e, dicom.TagMessageIDBeingRespondedTo, v.MessageIDBeingRespondedTo)
 	encodeField(e, dicom.TagCommandDataSetType, v.CommandDataSetType)
-	if v.NumberOfRemainingSuboperations != 0 {
+	if v.NumberOfRemainingSuboperations != 0 || v.Status.IsPending() {
 		encodeField(e, dicom.TagNumberOfRemainingSuboperations, v.NumberOfRemainingSuboperations)
 	}
-	if v.NumberOfCompletedSuboperations != 0 {
+	if v.NumberOfCompletedSuboperations != 0 || !v.Status.IsPending() {
 		encodeField(e, dicom.TagNumberOfCompletedSuboperations, v.NumberOfCompletedSuboperations)
 	}
-	if v.NumberOfFailedSuboperations != 0 {
+	if v.NumberOfFailedSuboperations != 0 || !v.Status.IsPending() {
 		encodeField(e, dicom.TagNumberOfFailedSuboperations, v.NumberOfFailedSuboperations)
 	}
-	if v.NumberOfWarningSuboperations != 0 {
+	if v.NumberOfWarningSuboperations != 0 || !v.Status.IsPending() {
 		encodeField(e, dicom.TagNumberOfWarningSuboperations, v.NumberOfWarningSuboperations)
 	}
 	encodeStatus(e, v.Status)
@@ -343,16 +343,16 @@ func (v* C_MOVE_RSP) Encode(e *dicomio.Encoder) {
 	encodeField(e, dicom.TagAffectedSOPClassUID, v.AffectedSOPClassUID)
 	encodeField(e, dicom.TagMessageIDBeingRespondedTo, v.MessageIDBeingRespondedTo)
 	encodeField(e, dicom.TagCommandDataSetType, v.CommandDataSetType)
-	if v.NumberOfRemainingSuboperations != 0 {
+	if v.NumberOfRemainingSuboperations != 0 || v.Status.IsPending() {
 		encodeField(e, dicom.TagNumberOfRemainingSuboperations, v.NumberOfRemainingSuboperations)
 	}
-	if v.NumberOfCompletedSuboperations != 0 {
+	if v.NumberOfCompletedSuboperations != 0 || !v.Status.IsPending() {
 		encodeField(e, dicom.TagNumberOfCompletedSuboperations, v.NumberOfCompletedSuboperations)
 	}
-	if v.NumberOfFailedSuboperations != 0 {
+	if v.NumberOfFailedSuboperations != 0 || !v.Status.IsPending() {
 		encodeField(e, dicom.TagNumberOfFailedSuboperations, v.NumberOfFailedSuboperations)
 	}
-	if v.NumberOfWarningSuboperations != 0 {
+	if v.NumberOfWarningSuboperations != 0 || !v.Status.IsPending() {
 		encodeField(e, dicom.TagNumberOfWarningSuboperations, v.NumberOfWarningSuboperations)
 	}
 	encodeStatus(e, v.Status)
@@ -457,6 +457,132 @@ func decodeC_ECHO_RSP(d *messageDecoder) *C_ECHO_RSP {
 	v.Extra = d.unparsedElements()
 	return v
 }
+type C_CANCEL_RQ struct  {
+	MessageIDBeingRespondedTo uint16
+	CommandDataSetType uint16
+	Extra []*dicom.Element  // Unparsed elements
+}
+
+func (v* C_CANCEL_RQ) Encode(e *dicomio.Encoder) {
+	encodeField(e, dicom.TagCommandField, uint16(4095))
+	encodeField(e, dicom.TagMessageIDBeingRespondedTo, v.MessageIDBeingRespondedTo)
+	encodeField(e, dicom.TagCommandDataSetType, v.CommandDataSetType)
+	for _, elem := range v.Extra {
+		dicom.WriteElement(e, elem)
+	}
+}
+
+func (v* C_CANCEL_RQ) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v* C_CANCEL_RQ) GetMessageID() uint16 {
+	return v.MessageIDBeingRespondedTo
+}
+
+func (v* C_CANCEL_RQ) String() string {
+	return fmt.Sprintf("C_CANCEL_RQ{MessageIDBeingRespondedTo:%v CommandDataSetType:%v}}", v.MessageIDBeingRespondedTo, v.CommandDataSetType)
+}
+
+func decodeC_CANCEL_RQ(d *messageDecoder) *C_CANCEL_RQ {
+	v := &C_CANCEL_RQ{}
+	v.MessageIDBeingRespondedTo = d.getUInt16(dicom.TagMessageIDBeingRespondedTo, RequiredElement)
+	v.CommandDataSetType = d.getUInt16(dicom.TagCommandDataSetType, RequiredElement)
+	v.Extra = d.unparsedElements()
+	return v
+}
+type N_GET_RQ struct  {
+	RequestedSOPClassUID string
+	MessageID uint16
+	CommandDataSetType uint16
+	RequestedSOPInstanceUID string
+	AttributeIdentifierList []dicom.Tag
+	Extra []*dicom.Element  // Unparsed elements
+}
+
+func (v* N_GET_RQ) Encode(e *dicomio.Encoder) {
+	encodeField(e, dicom.TagCommandField, uint16(272))
+	encodeField(e, dicom.TagRequestedSOPClassUID, v.RequestedSOPClassUID)
+	encodeField(e, dicom.TagMessageID, v.MessageID)
+	encodeField(e, dicom.TagCommandDataSetType, v.CommandDataSetType)
+	encodeField(e, dicom.TagRequestedSOPInstanceUID, v.RequestedSOPInstanceUID)
+	if len(v.AttributeIdentifierList) > 0 {
+		encodeTagsField(e, dicom.TagAttributeIdentifierList, v.AttributeIdentifierList)
+	}
+	for _, elem := range v.Extra {
+		dicom.WriteElement(e, elem)
+	}
+}
+
+func (v* N_GET_RQ) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v* N_GET_RQ) GetMessageID() uint16 {
+	return v.MessageID
+}
+
+func (v* N_GET_RQ) String() string {
+	return fmt.Sprintf("N_GET_RQ{RequestedSOPClassUID:%v MessageID:%v CommandDataSetType:%v RequestedSOPInstanceUID:%v AttributeIdentifierList:%v}}", v.RequestedSOPClassUID, v.MessageID, v.CommandDataSetType, v.RequestedSOPInstanceUID, v.AttributeIdentifierList)
+}
+
+func decodeN_GET_RQ(d *messageDecoder) *N_GET_RQ {
+	v := &N_GET_RQ{}
+	v.RequestedSOPClassUID = d.getString(dicom.TagRequestedSOPClassUID, RequiredElement)
+	v.MessageID = d.getUInt16(dicom.TagMessageID, RequiredElement)
+	v.CommandDataSetType = d.getUInt16(dicom.TagCommandDataSetType, RequiredElement)
+	v.RequestedSOPInstanceUID = d.getString(dicom.TagRequestedSOPInstanceUID, RequiredElement)
+	v.AttributeIdentifierList = d.getTags(dicom.TagAttributeIdentifierList, OptionalElement)
+	v.Extra = d.unparsedElements()
+	return v
+}
+type N_GET_RSP struct  {
+	AffectedSOPClassUID string
+	MessageIDBeingRespondedTo uint16
+	CommandDataSetType uint16
+	AffectedSOPInstanceUID string
+	Status Status
+	Extra []*dicom.Element  // Unparsed elements
+}
+
+func (v* N_GET_RSP) Encode(e *dicomio.Encoder) {
+	encodeField(e, dicom.TagCommandField, uint16(33040))
+	if v.AffectedSOPClassUID != "" {
+		encodeField(e, dicom.TagAffectedSOPClassUID, v.AffectedSOPClassUID)
+	}
+	encodeField(e, dicom.TagMessageIDBeingRespondedTo, v.MessageIDBeingRespondedTo)
+	encodeField(e, dicom.TagCommandDataSetType, v.CommandDataSetType)
+	if v.AffectedSOPInstanceUID != "" {
+		encodeField(e, dicom.TagAffectedSOPInstanceUID, v.AffectedSOPInstanceUID)
+	}
+	encodeStatus(e, v.Status)
+	for _, elem := range v.Extra {
+		dicom.WriteElement(e, elem)
+	}
+}
+
+func (v* N_GET_RSP) HasData() bool {
+	return v.CommandDataSetType != CommandDataSetTypeNull
+}
+
+func (v* N_GET_RSP) GetMessageID() uint16 {
+	return v.MessageIDBeingRespondedTo
+}
+
+func (v* N_GET_RSP) String() string {
+	return fmt.Sprintf("N_GET_RSP{AffectedSOPClassUID:%v MessageIDBeingRespondedTo:%v CommandDataSetType:%v AffectedSOPInstanceUID:%v Status:%v}}", v.AffectedSOPClassUID, v.MessageIDBeingRespondedTo, v.CommandDataSetType, v.AffectedSOPInstanceUID, v.Status)
+}
+
+func decodeN_GET_RSP(d *messageDecoder) *N_GET_RSP {
+	v := &N_GET_RSP{}
+	v.AffectedSOPClassUID = d.getString(dicom.TagAffectedSOPClassUID, OptionalElement)
+	v.MessageIDBeingRespondedTo = d.getUInt16(dicom.TagMessageIDBeingRespondedTo, RequiredElement)
+	v.CommandDataSetType = d.getUInt16(dicom.TagCommandDataSetType, RequiredElement)
+	v.AffectedSOPInstanceUID = d.getString(dicom.TagAffectedSOPInstanceUID, OptionalElement)
+	v.Status = d.getStatus()
+	v.Extra = d.unparsedElements()
+	return v
+}
 func decodeMessageForType(d* messageDecoder, commandField uint16) Message {
 	switch commandField {
 	case 0x1:
@@ -479,6 +605,12 @@ func decodeMessageForType(d* messageDecoder, commandField uint16) Message {
 		return decodeC_ECHO_RQ(d)
 	case 0x8030:
 		return decodeC_ECHO_RSP(d)
+	case 0xfff:
+		return decodeC_CANCEL_RQ(d)
+	case 0x110:
+		return decodeN_GET_RQ(d)
+	case 0x8110:
+		return decodeN_GET_RSP(d)
 	default:
 		d.setError(fmt.Errorf("Unknown DIMSE command 0x%x", commandField))
 		return nil
@@ -1,9 +1,16 @@
 package dimse_test
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"github.com/yasushi-saito/go-dicom"
 	"github.com/yasushi-saito/go-dicom/dicomio"
 	"github.com/yasushi-saito/go-netdicom/dimse"
+	"github.com/yasushi-saito/go-netdicom/pdu"
+	"io/ioutil"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -52,3 +59,418 @@ func TestCEchoRsp(t *testing.T) {
 		dimse.Status{Status: dimse.StatusCode(0x2345)},
 		nil})
 }
+
+func TestCCancelRq(t *testing.T) {
+	v := &dimse.C_CANCEL_RQ{0x1234, dimse.CommandDataSetTypeNull, nil}
+	testDIMSE(t, v)
+	if v.GetMessageID() != 0x1234 {
+		t.Errorf("Wrong message ID: %v", v.GetMessageID())
+	}
+}
+
+func TestNGetRq(t *testing.T) {
+	testDIMSE(t, &dimse.N_GET_RQ{
+		"1.2.3",
+		0x1234,
+		dimse.CommandDataSetTypeNull,
+		"3.4.5",
+		[]dicom.Tag{dicom.TagPatientID, dicom.TagStudyInstanceUID},
+		nil})
+	testDIMSE(t, &dimse.N_GET_RQ{"1.2.3", 0x1234, dimse.CommandDataSetTypeNull, "3.4.5", nil, nil})
+}
+
+func TestAttributeIdentifierListRoundTrip(t *testing.T) {
+	tags := []dicom.Tag{dicom.TagPatientID, dicom.TagStudyInstanceUID, {Group: 0x0009, Element: 0x1001}}
+	e := dicomio.NewBytesEncoder(binary.LittleEndian, dicomio.ImplicitVR)
+	dimse.EncodeMessage(e, &dimse.N_GET_RQ{
+		RequestedSOPClassUID:    "1.2.3",
+		MessageID:               0x1234,
+		CommandDataSetType:      dimse.CommandDataSetTypeNull,
+		RequestedSOPInstanceUID: "3.4.5",
+		AttributeIdentifierList: tags,
+	})
+	if err := e.Error(); err != nil {
+		t.Fatal(err)
+	}
+	data := e.Bytes()
+	// (0000,1005), length 12, then little-endian (group, element) pairs.
+	want := []byte{0x00, 0x00, 0x05, 0x10, 0x0c, 0x00, 0x00, 0x00,
+		0x10, 0x00, 0x20, 0x00,
+		0x20, 0x00, 0x0d, 0x00,
+		0x09, 0x00, 0x01, 0x10}
+	if !bytes.Contains(data, want) {
+		t.Errorf("AttributeIdentifierList not encoded as AT pairs: %x", data)
+	}
+	d := dicomio.NewBytesDecoder(data, binary.LittleEndian, dicomio.ImplicitVR)
+	v := dimse.ReadMessage(d)
+	if err := d.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	got := v.(*dimse.N_GET_RQ).AttributeIdentifierList
+	if !reflect.DeepEqual(got, tags) {
+		t.Errorf("Got %v, want %v", got, tags)
+	}
+}
+
+func TestNGetRsp(t *testing.T) {
+	testDIMSE(t, &dimse.N_GET_RSP{
+		"1.2.3",
+		0x1234,
+		dimse.CommandDataSetTypeNonNull,
+		"3.4.5",
+		dimse.Success,
+		nil})
+}
+
+func TestCFindRsp(t *testing.T) {
+	pending := &dimse.C_FIND_RSP{
+		AffectedSOPClassUID:       "1.2.3",
+		MessageIDBeingRespondedTo: 0x1234,
+		CommandDataSetType:        dimse.CommandDataSetTypeNonNull,
+		Status:                    dimse.Status{Status: dimse.StatusPending},
+	}
+	testDIMSE(t, pending)
+	if !pending.HasData() {
+		t.Errorf("Pending response must have data: %v", pending)
+	}
+	final := &dimse.C_FIND_RSP{
+		AffectedSOPClassUID:       "1.2.3",
+		MessageIDBeingRespondedTo: 0x1234,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		Status:                    dimse.Success,
+	}
+	testDIMSE(t, final)
+	if final.HasData() {
+		t.Errorf("Final response must not have data: %v", final)
+	}
+}
+
+func TestEncodeDecodeMessageBytes(t *testing.T) {
+	v := &dimse.C_ECHO_RQ{MessageID: 0x1234, CommandDataSetType: dimse.CommandDataSetTypeNull}
+	data, err := dimse.EncodeMessageToBytes(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		0, 0, 0, 0, 4, 0, 0, 0, 30, 0, 0, 0, // CommandGroupLength
+		0, 0, 0, 1, 2, 0, 0, 0, 0x30, 0, // CommandField
+		0, 0, 0x10, 1, 2, 0, 0, 0, 0x34, 0x12, // MessageID
+		0, 0, 0, 8, 2, 0, 0, 0, 1, 1, // CommandDataSetType
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Encoded bytes mismatch:\n got %v\n expect %v", data, expected)
+	}
+	v2, err := dimse.DecodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.String() != v2.String() {
+		t.Errorf("%v <-> %v", v, v2)
+	}
+	if _, err := dimse.DecodeMessage(data[:len(data)-1]); err == nil {
+		t.Error("Expect an error for a truncated message")
+	}
+}
+
+func TestCommandGroupLengthMismatch(t *testing.T) {
+	data, err := dimse.EncodeMessageToBytes(&dimse.C_ECHO_RQ{MessageID: 0x1234, CommandDataSetType: dimse.CommandDataSetTypeNull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bytes 8-11 hold the CommandGroupLength value.
+	for _, delta := range []int{-2, 2} {
+		corrupted := append([]byte{}, data...)
+		binary.LittleEndian.PutUint32(corrupted[8:], uint32(len(data)-12+delta))
+		if v, err := dimse.DecodeMessage(corrupted); err == nil {
+			t.Errorf("Expect an error for group length delta %d, got %v", delta, v)
+		}
+	}
+	// Extra bytes after the command are also a mismatch.
+	padded := append(append([]byte{}, data...), 0, 0, 0, 0, 0, 0, 0, 0)
+	if v, err := dimse.DecodeMessage(padded); err == nil {
+		t.Errorf("Expect an error for a padded command, got %v", v)
+	}
+}
+
+// A P-DATA-TF PDU from the fuzzer corpus, carrying a C-ECHO-RQ whose
+// MessageID (US) holds a string. In implicit VR, the string decodes as two US
+// values.
+func TestMalformedUInt16Element(t *testing.T) {
+	data, err := ioutil.ReadFile("../fuzzpdu/corpus/malformed-uint16-element")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := pdu.ReadPDU(bytes.NewReader(data), 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a dimse.CommandAssembler
+	_, msg, _, err := a.AddDataPDU(v.(*pdu.P_DATA_TF))
+	if err == nil {
+		t.Fatalf("Expect an error, got %v", msg)
+	}
+	if msg := err.Error(); !strings.Contains(msg, dicom.TagString(dicom.TagMessageID)) || !strings.Contains(msg, "US") {
+		t.Errorf("Error should name the tag and the expected type: %v", err)
+	}
+}
+
+func TestCommandAssemblerTrailingItems(t *testing.T) {
+	command, err := dimse.EncodeMessageToBytes(&dimse.C_ECHO_RQ{MessageID: 0x1234, CommandDataSetType: dimse.CommandDataSetTypeNull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	padded := &pdu.P_DATA_TF{Items: []pdu.PresentationDataValueItem{
+		{ContextID: 1, Command: true, Last: true, Value: command},
+		{ContextID: 1, Command: false, Last: true, Value: make([]byte, 16)},
+	}}
+
+	a := dimse.CommandAssembler{}
+	contextID, msg, data, err := a.AddDataPDU(padded)
+	if err != nil || contextID != 1 || msg == nil || len(data) != 0 {
+		t.Fatalf("Lenient mode: got %v %v %v %v", contextID, msg, data, err)
+	}
+	if msg.GetMessageID() != 0x1234 {
+		t.Errorf("Wrong message: %v", msg)
+	}
+	if _, msg, _, err := a.NextMessage(); err != nil || msg != nil {
+		t.Errorf("Lenient mode: the padding produced %v %v", msg, err)
+	}
+	// The padding must not leak into the next message.
+	_, msg, data, err = a.AddDataPDU(padded)
+	if err != nil || msg == nil || len(data) != 0 {
+		t.Errorf("Lenient mode, second message: got %v %v %v", msg, data, err)
+	}
+
+	a = dimse.CommandAssembler{Strict: true}
+	if _, msg, _, err := a.AddDataPDU(padded); err != nil || msg == nil {
+		t.Fatalf("Strict mode: got %v %v", msg, err)
+	}
+	if _, msg, _, err := a.NextMessage(); err == nil {
+		t.Errorf("Strict mode: expect an error for the padding, got %v", msg)
+	}
+}
+
+// A PDU may carry the last fragment of one message and the start of the
+// next, or several complete messages.
+func TestCommandAssemblerTwoMessagesInOnePDU(t *testing.T) {
+	echo, err := dimse.EncodeMessageToBytes(&dimse.C_ECHO_RQ{MessageID: 1, CommandDataSetType: dimse.CommandDataSetTypeNull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := dimse.EncodeMessageToBytes(&dimse.C_STORE_RQ{
+		AffectedSOPClassUID:    "1.2.840.10008.5.1.4.1.1.2",
+		MessageID:              2,
+		CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+		AffectedSOPInstanceUID: "1.2.3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, strict := range []bool{false, true} {
+		a := dimse.CommandAssembler{Strict: strict}
+		contextID, msg, data, err := a.AddDataPDU(&pdu.P_DATA_TF{Items: []pdu.PresentationDataValueItem{
+			{ContextID: 1, Command: true, Last: true, Value: echo},
+			{ContextID: 3, Command: true, Last: true, Value: store},
+			{ContextID: 3, Command: false, Last: false, Value: []byte("abcd")},
+		}})
+		if err != nil || contextID != 1 || msg == nil || msg.GetMessageID() != 1 || len(data) != 0 {
+			t.Fatalf("Strict=%v, first message: got %v %v %v %v", strict, contextID, msg, data, err)
+		}
+		// The C-STORE needs more data.
+		if _, msg, _, err := a.NextMessage(); err != nil || msg != nil {
+			t.Fatalf("Strict=%v: got %v %v before the last data fragment", strict, msg, err)
+		}
+		contextID, msg, data, err = a.AddDataPDU(&pdu.P_DATA_TF{Items: []pdu.PresentationDataValueItem{
+			{ContextID: 3, Command: false, Last: true, Value: []byte("efgh")},
+			{ContextID: 1, Command: true, Last: true, Value: echo},
+		}})
+		if err != nil || contextID != 3 || msg == nil || msg.GetMessageID() != 2 || string(data) != "abcdefgh" {
+			t.Fatalf("Strict=%v, second message: got %v %v %q %v", strict, contextID, msg, data, err)
+		}
+		contextID, msg, data, err = a.NextMessage()
+		if err != nil || contextID != 1 || msg == nil || msg.GetMessageID() != 1 || len(data) != 0 {
+			t.Fatalf("Strict=%v, third message: got %v %v %v %v", strict, contextID, msg, data, err)
+		}
+		if _, msg, _, err := a.NextMessage(); err != nil || msg != nil {
+			t.Errorf("Strict=%v: got %v %v after the last message", strict, msg, err)
+		}
+	}
+}
+
+func TestStatusCategory(t *testing.T) {
+	for _, test := range []struct {
+		code     dimse.StatusCode
+		category dimse.StatusCategory
+	}{
+		{dimse.StatusSuccess, dimse.StatusCategorySuccess},
+		{dimse.StatusPending, dimse.StatusCategoryPending},
+		{0xff01, dimse.StatusCategoryPending},
+		{dimse.StatusCancel, dimse.StatusCategoryCancel},
+		{0xb000, dimse.StatusCategoryWarning},
+		{0xb123, dimse.StatusCategoryWarning}, // vendor-specific
+		{dimse.CStoreStatusDuplicateInstance, dimse.StatusCategoryWarning},
+		{dimse.StatusAttributeValueOutOfRange, dimse.StatusCategoryWarning},
+		{dimse.CStoreStatusOutOfResources, dimse.StatusCategoryFailure},
+		{dimse.CStoreStatusCannotUnderstand, dimse.StatusCategoryFailure},
+		{dimse.StatusUnrecognizedOperation, dimse.StatusCategoryFailure},
+		{0x1234, dimse.StatusCategoryUnknown},
+	} {
+		status := dimse.Status{Status: test.code}
+		if c := status.Category(); c != test.category {
+			t.Errorf("0x%04x: got %v, want %v", uint16(test.code), c, test.category)
+		}
+	}
+	if !(dimse.Status{Status: 0xb007}).IsWarning() || (dimse.Status{Status: 0x1234}).IsFailure() {
+		t.Error("Wrong predicates")
+	}
+}
+
+// Encode "body", a dataset, inside "depth" levels of sequences (or, if
+// "strayItems", of bare items), in implicit or explicit VR little endian, with
+// defined or undefined lengths.
+func nestDataSet(body []byte, depth int, explicit, defined, strayItems bool) []byte {
+	header := func(tag dicom.Tag, vr string, length uint32) []byte {
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, []uint16{tag.Group, tag.Element})
+		if explicit && tag.Group != dicom.TagItem.Group {
+			b.WriteString(vr)
+			b.Write([]byte{0, 0})
+		}
+		binary.Write(&b, binary.LittleEndian, length)
+		return b.Bytes()
+	}
+	wrap := func(tag dicom.Tag, vr string, end dicom.Tag, body []byte) []byte {
+		if defined {
+			return append(header(tag, vr, uint32(len(body))), body...)
+		}
+		b := append(header(tag, vr, 0xffffffff), body...)
+		return append(b, header(end, "", 0)...)
+	}
+	for i := 0; i < depth; i++ {
+		body = wrap(dicom.TagItem, "", dicom.TagItemDelimitationItem, body)
+		if !strayItems {
+			body = wrap(dicom.Tag{Group: 0x0008, Element: 0x1115}, "SQ", dicom.TagSequenceDelimitationItem, body)
+		}
+	}
+	return body
+}
+
+func TestCheckSequenceDepth(t *testing.T) {
+	leaf := map[bool][]byte{
+		false: {0x10, 0x00, 0x20, 0x00, 4, 0, 0, 0, 'f', 'o', 'o', ' '},
+		true:  {0x10, 0x00, 0x20, 0x00, 'L', 'O', 4, 0, 'f', 'o', 'o', ' '},
+	}
+	syntaxes := map[bool]string{false: "1.2.840.10008.1.2", true: "1.2.840.10008.1.2.1"}
+	for _, explicit := range []bool{false, true} {
+		for _, defined := range []bool{false, true} {
+			for _, strayItems := range []bool{false, true} {
+				name := fmt.Sprintf("explicit=%v defined=%v strayItems=%v", explicit, defined, strayItems)
+				data := nestDataSet(leaf[explicit], dimse.DefaultMaxSequenceDepth, explicit, defined, strayItems)
+				if err := dimse.CheckSequenceDepth(data, syntaxes[explicit], 0); err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+				// Make sure that the data is well formed.
+				d := dicomio.NewBytesDecoderWithTransferSyntax(data, syntaxes[explicit])
+				dicom.ReadElement(d, dicom.ReadOptions{})
+				if err := d.Finish(); err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+				data = nestDataSet(leaf[explicit], dimse.DefaultMaxSequenceDepth+1, explicit, defined, strayItems)
+				if err := dimse.CheckSequenceDepth(data, syntaxes[explicit], 0); err == nil {
+					t.Errorf("%s: sequences nested too deep were accepted", name)
+				}
+				if err := dimse.CheckSequenceDepth(data, syntaxes[explicit], dimse.DefaultMaxSequenceDepth+1); err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+			}
+		}
+	}
+}
+
+func TestCommandAssemblerSequenceDepth(t *testing.T) {
+	command, err := dimse.EncodeMessageToBytes(&dimse.C_ECHO_RQ{MessageID: 0x1234, CommandDataSetType: dimse.CommandDataSetTypeNull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := []byte{0x00, 0x00, 0x00, 0x09, 2, 0, 0, 0, 0, 0} // (0000,0900) Status
+	deep := append(command, nestDataSet(leaf, 3, false, false, false)...)
+	p := &pdu.P_DATA_TF{Items: []pdu.PresentationDataValueItem{
+		{ContextID: 1, Command: true, Last: true, Value: deep},
+	}}
+	a := dimse.CommandAssembler{MaxSequenceDepth: 2}
+	if _, msg, _, err := a.AddDataPDU(p); err == nil || !strings.Contains(err.Error(), "nested deeper than 2") {
+		t.Errorf("Expect a nesting error, got %v %v", msg, err)
+	}
+}
+
+func TestSuboperationCountsWithZeroMatches(t *testing.T) {
+	hasTag := func(v dimse.Message, tag dicom.Tag) bool {
+		e := dicomio.NewBytesEncoder(binary.LittleEndian, dicomio.ImplicitVR)
+		v.Encode(e)
+		d := dicomio.NewBytesDecoder(e.Bytes(), binary.LittleEndian, dicomio.ImplicitVR)
+		for d.Len() > 0 {
+			elem := dicom.ReadElement(d, dicom.ReadOptions{})
+			if err := d.Error(); err != nil {
+				t.Fatal(err)
+			}
+			if elem.Tag == tag {
+				return true
+			}
+		}
+		return false
+	}
+	// The final response reports zero completed sub-operations, rather than
+	// omitting the count.
+	final := &dimse.C_MOVE_RSP{
+		AffectedSOPClassUID:       "1.2.3",
+		MessageIDBeingRespondedTo: 0x1234,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		Status:                    dimse.Success,
+	}
+	if !hasTag(final, dicom.TagNumberOfCompletedSuboperations) || !hasTag(final, dicom.TagNumberOfFailedSuboperations) {
+		t.Error("Final C-MOVE response lacks the sub-operation counts")
+	}
+	if hasTag(final, dicom.TagNumberOfRemainingSuboperations) {
+		t.Error("Final C-MOVE response has the number of remaining sub-operations")
+	}
+	pending := &dimse.C_GET_RSP{
+		AffectedSOPClassUID:       "1.2.3",
+		MessageIDBeingRespondedTo: 0x1234,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		Status:                    dimse.Status{Status: dimse.StatusPending},
+	}
+	if !hasTag(pending, dicom.TagNumberOfRemainingSuboperations) {
+		t.Error("Pending C-GET response lacks the number of remaining sub-operations")
+	}
+}
+
+// Decode a C-FIND command that carries many attributes. The decoder looks up
+// the optional ErrorComment, which is missing.
+func BenchmarkReadMessageCFindRsp(b *testing.B) {
+	v := &dimse.C_FIND_RSP{
+		AffectedSOPClassUID:       "1.2.3",
+		MessageIDBeingRespondedTo: 0x1234,
+		CommandDataSetType:        dimse.CommandDataSetTypeNonNull,
+		Status:                    dimse.Status{Status: dimse.StatusPending},
+	}
+	for i := 0; i < 1000; i++ {
+		v.Extra = append(v.Extra, dicom.MustNewElement(dicom.Tag{Group: 0x0009, Element: uint16(0x1000 + i)}, "value"))
+	}
+	e := dicomio.NewBytesEncoder(binary.LittleEndian, dicomio.ImplicitVR)
+	dimse.EncodeMessage(e, v)
+	if err := e.Error(); err != nil {
+		b.Fatal(err)
+	}
+	data := e.Bytes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d := dicomio.NewBytesDecoder(data, binary.LittleEndian, dicomio.ImplicitVR)
+		v2 := dimse.ReadMessage(d)
+		if err := d.Finish(); err != nil {
+			b.Fatal(err)
+		}
+		if len(v2.(*dimse.C_FIND_RSP).Extra) != len(v.Extra) {
+			b.Fatalf("Wrong # of attributes: %v", v2)
+		}
+	}
+}
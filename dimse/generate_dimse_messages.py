@@ -3,9 +3,22 @@
 import enum
 from typing import IO, List, NamedTuple
 
+# If "encode_if" is set, an optional field is encoded also when it is zero, as
+# long as the Go expression evaluates to true.
 Field = NamedTuple('Field', [('name', str),
                              ('type', str),
-                             ('required', bool)])
+                             ('required', bool),
+                             ('encode_if', str)])
+Field.__new__.__defaults__ = ('',)
+
+# P3.4 C.4.2.1.5: pending C-MOVE and C-GET responses carry the number of
+# remaining sub-operations, and the final ones carry the other counts, even if
+# they are zero, e.g., when the request matched nothing.
+SUBOPERATION_FIELDS = [
+    Field('NumberOfRemainingSuboperations', 'uint16', False, 'v.Status.IsPending()'),
+    Field('NumberOfCompletedSuboperations', 'uint16', False, '!v.Status.IsPending()'),
+    Field('NumberOfFailedSuboperations', 'uint16', False, '!v.Status.IsPending()'),
+    Field('NumberOfWarningSuboperations', 'uint16', False, '!v.Status.IsPending()')]
 class Type(enum.Enum):
     REQUEST = 1
     RESPONSE = 2
@@ -59,12 +72,9 @@ MESSAGES = [
             Type.RESPONSE, 0x8010,
             [Field('AffectedSOPClassUID', 'string', True),
              Field('MessageIDBeingRespondedTo', 'uint16', True),
-             Field('CommandDataSetType', 'uint16', True),
-             Field('NumberOfRemainingSuboperations', 'uint16', False),
-             Field('NumberOfCompletedSuboperations', 'uint16', False),
-             Field('NumberOfFailedSuboperations', 'uint16', False),
-             Field('NumberOfWarningSuboperations', 'uint16', False),
-	     Field('Status', 'Status', True)]),
+             Field('CommandDataSetType', 'uint16', True)] +
+            SUBOPERATION_FIELDS +
+            [Field('Status', 'Status', True)]),
     # P3.7 9.3.4.1
     Message('C_MOVE_RQ',
             Type.REQUEST, 0x21,
@@ -77,12 +87,9 @@ MESSAGES = [
             Type.RESPONSE, 0x8021,
             [Field('AffectedSOPClassUID', 'string', True),
              Field('MessageIDBeingRespondedTo', 'uint16', True),
-             Field('CommandDataSetType', 'uint16', True),
-             Field('NumberOfRemainingSuboperations', 'uint16', False),
-             Field('NumberOfCompletedSuboperations', 'uint16', False),
-             Field('NumberOfFailedSuboperations', 'uint16', False),
-             Field('NumberOfWarningSuboperations', 'uint16', False),
-	     Field('Status', 'Status', True)]),
+             Field('CommandDataSetType', 'uint16', True)] +
+            SUBOPERATION_FIELDS +
+            [Field('Status', 'Status', True)]),
     # P3.7 9.3.5
     Message('C_ECHO_RQ',
             Type.REQUEST, 0x30,
@@ -92,7 +99,28 @@ MESSAGES = [
             Type.RESPONSE, 0x8030,
             [Field('MessageIDBeingRespondedTo', 'uint16', True),
              Field('CommandDataSetType', 'uint16', True),
-	     Field('Status', 'Status', True)])
+	     Field('Status', 'Status', True)]),
+    # P3.7 9.3.2.3. Cancels the C-FIND, C-GET, or C-MOVE whose MessageID is
+    # MessageIDBeingRespondedTo.
+    Message('C_CANCEL_RQ',
+            Type.REQUEST, 0xfff,
+            [Field('MessageIDBeingRespondedTo', 'uint16', True),
+             Field('CommandDataSetType', 'uint16', True)]),
+    # P3.7 10.3.2
+    Message('N_GET_RQ',
+            Type.REQUEST, 0x110,
+            [Field('RequestedSOPClassUID', 'string', True),
+             Field('MessageID', 'uint16', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('RequestedSOPInstanceUID', 'string', True),
+             Field('AttributeIdentifierList', '[]dicom.Tag', False)]),
+    Message('N_GET_RSP',
+            Type.RESPONSE, 0x8110,
+            [Field('AffectedSOPClassUID', 'string', False),
+             Field('MessageIDBeingRespondedTo', 'uint16', True),
+             Field('CommandDataSetType', 'uint16', True),
+             Field('AffectedSOPInstanceUID', 'string', False),
+             Field('Status', 'Status', True)])
 ]
 
 def generate_go_definition(m: Message, out: IO[str]):
@@ -106,12 +134,21 @@ def generate_go_definition(m: Message, out: IO[str]):
     print(f'func (v* {m.name}) Encode(e *dicomio.Encoder) {{', file=out)
     print(f'	encodeField(e, dicom.TagCommandField, uint16({m.command_field}))', file=out)
     for f in m.fields:
-        if not f.required:
+        if f.type == '[]dicom.Tag':
+            # Attribute tags (AT) are only optional.
+            assert not f.required
+            print(f'	if len(v.{f.name}) > 0 {{', file=out)
+            print(f'		encodeTagsField(e, dicom.Tag{f.name}, v.{f.name})', file=out)
+            print(f'	}}', file=out)
+        elif not f.required:
             if f.type == 'string':
                 zero = '""'
             else:
                 zero = '0'
-            print(f'	if v.{f.name} != {zero} {{', file=out)
+            cond = f'v.{f.name} != {zero}'
+            if f.encode_if:
+                cond += f' || {f.encode_if}'
+            print(f'	if {cond} {{', file=out)
             print(f'		encodeField(e, dicom.Tag{f.name}, v.{f.name})', file=out)
             print(f'	}}', file=out)
         elif f.type == 'Status':
@@ -130,7 +167,7 @@ def generate_go_definition(m: Message, out: IO[str]):
 
     print('', file=out)
     print(f'func (v* {m.name}) GetMessageID() uint16 {{', file=out)
-    if m.type == Type.REQUEST:
+    if m.type == Type.REQUEST and m.fields[0].name != 'MessageIDBeingRespondedTo':
         print(f'	return v.MessageID', file=out)
     else:
         print(f'	return v.MessageIDBeingRespondedTo', file=out)
@@ -167,6 +204,8 @@ def generate_go_definition(m: Message, out: IO[str]):
                 decoder = 'UInt16'
             elif f.type == 'uint32':
                 decoder = 'UInt32'
+            elif f.type == '[]dicom.Tag':
+                decoder = 'Tags'
             else:
                 raise Exception(f)
             if f.required:
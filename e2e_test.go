@@ -1,17 +1,27 @@
 package netdicom_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
+	"fmt"
 	"github.com/yasushi-saito/go-dicom"
 	"github.com/yasushi-saito/go-dicom/dicomio"
 	"github.com/yasushi-saito/go-dicom/dicomuid"
 	"github.com/yasushi-saito/go-netdicom"
 	"github.com/yasushi-saito/go-netdicom/dimse"
+	"github.com/yasushi-saito/go-netdicom/pdu"
 	"github.com/yasushi-saito/go-netdicom/sopclass"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 	"v.io/x/lib/vlog"
 )
 
@@ -31,6 +41,10 @@ func initTest() {
 			params := netdicom.ServiceProviderParams{
 				CStore: onCStoreRequest,
 				CFind:  onCFindRequest,
+				CGet:   onCGetRequest,
+				QRExtendedNegotiation: netdicom.QRExtendedNegotiation{
+					Relational: true,
+				},
 			}
 			for {
 				conn, err := listener.Accept()
@@ -39,30 +53,60 @@ func initTest() {
 					continue
 				}
 				vlog.Infof("Accepted connection %v", conn)
-				netdicom.RunProviderForConn(conn, params)
+				go netdicom.RunProviderForConn(conn, params)
 			}
 		}()
 		serverAddr = listener.Addr().String()
 	})
 }
 
-func onCStoreRequest(
-	transferSyntaxUID string,
-	sopClassUID string,
-	sopInstanceUID string,
-	data []byte) dimse.Status {
+const ctImageStorage = "1.2.840.10008.5.1.4.1.1.2"
+
+// Start a service provider on an ephemeral port. It is shut down when the
+// test finishes.
+func startServiceProvider(t *testing.T, params netdicom.ServiceProviderParams) *netdicom.ServiceProvider {
+	t.Helper()
+	sp, err := netdicom.NewServiceProvider(params, ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sp.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := sp.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+	return sp
+}
+
+// Create a service user that proposes sopClasses, and connect it to sp.
+func newServiceUser(t *testing.T, sp *netdicom.ServiceProvider, callingAETitle string, sopClasses []sopclass.SOPUID) *netdicom.ServiceUser {
+	t.Helper()
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", callingAETitle, sopClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	su := netdicom.NewServiceUser(params)
+	su.Connect(sp.ListenAddr().String())
+	return su
+}
+
+func onCStoreRequest(req netdicom.CStoreRequest) dimse.Status {
 	vlog.Infof("Start C-STORE handler, transfersyntax=%s, sopclass=%s, sopinstance=%s",
-		dicomuid.UIDString(transferSyntaxUID),
-		dicomuid.UIDString(sopClassUID),
-		dicomuid.UIDString(sopInstanceUID))
+		dicomuid.UIDString(req.TransferSyntaxUID),
+		dicomuid.UIDString(req.SOPClassUID),
+		dicomuid.UIDString(req.SOPInstanceUID))
 	e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
 	dicom.WriteFileHeader(e,
 		[]*dicom.Element{
-			dicom.MustNewElement(dicom.TagTransferSyntaxUID, transferSyntaxUID),
-			dicom.MustNewElement(dicom.TagMediaStorageSOPClassUID, sopClassUID),
-			dicom.MustNewElement(dicom.TagMediaStorageSOPInstanceUID, sopInstanceUID),
+			dicom.MustNewElement(dicom.TagTransferSyntaxUID, req.TransferSyntaxUID),
+			dicom.MustNewElement(dicom.TagMediaStorageSOPClassUID, req.SOPClassUID),
+			dicom.MustNewElement(dicom.TagMediaStorageSOPInstanceUID, req.SOPInstanceUID),
 		})
-	e.WriteBytes(data)
+	e.WriteBytes(req.Data)
 	if cstoreData != nil {
 		vlog.Fatal("Received C-STORE data twice")
 	}
@@ -71,14 +115,17 @@ func onCStoreRequest(
 	return dimse.Success
 }
 
-func onCFindRequest(
-	transferSyntaxUID string,
-	sopClassUID string,
-	filters []*dicom.Element,
-	ch chan netdicom.CFindResult) {
+// The QR extended negotiation outcome seen by the last C-FIND request.
+var cfindExtendedNegotiation netdicom.QRExtendedNegotiation
+
+func onCFindRequest(req netdicom.CFindRequest, ch chan netdicom.CFindResult) {
 	vlog.Infof("Received cfind request")
+	if req.QRLevel != "PATIENT" {
+		vlog.Fatalf("Wrong QR level: %v", req.QRLevel)
+	}
+	cfindExtendedNegotiation = req.Info.QRExtendedNegotiation(req.SOPClassUID)
 	found := 0
-	for _, elem := range filters {
+	for _, elem := range req.Filters {
 		vlog.Infof("Filter %v", elem)
 		if elem.Tag == dicom.TagQueryRetrieveLevel {
 			if elem.MustGetString() != "PATIENT" {
@@ -94,7 +141,7 @@ func onCFindRequest(
 		}
 	}
 	if found != 2 {
-		vlog.Fatalf("Didn't find expected filters: %v", filters)
+		vlog.Fatalf("Didn't find expected filters: %v", req.Filters)
 	}
 	ch <- netdicom.CFindResult{
 		Elements: []*dicom.Element{dicom.MustNewElement(dicom.TagPatientName, "johndoe")},
@@ -105,6 +152,16 @@ func onCFindRequest(
 	close(ch)
 }
 
+func onCGetRequest(req netdicom.CMoveRequest, ch chan netdicom.CMoveResult) {
+	path := "testdata/IM-0001-0003.dcm"
+	ch <- netdicom.CMoveResult{
+		Remaining: 0,
+		Path:      path,
+		DataSet:   readDICOMFile(path),
+	}
+	close(ch)
+}
+
 func checkFileBodiesEqual(t *testing.T, in, out *dicom.DataSet) {
 	var removeMetaElems = func(f *dicom.DataSet) []*dicom.Element {
 		var elems []*dicom.Element
@@ -173,6 +230,36 @@ func TestStoreSingleFile(t *testing.T) {
 	checkFileBodiesEqual(t, dataset, out)
 }
 
+func TestMessageIDGenerator(t *testing.T) {
+	initTest()
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "testclient", sopclass.QRFindClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint16
+	params.MessageIDGenerator = func() uint16 {
+		ids = append(ids, uint16(1000+len(ids)))
+		return ids[len(ids)-1]
+	}
+	su := netdicom.NewServiceUser(params)
+	su.Connect(serverAddr)
+	filter := []*dicom.Element{
+		dicom.MustNewElement(dicom.TagPatientName, "foohah"),
+	}
+	for i := 0; i < 2; i++ {
+		for result := range su.CFind(netdicom.CFindPatientQRLevel, filter) {
+			if result.Err != nil {
+				t.Error(result.Err)
+			}
+		}
+	}
+	su.Release()
+	if len(ids) != 2 || ids[0] != 1000 || ids[1] != 1001 {
+		t.Errorf("Wrong message IDs: %v", ids)
+	}
+}
+
 func TestFind(t *testing.T) {
 	initTest()
 	params, err := netdicom.NewServiceUserParams(
@@ -206,6 +293,228 @@ func TestFind(t *testing.T) {
 	}
 }
 
+func TestFindPatientStudyOnly(t *testing.T) {
+	initTest()
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "testclient", sopclass.QRFindClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	su := netdicom.NewServiceUser(params)
+	defer su.Release()
+	su.Connect(serverAddr)
+	filter := []*dicom.Element{
+		dicom.MustNewElement(dicom.TagPatientName, "foohah"),
+	}
+	n := 0
+	for result := range su.CFind(netdicom.CFindPatientStudyOnlyPatientQRLevel, filter) {
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Errorf("Expect two results, got %d", n)
+	}
+}
+
+func TestQRExtendedNegotiation(t *testing.T) {
+	initTest()
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "testclient", sopclass.QRFindClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.QRExtendedNegotiation = netdicom.QRExtendedNegotiation{
+		Relational:       true,
+		DateTimeMatching: true,
+	}
+	su := netdicom.NewServiceUser(params)
+	su.Connect(serverAddr)
+	filter := []*dicom.Element{
+		dicom.MustNewElement(dicom.TagPatientName, "foohah"),
+	}
+	for result := range su.CFind(netdicom.CFindPatientQRLevel, filter) {
+		if result.Err != nil {
+			t.Error(result.Err)
+		}
+	}
+	su.Release()
+	// The server supports only relational queries.
+	expected := netdicom.QRExtendedNegotiation{Relational: true}
+	if cfindExtendedNegotiation != expected {
+		t.Errorf("Wrong extended negotiation: %+v", cfindExtendedNegotiation)
+	}
+}
+
+func TestCGet(t *testing.T) {
+	initTest()
+	dataset := readDICOMFile("testdata/IM-0001-0003.dcm")
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "testclient",
+		append(append([]sopclass.SOPUID{}, sopclass.QRGetClasses...), sopclass.StorageClasses...), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	su := netdicom.NewServiceUser(params)
+	su.Connect(serverAddr)
+	defer su.Release()
+	filter := []*dicom.Element{
+		dicom.MustNewElement(dicom.TagPatientName, "foohah"),
+	}
+	var progress []netdicom.RetrieveProgress
+	var received []*dicom.DataSet
+	err = su.CGet(netdicom.CFindPatientQRLevel, filter,
+		func(p netdicom.RetrieveProgress) {
+			progress = append(progress, p)
+		},
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
+			dicom.WriteFileHeader(e,
+				[]*dicom.Element{
+					dicom.MustNewElement(dicom.TagTransferSyntaxUID, transferSyntaxUID),
+					dicom.MustNewElement(dicom.TagMediaStorageSOPClassUID, sopClassUID),
+					dicom.MustNewElement(dicom.TagMediaStorageSOPInstanceUID, sopInstanceUID),
+				})
+			e.WriteBytes(data)
+			ds, err := dicom.ReadDataSetInBytes(e.Bytes(), dicom.ReadOptions{})
+			if err != nil {
+				t.Error(err)
+				return dimse.Status{Status: dimse.CStoreStatusCannotUnderstand}
+			}
+			received = append(received, ds)
+			return dimse.Success
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 {
+		t.Fatalf("Expect one instance, got %d", len(received))
+	}
+	checkFileBodiesEqual(t, dataset, received[0])
+	if len(progress) != 2 ||
+		progress[0].Status.Status != dimse.StatusPending || progress[0].Completed != 1 ||
+		progress[1].Status.Status != dimse.StatusSuccess || progress[1].Completed != 1 {
+		t.Errorf("Wrong progress: %+v", progress)
+	}
+}
+
+func TestCStoreBatchResume(t *testing.T) {
+	var mu sync.Mutex
+	received := map[string]bool{}
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			if req.SOPInstanceUID == "1.2.3.5" {
+				return dimse.Status{Status: dimse.CStoreStatusCannotUnderstand}
+			}
+			mu.Lock()
+			received[req.SOPInstanceUID] = true
+			mu.Unlock()
+			return dimse.Success
+		},
+		// Drops each association after a few instances.
+		MaxBytesPerAssociation: 1000,
+	})
+	var datasets []*dicom.DataSet
+	for i := 0; i < 10; i++ {
+		uid := fmt.Sprintf("1.2.3.%d", i)
+		datasets = append(datasets, &dicom.DataSet{Elements: []*dicom.Element{
+			dicom.MustNewElement(dicom.TagSOPClassUID, ctImageStorage),
+			dicom.MustNewElement(dicom.TagSOPInstanceUID, uid),
+			dicom.MustNewElement(dicom.TagPatientID, "batchpatient"),
+		}})
+	}
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "batchclient", sopclass.StorageClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []int
+	var failed []int
+	next := 0
+	associations := 0
+	for next < len(datasets) {
+		associations++
+		if associations > len(datasets) {
+			t.Fatalf("No progress; stored %v", stored)
+		}
+		su := netdicom.NewServiceUser(params)
+		su.Connect(sp.ListenAddr().String())
+		result, err := su.CStoreBatch(datasets, next)
+		su.Release()
+		if (err == nil) != (result.Next == len(datasets)) {
+			t.Errorf("Wrong result %+v for error %v", result, err)
+		}
+		if result.Next < next {
+			t.Fatalf("Checkpoint went back from %d to %d", next, result.Next)
+		}
+		stored = append(stored, result.Stored...)
+		for _, f := range result.Failed {
+			failed = append(failed, f.Index)
+		}
+		next = result.Next
+	}
+	if associations < 2 {
+		t.Error("The byte limit should have dropped an association")
+	}
+	if len(failed) != 1 || failed[0] != 5 {
+		t.Errorf("Wrong failed instances: %v", failed)
+	}
+	want := []int{0, 1, 2, 3, 4, 6, 7, 8, 9}
+	if fmt.Sprint(stored) != fmt.Sprint(want) {
+		t.Errorf("Stored %v, want %v", stored, want)
+	}
+	for _, i := range want {
+		if uid := fmt.Sprintf("1.2.3.%d", i); !received[uid] {
+			t.Errorf("Instance %s not received", uid)
+		}
+	}
+}
+
+func TestCStoreBatchOrder(t *testing.T) {
+	const grayscaleSoftcopyPresentationStateStorage = "1.2.840.10008.5.1.4.1.1.11.1"
+	var mu sync.Mutex
+	var received []string
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			mu.Lock()
+			received = append(received, req.SOPInstanceUID)
+			mu.Unlock()
+			return dimse.Success
+		},
+	})
+	// Interleave the SOP classes, and use descending UIDs, so that neither
+	// grouping nor sorting would keep the order.
+	var datasets []*dicom.DataSet
+	var want []string
+	for i := 9; i >= 0; i-- {
+		sopClassUID := ctImageStorage
+		if i%3 == 0 {
+			sopClassUID = grayscaleSoftcopyPresentationStateStorage
+		}
+		uid := fmt.Sprintf("1.2.4.%d", i)
+		datasets = append(datasets, &dicom.DataSet{Elements: []*dicom.Element{
+			dicom.MustNewElement(dicom.TagSOPClassUID, sopClassUID),
+			dicom.MustNewElement(dicom.TagSOPInstanceUID, uid),
+		}})
+		want = append(want, uid)
+	}
+	su := newServiceUser(t, sp, "orderclient", sopclass.StorageClasses)
+	result, err := su.CStoreBatch(datasets, 0)
+	su.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(result.Stored) != fmt.Sprint([]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Errorf("Wrong stored instances: %v", result.Stored)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(received) != fmt.Sprint(want) {
+		t.Errorf("Received %v, want %v", received, want)
+	}
+}
+
 func TestNonexistentServer(t *testing.T) {
 	initTest()
 	dataset := readDICOMFile("testdata/IM-0001-0003.dcm")
@@ -224,3 +533,1524 @@ func TestNonexistentServer(t *testing.T) {
 }
 
 // TODO(saito) Test that the state machine shuts down propelry.
+
+func TestRateLimitPerAE(t *testing.T) {
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CEcho:          func(req netdicom.CEchoRequest) dimse.Status { return dimse.Success },
+		RateLimitPerAE: netdicom.NewAERateLimiter(1e-6, 1),
+	})
+	echo := func(callingAETitle string) error {
+		su := newServiceUser(t, sp, callingAETitle, sopclass.VerificationClasses)
+		defer su.Release()
+		return su.CEcho()
+	}
+	if err := echo("ae1"); err != nil {
+		t.Error(err)
+	}
+	want := netdicom.Rejection{
+		Result: pdu.ResultRejectedTransient,
+		Source: pdu.SourceULServiceProviderPresentation,
+		Reason: pdu.ReasonTemporaryCongestion,
+	}
+	if err, ok := echo("ae1").(*netdicom.Rejection); !ok || *err != want {
+		t.Errorf("Second association from ae1 should be rejected with %v, got %v", &want, err)
+	}
+	if err := echo("ae2"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAcceptTransferSyntax(t *testing.T) {
+	var accepted []string
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CEcho: func(req netdicom.CEchoRequest) dimse.Status { return dimse.Success },
+		AcceptTransferSyntax: func(sopClassUID, transferSyntaxUID string) bool {
+			for _, uid := range accepted {
+				if uid == transferSyntaxUID {
+					return true
+				}
+			}
+			return false
+		},
+	})
+	echo := func(implicit bool) error {
+		params, err := netdicom.NewServiceUserParams(
+			"dontcare", "testclient", sopclass.VerificationClasses, dicomio.StandardTransferSyntaxes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !implicit {
+			// Implicit VR LE is always proposed for the required
+			// services, but not for the extra contexts.
+			params.RequiredServices = sopclass.StorageClasses
+			params.ExtraPresentationContexts = []netdicom.PresentationContext{
+				{AbstractSyntaxUID: dicomuid.VerificationSOPClass,
+					TransferSyntaxUIDs: []string{dicomuid.ExplicitVRLittleEndian}},
+			}
+		}
+		su := netdicom.NewServiceUser(params)
+		defer su.Release()
+		su.Connect(sp.ListenAddr().String())
+		return su.CEcho()
+	}
+	accepted = []string{dicomuid.ExplicitVRLittleEndian}
+	if err := echo(false); err != nil {
+		t.Error(err)
+	}
+	accepted = nil
+	// The default transfer syntax is accepted even if the callback
+	// rejects it.
+	if err := echo(true); err != nil {
+		t.Error(err)
+	}
+	if err := echo(false); err == nil {
+		t.Error("C-ECHO should fail when no transfer syntax is acceptable")
+	}
+}
+
+func TestAssociationSummary(t *testing.T) {
+	summaryCh := make(chan netdicom.AssociationSummary, 1)
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			return dimse.Success
+		},
+		OnAssociationClose: func(info netdicom.AssociationInfo, summary netdicom.AssociationSummary) {
+			summaryCh <- summary
+		},
+	})
+	dataset := readDICOMFile("testdata/IM-0001-0003.dcm")
+	su := newServiceUser(t, sp, "summaryclient", sopclass.StorageClasses)
+	if err := su.CStore(dataset); err != nil {
+		t.Fatal(err)
+	}
+	su.Release()
+	summary := <-summaryCh
+	elem, err := dataset.FindElementByTag(dicom.TagSOPClassUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sopClassUID := elem.MustGetString()
+	if summary.CallingAETitle != "summaryclient" || summary.NumInstances != 1 ||
+		summary.NumBytes == 0 || summary.NumFailures != 0 || summary.PerSOPClass[sopClassUID] != 1 {
+		t.Errorf("Wrong summary: %+v", summary)
+	}
+}
+
+func TestDIMSETimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CEcho: func(req netdicom.CEchoRequest) dimse.Status {
+			<-unblock
+			return dimse.Success
+		},
+	})
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "testclient", sopclass.VerificationClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.DIMSETimeout = 100 * time.Millisecond
+	su := netdicom.NewServiceUser(params)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	if err := su.CEcho(); err != netdicom.ErrDIMSETimeout {
+		t.Errorf("Expect a timeout, got %v", err)
+	}
+}
+
+func TestCStoreOnContext(t *testing.T) {
+	transferSyntaxCh := make(chan string, 2)
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			transferSyntaxCh <- req.TransferSyntaxUID
+			return dimse.Success
+		},
+	})
+	dataset := readDICOMFile("testdata/IM-0001-0003.dcm")
+	elem, err := dataset.FindElementByTag(dicom.TagSOPClassUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sopClassUID := elem.MustGetString()
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "testclient", sopclass.StorageClasses, []string{dicomuid.ImplicitVRLittleEndian})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.ExtraPresentationContexts = []netdicom.PresentationContext{
+		{AbstractSyntaxUID: sopClassUID, TransferSyntaxUIDs: []string{dicomuid.ExplicitVRLittleEndian}},
+	}
+	su := netdicom.NewServiceUser(params)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	if err := su.CStore(dataset); err != nil {
+		t.Fatal(err)
+	}
+	if uid := <-transferSyntaxCh; uid != dicomuid.ImplicitVRLittleEndian {
+		t.Errorf("CStore used transfer syntax %v", uid)
+	}
+	contextID, err := su.PresentationContextID(sopClassUID, dicomuid.ExplicitVRLittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := su.CStoreOnContext(contextID, dataset); err != nil {
+		t.Fatal(err)
+	}
+	if uid := <-transferSyntaxCh; uid != dicomuid.ExplicitVRLittleEndian {
+		t.Errorf("CStoreOnContext used transfer syntax %v", uid)
+	}
+}
+
+func TestMaxSequenceDepth(t *testing.T) {
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CFind: func(req netdicom.CFindRequest, ch chan netdicom.CFindResult) {
+			ch <- netdicom.CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(dicom.TagStudyInstanceUID, "1.2.3")}}
+			close(ch)
+		},
+		MaxSequenceDepth: 1,
+	})
+	su := newServiceUser(t, sp, "testclient", sopclass.QRFindClasses)
+	defer su.Release()
+	nest := func(depth int) *dicom.Element {
+		elem := dicom.MustNewElement(dicom.TagPatientID, "P1")
+		for i := 0; i < depth; i++ {
+			item := &dicom.Element{Tag: dicom.TagItem, VR: "NA", Value: []interface{}{elem}}
+			elem = &dicom.Element{Tag: dicom.TagReferencedStudySequence, VR: "SQ", Value: []interface{}{item}}
+		}
+		return elem
+	}
+	find := func(depth int) (err error) {
+		for result := range su.CFind(netdicom.CFindStudyQRLevel, []*dicom.Element{nest(depth)}) {
+			if result.Err != nil {
+				err = result.Err
+			}
+		}
+		return err
+	}
+	if err := find(1); err != nil {
+		t.Error(err)
+	}
+	if err := find(2); err == nil || !strings.Contains(err.Error(), "nested deeper than 1") {
+		t.Errorf("Expect a nesting error, got %v", err)
+	}
+}
+
+// The data passed to the CStore callback must be the dataset exactly as the
+// requestor encoded it in the negotiated transfer syntax.
+func TestCStoreDataUntouched(t *testing.T) {
+	dataCh := make(chan netdicom.CStoreRequest, 2)
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			dataCh <- req
+			return dimse.Success
+		},
+	})
+	dataset := readDICOMFile("testdata/IM-0001-0003.dcm")
+	for _, transferSyntaxUID := range []string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian} {
+		params, err := netdicom.NewServiceUserParams(
+			"dontcare", "testclient", sopclass.StorageClasses, []string{transferSyntaxUID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		su := netdicom.NewServiceUser(params)
+		su.Connect(sp.ListenAddr().String())
+		if err := su.CStore(dataset); err != nil {
+			t.Fatal(err)
+		}
+		su.Release()
+		e := dicomio.NewBytesEncoderWithTransferSyntax(transferSyntaxUID)
+		for _, elem := range dataset.Elements {
+			if elem.Tag.Group != dicom.TagMetadataGroup {
+				dicom.WriteElement(e, elem)
+			}
+		}
+		req := <-dataCh
+		if req.TransferSyntaxUID != transferSyntaxUID {
+			t.Errorf("Got transfer syntax %v, expect %v", req.TransferSyntaxUID, transferSyntaxUID)
+		}
+		if !bytes.Equal(req.Data, e.Bytes()) {
+			t.Errorf("%v: the data passed to the callback differs from the data sent (%d vs %d bytes)",
+				dicomuid.UIDString(transferSyntaxUID), len(req.Data), len(e.Bytes()))
+		}
+	}
+}
+
+// A Tracer that records the spans that have ended.
+type testTracer struct {
+	mu    sync.Mutex
+	ended []string // "name attrs err" of the ended spans, in order.
+	done  chan string
+}
+
+type testSpan struct {
+	name  string
+	attrs map[string]string
+}
+
+func (t *testTracer) StartSpan(parent netdicom.Span, name string, attrs map[string]string) netdicom.Span {
+	return &testSpan{name: name, attrs: attrs}
+}
+
+func (t *testTracer) EndSpan(span netdicom.Span, attrs map[string]string, err error) {
+	s := span.(*testSpan)
+	for k, v := range attrs {
+		s.attrs[k] = v
+	}
+	t.mu.Lock()
+	t.ended = append(t.ended, fmt.Sprintf("%s %v %v", s.name, s.attrs, err))
+	t.mu.Unlock()
+	t.done <- s.name
+}
+
+func TestTracer(t *testing.T) {
+	providerTracer := &testTracer{done: make(chan string, 10)}
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CEcho:  func(req netdicom.CEchoRequest) dimse.Status { return dimse.Success },
+		Tracer: providerTracer,
+	})
+	userTracer := &testTracer{done: make(chan string, 10)}
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "tracerclient", sopclass.VerificationClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.Tracer = userTracer
+	su := netdicom.NewServiceUser(params)
+	su.Connect(sp.ListenAddr().String())
+	if err := su.CEcho(); err != nil {
+		t.Fatal(err)
+	}
+	su.Release()
+	for _, tracer := range []*testTracer{userTracer, providerTracer} {
+		for name := range tracer.done {
+			if name == "association" {
+				break
+			}
+		}
+		tracer.mu.Lock()
+		if len(tracer.ended) != 2 ||
+			!strings.HasPrefix(tracer.ended[0], "C-ECHO map[") ||
+			!strings.Contains(tracer.ended[0], "dicom.sop_class_uid:"+dicomuid.VerificationSOPClass) ||
+			!strings.HasPrefix(tracer.ended[1], "association map[") ||
+			!strings.Contains(tracer.ended[1], "dicom.calling_ae:tracerclient") {
+			t.Errorf("Wrong spans: %v", tracer.ended)
+		}
+		tracer.mu.Unlock()
+	}
+	if !strings.Contains(providerTracer.ended[0], "dicom.status:0x0000") {
+		t.Errorf("Provider span lacks the status: %v", providerTracer.ended[0])
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &netdicom.FileStore{Dir: dir}
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CStore: store.CStore,
+	})
+	dataset := readDICOMFile("testdata/IM-0001-0003.dcm")
+	su := newServiceUser(t, sp, "filestoreclient", sopclass.StorageClasses)
+	defer su.Release()
+	if err := su.CStore(dataset); err != nil {
+		t.Fatal(err)
+	}
+	getString := func(tag dicom.Tag) string {
+		elem, err := dataset.FindElementByTag(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return elem.MustGetString()
+	}
+	path := filepath.Join(dir, netdicom.HierarchicalPath(netdicom.StoredInstance{
+		SOPInstanceUID:    getString(dicom.TagSOPInstanceUID),
+		PatientID:         getString(dicom.TagPatientID),
+		StudyInstanceUID:  getString(dicom.TagStudyInstanceUID),
+		SeriesInstanceUID: getString(dicom.TagSeriesInstanceUID),
+	}))
+	out, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFileBodiesEqual(t, dataset, out)
+}
+
+func TestFlatPath(t *testing.T) {
+	for uid, want := range map[string]string{
+		"1.2.3":       "1.2.3.dcm",
+		"../../etc/x": ".._.._etc_x.dcm",
+		"":            "unknown.dcm",
+	} {
+		if path := netdicom.FlatPath(netdicom.StoredInstance{SOPInstanceUID: uid}); path != want {
+			t.Errorf("FlatPath(%q): got %q, want %q", uid, path, want)
+		}
+	}
+}
+
+// The test file is encoded in JPEG 2000. It must be sent, and stored, in that
+// transfer syntax, even though the requestor proposes Explicit VR Little
+// Endian first.
+func TestFileStoreEncapsulatedTransferSyntax(t *testing.T) {
+	const jpeg2000 = "1.2.840.10008.1.2.4.91"
+	dir, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &netdicom.FileStore{Dir: dir}
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CStore: store.CStore,
+	})
+	dataset := readDICOMFile("testdata/IM-0001-0003.dcm")
+	getString := func(tag dicom.Tag) string {
+		elem, err := dataset.FindElementByTag(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return elem.MustGetString()
+	}
+	if uid := getString(dicom.TagTransferSyntaxUID); uid != jpeg2000 {
+		t.Fatalf("Test file has transfer syntax %v, want %v", uid, jpeg2000)
+	}
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "filestoreclient", sopclass.StorageClasses,
+		[]string{dicomuid.ExplicitVRLittleEndian, jpeg2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sopClassUID := getString(dicom.TagSOPClassUID)
+	params.ExtraPresentationContexts = []netdicom.PresentationContext{
+		{AbstractSyntaxUID: sopClassUID, TransferSyntaxUIDs: []string{jpeg2000}},
+	}
+	su := netdicom.NewServiceUser(params)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	if err := su.CStore(dataset); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, netdicom.HierarchicalPath(netdicom.StoredInstance{
+		SOPInstanceUID:    getString(dicom.TagSOPInstanceUID),
+		PatientID:         getString(dicom.TagPatientID),
+		StudyInstanceUID:  getString(dicom.TagStudyInstanceUID),
+		SeriesInstanceUID: getString(dicom.TagSeriesInstanceUID),
+	}))
+	out, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	elem, err := out.FindElementByTag(dicom.TagTransferSyntaxUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid := elem.MustGetString(); uid != jpeg2000 {
+		t.Errorf("Stored with transfer syntax %v, want %v", uid, jpeg2000)
+	}
+	checkFileBodiesEqual(t, dataset, out)
+}
+
+func TestProposeVerification(t *testing.T) {
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CEcho: func(req netdicom.CEchoRequest) dimse.Status { return dimse.Success },
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			return dimse.Success
+		},
+	})
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "verifyclient", sopclass.StorageClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.ProposeVerification = true
+	su := netdicom.NewServiceUser(params)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	if err := su.CEcho(); err != nil {
+		t.Fatal(err)
+	}
+	if err := su.CStore(readDICOMFile("testdata/IM-0001-0003.dcm")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// An association request with more contexts than there are context IDs can't
+// be sent. The operation reports why, rather than a generic failure.
+func TestTooManyPresentationContexts(t *testing.T) {
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CEcho: func(req netdicom.CEchoRequest) dimse.Status { return dimse.Success },
+	})
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "testclient", sopclass.VerificationClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 128; i++ {
+		params.ExtraPresentationContexts = append(params.ExtraPresentationContexts, netdicom.PresentationContext{
+			AbstractSyntaxUID:  fmt.Sprintf("1.2.3.%d", i),
+			TransferSyntaxUIDs: []string{dicomuid.ImplicitVRLittleEndian},
+		})
+	}
+	su := netdicom.NewServiceUser(params)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	if err := su.CEcho(); err == nil || !strings.Contains(err.Error(), "Too many presentation contexts") {
+		t.Errorf("Got %v, expect an error for too many presentation contexts", err)
+	}
+}
+
+func TestOperationAfterRelease(t *testing.T) {
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CEcho: func(req netdicom.CEchoRequest) dimse.Status { return dimse.Success },
+	})
+	su := newServiceUser(t, sp, "releaseclient", sopclass.VerificationClasses)
+	if err := su.CEcho(); err != nil {
+		t.Fatal(err)
+	}
+	su.Release()
+	if err := su.CEcho(); err != netdicom.ErrReleased {
+		t.Errorf("C-ECHO after release: got %v, want ErrReleased", err)
+	}
+}
+
+func TestReleaseTwice(t *testing.T) {
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			return dimse.Success
+		},
+		MaxBytesPerAssociation: 1000,
+	})
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "releaseclient", sopclass.StorageClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Orderly release.
+	su := netdicom.NewServiceUser(params)
+	su.Connect(sp.ListenAddr().String())
+	for i := 0; i < 2; i++ {
+		if err := su.Release(); err != nil {
+			t.Errorf("Release #%d: %v", i, err)
+		}
+	}
+
+	// Release after the provider aborts the association for exceeding
+	// the byte limit.
+	su = netdicom.NewServiceUser(params)
+	su.Connect(sp.ListenAddr().String())
+	if err := su.CStore(readDICOMFile("testdata/IM-0001-0003.dcm")); err == nil {
+		t.Error("C-STORE over the byte limit should fail")
+	}
+	for i := 0; i < 2; i++ {
+		if err := su.Release(); err != nil {
+			t.Errorf("Release #%d after abort: %v", i, err)
+		}
+	}
+
+	// Release after a connection failure reports it only once.
+	su = netdicom.NewServiceUser(params)
+	su.Connect(":99999")
+	if err := su.Release(); err == nil {
+		t.Error("Release after a connection failure should fail")
+	}
+	if err := su.Release(); err != nil {
+		t.Errorf("Second release: %v", err)
+	}
+}
+
+func TestDuplicateInstancePolicy(t *testing.T) {
+	dataset := readDICOMFile("testdata/IM-0001-0003.dcm")
+	for _, policy := range []netdicom.DuplicateInstancePolicy{
+		netdicom.DuplicateInstanceIgnore, netdicom.DuplicateInstanceReject} {
+		var mu sync.Mutex
+		nStored := 0
+		summaryCh := make(chan netdicom.AssociationSummary, 1)
+		sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+			CStore: func(req netdicom.CStoreRequest) dimse.Status {
+				mu.Lock()
+				nStored++
+				mu.Unlock()
+				return dimse.Success
+			},
+			DuplicateInstancePolicy: policy,
+			OnAssociationClose: func(info netdicom.AssociationInfo, summary netdicom.AssociationSummary) {
+				summaryCh <- summary
+			},
+		})
+		su := newServiceUser(t, sp, "dupclient", sopclass.StorageClasses)
+		if err := su.CStore(dataset); err != nil {
+			t.Fatal(err)
+		}
+		err := su.CStore(dataset)
+		if policy == netdicom.DuplicateInstanceIgnore && err != nil {
+			t.Errorf("Duplicate should be ignored: %v", err)
+		}
+		if policy == netdicom.DuplicateInstanceReject && err == nil {
+			t.Error("Duplicate should be rejected")
+		}
+		su.Release()
+		mu.Lock()
+		if nStored != 1 {
+			t.Errorf("Policy %v: the callback stored %d instances", policy, nStored)
+		}
+		mu.Unlock()
+		// The duplicate is neither a stored instance nor a failure.
+		summary := <-summaryCh
+		if summary.NumInstances != 1 || summary.NumFailures != 0 || summary.NumDuplicates != 1 {
+			t.Errorf("Policy %v: wrong summary: %+v", policy, summary)
+		}
+	}
+}
+
+func TestShutdownCancelsCFind(t *testing.T) {
+	cancelled := make(chan struct{})
+	sp, err := netdicom.NewServiceProvider(netdicom.ServiceProviderParams{
+		CFind: func(req netdicom.CFindRequest, ch chan netdicom.CFindResult) {
+			ch <- netdicom.CFindResult{
+				Elements: []*dicom.Element{dicom.MustNewElement(dicom.TagPatientName, "johndoe")},
+			}
+			<-req.Cancel
+			close(cancelled)
+			close(ch)
+		},
+	}, ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runDone := make(chan struct{})
+	go func() {
+		sp.Run()
+		close(runDone)
+	}()
+	su := newServiceUser(t, sp, "shutdownclient", sopclass.QRFindClasses)
+	defer su.Release()
+	ch := su.CFind(netdicom.CFindPatientQRLevel, []*dicom.Element{
+		dicom.MustNewElement(dicom.TagPatientName, "*")})
+	if result := <-ch; result.Err != nil || len(result.Elements) != 1 {
+		t.Fatalf("Wrong first result: %+v", result)
+	}
+	// The association stays open until the client releases it, so
+	// Shutdown gives up when ctx expires.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := sp.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown with an open association: got %v", err)
+	}
+	<-cancelled
+	<-runDone
+	// The query ends with status Cancel.
+	result, ok := <-ch
+	if !ok || result.Err == nil || !strings.Contains(result.Err.Error(), "65024") {
+		t.Errorf("Wrong final result: %+v %v", result, ok)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("Channel should be closed")
+	}
+	if err := su.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown after release: %v", err)
+	}
+}
+
+func TestCFindWithCancel(t *testing.T) {
+	cancelled := make(chan struct{}, 2)
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CFind: func(req netdicom.CFindRequest, ch chan netdicom.CFindResult) {
+			defer close(ch)
+			// Stream matches until the requestor cancels.
+			for {
+				select {
+				case ch <- netdicom.CFindResult{
+					Elements: []*dicom.Element{dicom.MustNewElement(dicom.TagPatientName, "johndoe")},
+				}:
+				case <-req.Cancel:
+					cancelled <- struct{}{}
+					return
+				}
+			}
+		},
+	})
+	su := newServiceUser(t, sp, "cancelclient", sopclass.QRFindClasses)
+	defer su.Release()
+	filter := []*dicom.Element{dicom.MustNewElement(dicom.TagPatientName, "*")}
+	for i := 0; i < 2; i++ {
+		// Read the first page of the matches, then cancel the rest. The
+		// association must be usable for the next query.
+		cancel := make(chan struct{})
+		ch := su.CFindWithCancel(netdicom.CFindPatientQRLevel, filter, cancel)
+		for j := 0; j < 3; j++ {
+			if result := <-ch; result.Err != nil || len(result.Elements) != 1 {
+				t.Fatalf("Wrong result: %+v", result)
+			}
+		}
+		close(cancel)
+		<-cancelled
+		for result := range ch {
+			if result.Err != nil {
+				t.Errorf("Unexpected error after cancel: %v", result.Err)
+			}
+		}
+	}
+}
+
+func TestCFindEmptyResult(t *testing.T) {
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CFind: func(req netdicom.CFindRequest, ch chan netdicom.CFindResult) {
+			defer close(ch)
+			ch <- netdicom.CFindResult{
+				Elements: []*dicom.Element{dicom.MustNewElement(dicom.TagPatientName, "johndoe")},
+			}
+			ch <- netdicom.CFindResult{}
+		},
+	})
+	su := newServiceUser(t, sp, "findclient", sopclass.QRFindClasses)
+	defer su.Release()
+	var results []netdicom.CFindResult
+	for result := range su.CFind(netdicom.CFindPatientQRLevel, []*dicom.Element{
+		dicom.MustNewElement(dicom.TagPatientName, "*")}) {
+		results = append(results, result)
+	}
+	if len(results) != 2 || results[0].Err != nil || results[1].Err == nil {
+		t.Fatalf("Got %+v, want a match followed by an error", results)
+	}
+	if !strings.Contains(results[1].Err.Error(), "empty result") {
+		t.Errorf("Wrong error: %v", results[1].Err)
+	}
+}
+
+// Cancelling a query whose results the caller doesn't read must not block the
+// association, even if many results are queued.
+func TestCancelWithoutDraining(t *testing.T) {
+	const numResults = 1000
+	sentAll := make(chan struct{})
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CFind: func(req netdicom.CFindRequest, ch chan netdicom.CFindResult) {
+			defer close(ch)
+			defer close(sentAll)
+			for i := 0; i < numResults; i++ {
+				ch <- netdicom.CFindResult{
+					Elements: []*dicom.Element{dicom.MustNewElement(dicom.TagPatientName, "johndoe")},
+				}
+			}
+		},
+	})
+	su := newServiceUser(t, sp, "cancelclient", sopclass.QRFindClasses)
+	ch := su.CFind(netdicom.CFindPatientQRLevel, []*dicom.Element{
+		dicom.MustNewElement(dicom.TagPatientName, "*")})
+	first := <-ch
+	if first.Err != nil {
+		t.Fatal(first.Err)
+	}
+	// Let the results pile up in the service user.
+	<-sentAll
+	time.Sleep(100 * time.Millisecond)
+
+	doneCh := make(chan error)
+	go func() {
+		if err := su.CancelOperation(first.MessageID); err != nil {
+			doneCh <- err
+			return
+		}
+		doneCh <- su.Release()
+	}()
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("CancelOperation or Release blocked")
+	}
+}
+
+func TestCancelOperation(t *testing.T) {
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CFind: func(req netdicom.CFindRequest, ch chan netdicom.CFindResult) {
+			defer close(ch)
+			var name string
+			for _, elem := range req.Filters {
+				if elem.Tag == dicom.TagPatientName {
+					name = elem.MustGetString()
+				}
+			}
+			for i := 0; i < 3; i++ {
+				ch <- netdicom.CFindResult{
+					Elements: []*dicom.Element{dicom.MustNewElement(dicom.TagPatientName, name)},
+				}
+			}
+			if name == "slow" {
+				// Never finishes unless cancelled.
+				<-req.Cancel
+			}
+		},
+	})
+	su := newServiceUser(t, sp, "cancelclient", sopclass.QRFindClasses)
+	defer su.Release()
+	slowCh := su.CFind(netdicom.CFindPatientQRLevel, []*dicom.Element{
+		dicom.MustNewElement(dicom.TagPatientName, "slow")})
+	first := <-slowCh
+	if first.Err != nil || first.MessageID == 0 {
+		t.Fatalf("Wrong first result: %+v", first)
+	}
+
+	// Another query on the same association runs to completion.
+	n := 0
+	for result := range su.CFind(netdicom.CFindPatientQRLevel, []*dicom.Element{
+		dicom.MustNewElement(dicom.TagPatientName, "fast")}) {
+		if result.Err != nil || result.MessageID == first.MessageID {
+			t.Errorf("Wrong result: %+v", result)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Errorf("Got %d results, want 3", n)
+	}
+
+	if err := su.CancelOperation(first.MessageID); err != nil {
+		t.Fatal(err)
+	}
+	for result := range slowCh {
+		if result.Err != nil {
+			t.Errorf("Unexpected error after cancel: %v", result.Err)
+		}
+	}
+	if err := su.CancelOperation(first.MessageID); err == nil {
+		t.Error("Cancelling a finished request should fail")
+	}
+}
+
+func TestAssociationScratch(t *testing.T) {
+	instancesCh := make(chan []string, 1)
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			req.Info.Scratch.Update("instances", func(v interface{}) interface{} {
+				list, _ := v.([]string)
+				return append(list, req.SOPInstanceUID)
+			})
+			return dimse.Success
+		},
+		OnAssociationClose: func(info netdicom.AssociationInfo, summary netdicom.AssociationSummary) {
+			list, _ := info.Scratch.Get("instances").([]string)
+			instancesCh <- list
+		},
+	})
+	dataset := readDICOMFile("testdata/IM-0001-0003.dcm")
+	su := newServiceUser(t, sp, "scratchclient", sopclass.StorageClasses)
+	for i := 0; i < 2; i++ {
+		if err := su.CStore(dataset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	su.Release()
+	if instances := <-instancesCh; len(instances) != 2 {
+		t.Errorf("Wrong instances in the scratch space: %v", instances)
+	}
+}
+
+// Return a copy of dataset without the meta group, as sent by requestors
+// that predate it.
+func stripMetaGroup(dataset *dicom.DataSet) *dicom.DataSet {
+	legacy := &dicom.DataSet{}
+	for _, elem := range dataset.Elements {
+		if elem.Tag.Group != dicom.TagMetadataGroup {
+			legacy.Elements = append(legacy.Elements, elem)
+		}
+	}
+	return legacy
+}
+
+func TestStoreWithoutMetaGroup(t *testing.T) {
+	type instance struct{ sopClassUID, sopInstanceUID string }
+	storedCh := make(chan instance, 1)
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			storedCh <- instance{req.SOPClassUID, req.SOPInstanceUID}
+			return dimse.Success
+		},
+	})
+	dataset := readDICOMFile("testdata/IM-0001-0003.dcm")
+	legacy := stripMetaGroup(dataset)
+	su := newServiceUser(t, sp, "legacyclient", sopclass.StorageClasses)
+	defer su.Release()
+	if err := su.CStore(legacy); err != nil {
+		t.Fatal(err)
+	}
+	getString := func(tag dicom.Tag) string {
+		elem, err := dataset.FindElementByTag(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return elem.MustGetString()
+	}
+	if stored := <-storedCh; stored.sopClassUID != getString(dicom.TagSOPClassUID) ||
+		stored.sopInstanceUID != getString(dicom.TagSOPInstanceUID) {
+		t.Errorf("Wrong UIDs: %+v", stored)
+	}
+}
+
+// The C-STOREs of C-MOVE and C-GET sub-operations must also take the SOP UIDs
+// from the dataset when it has no meta group.
+func TestRetrieveWithoutMetaGroup(t *testing.T) {
+	type instance struct{ sopClassUID, sopInstanceUID string }
+	dataset := readDICOMFile("testdata/IM-0001-0003.dcm")
+	legacy := stripMetaGroup(dataset)
+	getString := func(tag dicom.Tag) string {
+		elem, err := dataset.FindElementByTag(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return elem.MustGetString()
+	}
+	expected := instance{getString(dicom.TagSOPClassUID), getString(dicom.TagSOPInstanceUID)}
+
+	storedCh := make(chan instance, 1)
+	dest := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			storedCh <- instance{req.SOPClassUID, req.SOPInstanceUID}
+			return dimse.Success
+		},
+	})
+	retrieve := func(req netdicom.CMoveRequest, ch chan netdicom.CMoveResult) {
+		ch <- netdicom.CMoveResult{Remaining: 0, Path: "legacy", DataSet: legacy}
+		close(ch)
+	}
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		AETitle:   "legacyscp",
+		CMove:     retrieve,
+		CGet:      retrieve,
+		RemoteAEs: map[string]string{"LEGACYDEST": dest.ListenAddr().String()},
+	})
+	su := newServiceUser(t, sp, "legacyclient",
+		append(append(append([]sopclass.SOPUID{}, sopclass.QRMoveClasses...), sopclass.QRGetClasses...), sopclass.StorageClasses...))
+	defer su.Release()
+	filter := []*dicom.Element{dicom.MustNewElement(dicom.TagStudyInstanceUID, "1.2.3")}
+	checkProgress := func(op string, progress []netdicom.RetrieveProgress) {
+		if len(progress) == 0 {
+			t.Errorf("%s: no progress reported", op)
+			return
+		}
+		if last := progress[len(progress)-1]; last.Completed != 1 || last.Failed != 0 {
+			t.Errorf("%s: wrong sub-operation counts: %+v", op, last)
+		}
+	}
+
+	var progress []netdicom.RetrieveProgress
+	err := su.CMove(netdicom.CFindStudyQRLevel, "LEGACYDEST", filter,
+		func(p netdicom.RetrieveProgress) { progress = append(progress, p) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProgress("C-MOVE", progress)
+	select {
+	case stored := <-storedCh:
+		if stored != expected {
+			t.Errorf("C-MOVE stored %+v, expect %+v", stored, expected)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("C-MOVE stored nothing")
+	}
+
+	progress = nil
+	var received []instance
+	err = su.CGet(netdicom.CFindStudyQRLevel, filter,
+		func(p netdicom.RetrieveProgress) { progress = append(progress, p) },
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			received = append(received, instance{sopClassUID, sopInstanceUID})
+			return dimse.Success
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProgress("C-GET", progress)
+	if len(received) != 1 || received[0] != expected {
+		t.Errorf("C-GET received %+v, expect %+v", received, expected)
+	}
+}
+
+type testQueryBackend struct {
+	levels chan string
+}
+
+func (b *testQueryBackend) Find(level string, filter []*dicom.Element) (<-chan netdicom.QueryResult, error) {
+	b.levels <- level
+	ch := make(chan netdicom.QueryResult)
+	go func() {
+		for _, name := range []string{"johndoe", "johndoe2"} {
+			ch <- netdicom.QueryResult{
+				Elements: []*dicom.Element{dicom.MustNewElement(dicom.TagPatientName, name)},
+			}
+		}
+		close(ch)
+	}()
+	return ch, nil
+}
+
+func TestQueryBackend(t *testing.T) {
+	backend := &testQueryBackend{levels: make(chan string, 1)}
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		QueryBackend: backend,
+	})
+	su := newServiceUser(t, sp, "backendclient", sopclass.QRFindClasses)
+	defer su.Release()
+	var namesFound []string
+	for result := range su.CFind(netdicom.CFindStudyQRLevel, []*dicom.Element{
+		dicom.MustNewElement(dicom.TagPatientName, "*")}) {
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		namesFound = append(namesFound, result.Elements[0].MustGetString())
+	}
+	if len(namesFound) != 2 || namesFound[0] != "johndoe" || namesFound[1] != "johndoe2" {
+		t.Error(namesFound)
+	}
+	if level := <-backend.levels; level != "STUDY" {
+		t.Errorf("Wrong level: %q", level)
+	}
+}
+
+func TestCommonExtendedNegotiation(t *testing.T) {
+	dataset := readDICOMFile("testdata/IM-0001-0003.dcm")
+	sopClassUID, err := dataset.FindElementByTag(dicom.TagMediaStorageSOPClassUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	negotiated := make(chan netdicom.CommonExtendedNegotiation, 1)
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			n, ok := req.Info.CommonExtendedNegotiation(req.SOPClassUID)
+			if !ok {
+				t.Errorf("No common extended negotiation for %v", req.SOPClassUID)
+			}
+			negotiated <- n
+			return dimse.Success
+		},
+	})
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "commonextclient", sopclass.StorageClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.CommonExtendedNegotiation = map[string]netdicom.CommonExtendedNegotiation{
+		sopClassUID.MustGetString(): {
+			ServiceClassUID:            "1.2.840.10008.4.2",
+			RelatedGeneralSOPClassUIDs: []string{"1.2.3.4", "1.2.3.5"},
+		},
+	}
+	su := netdicom.NewServiceUser(params)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	if err := su.CStore(dataset); err != nil {
+		t.Fatal(err)
+	}
+	n := <-negotiated
+	if n.ServiceClassUID != "1.2.840.10008.4.2" || len(n.RelatedGeneralSOPClassUIDs) != 2 ||
+		n.RelatedGeneralSOPClassUIDs[1] != "1.2.3.5" {
+		t.Errorf("Wrong negotiation: %+v", n)
+	}
+}
+
+func TestMaxBytesPerAssociation(t *testing.T) {
+	summaryCh := make(chan netdicom.AssociationSummary, 1)
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			return dimse.Success
+		},
+		OnAssociationClose: func(info netdicom.AssociationInfo, summary netdicom.AssociationSummary) {
+			summaryCh <- summary
+		},
+		MaxBytesPerAssociation: 1000,
+	})
+	su := newServiceUser(t, sp, "bytelimitclient", sopclass.StorageClasses)
+	defer su.Release()
+	if err := su.CStore(readDICOMFile("testdata/IM-0001-0003.dcm")); err == nil {
+		t.Error("C-STORE over the byte limit should fail")
+	}
+	if summary := <-summaryCh; summary.Err == nil || !strings.Contains(summary.Err.Error(), "limit") {
+		t.Errorf("Wrong summary error: %v", summary.Err)
+	}
+}
+
+func TestNGetPrinter(t *testing.T) {
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		NGet: func(req netdicom.NGetRequest) ([]*dicom.Element, dimse.Status) {
+			if req.SOPInstanceUID != sopclass.PrinterSOPInstance {
+				return nil, dimse.Status{Status: dimse.StatusInvalidObjectInstance}
+			}
+			if len(req.Attributes) != 1 || req.Attributes[0] != dicom.TagPatientName {
+				t.Errorf("Wrong attributes: %v", req.Attributes)
+			}
+			return []*dicom.Element{dicom.MustNewElement(dicom.TagPatientName, "NORMAL")}, dimse.Success
+		},
+	})
+	su := newServiceUser(t, sp, "ngetclient", sopclass.PrinterClasses)
+	defer su.Release()
+	printer := sopclass.PrinterClasses[0].UID
+	elems, err := su.NGet(printer, sopclass.PrinterSOPInstance, []dicom.Tag{dicom.TagPatientName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elems) != 1 || elems[0].MustGetString() != "NORMAL" {
+		t.Errorf("Wrong N-GET result: %v", elems)
+	}
+	if _, err := su.NGet(printer, "1.2.3", nil); err == nil {
+		t.Error("N-GET of an unknown instance should fail")
+	}
+}
+
+func TestResolveMoveDestination(t *testing.T) {
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CMove: func(req netdicom.CMoveRequest, ch chan netdicom.CMoveResult) {
+			t.Error("CMove shouldn't be called for an unknown destination")
+			close(ch)
+		},
+		ResolveMoveDestination: func(destinationAE string) (string, *tls.Config, error) {
+			return "", nil, fmt.Errorf("unknown AE %s", destinationAE)
+		},
+	})
+	su := newServiceUser(t, sp, "moveclient", sopclass.QRMoveClasses)
+	defer su.Release()
+	var status dimse.Status
+	err := su.CMove(netdicom.CFindStudyQRLevel, "NOSUCHAE", []*dicom.Element{
+		dicom.MustNewElement(dicom.TagPatientName, "*")},
+		func(progress netdicom.RetrieveProgress) { status = progress.Status })
+	if err == nil || status.Status != dimse.CMoveMoveDestinationUnknown {
+		t.Errorf("Wrong C-MOVE result: %v, status %v", err, status)
+	}
+}
+
+func TestRunProviderForConnSummary(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	summaryCh := make(chan netdicom.AssociationSummary, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		summaryCh <- netdicom.RunProviderForConn(conn, netdicom.ServiceProviderParams{
+			CEcho: func(req netdicom.CEchoRequest) dimse.Status { return dimse.Success },
+			CStore: func(req netdicom.CStoreRequest) dimse.Status {
+				return dimse.Success
+			},
+		})
+	}()
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "summaryclient", sopclass.StorageClasses, []string{dicomuid.ImplicitVRLittleEndian})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.ProposeVerification = true
+	su := netdicom.NewServiceUser(params)
+	su.Connect(listener.Addr().String())
+	if err := su.CEcho(); err != nil {
+		t.Fatal(err)
+	}
+	if err := su.CStore(readDICOMFile("testdata/IM-0001-0003.dcm")); err != nil {
+		t.Fatal(err)
+	}
+	su.Release()
+	summary := <-summaryCh
+	if summary.CallingAETitle != "summaryclient" || summary.Err != nil {
+		t.Errorf("Wrong summary: %+v", summary)
+	}
+	if len(summary.AcceptedContexts) != len(sopclass.StorageClasses)+1 ||
+		summary.AcceptedContexts[0].TransferSyntaxUIDs[0] != dicomuid.ImplicitVRLittleEndian {
+		t.Errorf("Wrong accepted contexts: %v", summary.AcceptedContexts)
+	}
+	if summary.Operations["C-ECHO"] != 1 || summary.Operations["C-STORE"] != 1 ||
+		summary.BytesReceived != summary.NumBytes || summary.NumBytes == 0 {
+		t.Errorf("Wrong operations: %v, %d bytes", summary.Operations, summary.BytesReceived)
+	}
+}
+
+// A peer that aborts in the middle of a large C-STORE, and stops reading, must
+// not leave the sender blocked on the write.
+func TestPeerAbortDuringCStore(t *testing.T) {
+	const pdfStorage = "1.2.840.10008.5.1.4.1.1.104.1"
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	peerDone := make(chan struct{})
+	defer close(peerDone)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		v, err := pdu.ReadPDU(conn, netdicom.DefaultMaxPDUSize)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		rq := v.(*pdu.A_ASSOCIATE)
+		ac := &pdu.A_ASSOCIATE{
+			Type:            pdu.PDUTypeA_ASSOCIATE_AC,
+			ProtocolVersion: pdu.CurrentProtocolVersion,
+			CalledAETitle:   rq.CalledAETitle,
+			CallingAETitle:  rq.CallingAETitle,
+			Items: []pdu.SubItem{
+				&pdu.ApplicationContextItem{Name: pdu.DICOMApplicationContextItemName},
+			},
+		}
+		for _, item := range rq.Items {
+			if pc, ok := item.(*pdu.PresentationContextItem); ok {
+				ac.Items = append(ac.Items, &pdu.PresentationContextItem{
+					Type:      pdu.ItemTypePresentationContextResponse,
+					ContextID: pc.ContextID,
+					Result:    pdu.PresentationContextAccepted,
+					Items: []pdu.SubItem{&pdu.TransferSyntaxSubItem{
+						Name: dicomuid.ImplicitVRLittleEndian}},
+				})
+			}
+		}
+		ac.Items = append(ac.Items, &pdu.UserInformationItem{
+			Items: []pdu.SubItem{&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: 16384}}})
+		data, err := pdu.EncodePDU(ac)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Write(data)
+		// Abort after the first P-DATA-TF, then stop reading.
+		if _, err := pdu.ReadPDU(conn, netdicom.DefaultMaxPDUSize); err != nil {
+			t.Error(err)
+			return
+		}
+		data, _ = pdu.EncodePDU(&pdu.A_ABORT{Source: 2, Reason: 1})
+		conn.Write(data)
+		<-peerDone
+	}()
+
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "abortclient", sopclass.StorageClasses, []string{dicomuid.ImplicitVRLittleEndian})
+	if err != nil {
+		t.Fatal(err)
+	}
+	su := netdicom.NewServiceUser(params)
+	defer su.Release()
+	su.Connect(listener.Addr().String())
+	// Much larger than the socket buffers.
+	ds := &dicom.DataSet{Elements: []*dicom.Element{
+		dicom.MustNewElement(dicom.TagSOPClassUID, pdfStorage),
+		dicom.MustNewElement(dicom.TagSOPInstanceUID, "1.2.3.4"),
+		dicom.MustNewElement(dicom.TagEncapsulatedDocument, make([]byte, 64<<20)),
+	}}
+	errCh := make(chan error, 1)
+	go func() { errCh <- su.CStore(ds) }()
+	select {
+	case err := <-errCh:
+		abort, ok := err.(*netdicom.AbortError)
+		if !ok || abort.Source != 2 || abort.Reason != 1 {
+			t.Errorf("Got %v, want an AbortError", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("C-STORE blocked after the peer aborted")
+	}
+}
+
+// A provider that receives a malformed DIMSE command, here the fuzzer corpus
+// entry also used by the dimse tests, must abort the association.
+func TestMalformedCommandAborts(t *testing.T) {
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CEcho: func(req netdicom.CEchoRequest) dimse.Status { return dimse.Success },
+	})
+	conn, err := net.Dial("tcp", sp.ListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	rq := &pdu.A_ASSOCIATE{
+		Type:            pdu.PDUTypeA_ASSOCIATE_RQ,
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "dontcare",
+		CallingAETitle:  "fuzzclient",
+		Items: []pdu.SubItem{
+			&pdu.ApplicationContextItem{Name: pdu.DICOMApplicationContextItemName},
+			&pdu.PresentationContextItem{
+				Type:      pdu.ItemTypePresentationContextRequest,
+				ContextID: 1, // The context used by the corpus entry.
+				Items: []pdu.SubItem{
+					&pdu.AbstractSyntaxSubItem{Name: dicomuid.VerificationSOPClass},
+					&pdu.TransferSyntaxSubItem{Name: dicomuid.ImplicitVRLittleEndian},
+				},
+			},
+			&pdu.UserInformationItem{
+				Items: []pdu.SubItem{&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: 16384}}},
+		},
+	}
+	data, err := pdu.EncodePDU(rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(data)
+	v, err := pdu.ReadPDU(conn, netdicom.DefaultMaxPDUSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ac, ok := v.(*pdu.A_ASSOCIATE); !ok || ac.Type != pdu.PDUTypeA_ASSOCIATE_AC {
+		t.Fatalf("Expect A-ASSOCIATE-AC, got %v", v)
+	}
+	data, err = ioutil.ReadFile("fuzzpdu/corpus/malformed-uint16-element")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(data)
+	v, err = pdu.ReadPDU(conn, netdicom.DefaultMaxPDUSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v.(*pdu.A_ABORT); !ok {
+		t.Errorf("Expect A-ABORT, got %v", v)
+	}
+}
+
+func TestAcceptConnection(t *testing.T) {
+	var mu sync.Mutex
+	allow := false
+	addrCh := make(chan net.Addr, 2)
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CEcho: func(req netdicom.CEchoRequest) dimse.Status { return dimse.Success },
+		AcceptConnection: func(remoteAddr net.Addr) bool {
+			addrCh <- remoteAddr
+			mu.Lock()
+			defer mu.Unlock()
+			return allow
+		},
+	})
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "filterclient", sopclass.VerificationClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	su := netdicom.NewServiceUser(params)
+	su.Connect(sp.ListenAddr().String())
+	if err := su.CEcho(); err == nil {
+		t.Error("C-ECHO over a rejected connection should fail")
+	}
+	su.Release()
+	if addr := <-addrCh; addr == nil {
+		t.Error("AcceptConnection got no remote address")
+	}
+
+	mu.Lock()
+	allow = true
+	mu.Unlock()
+	su = netdicom.NewServiceUser(params)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	if err := su.CEcho(); err != nil {
+		t.Fatal(err)
+	}
+	<-addrCh
+}
+
+func TestSupportedStorageClasses(t *testing.T) {
+	const mrImageStorage = "1.2.840.10008.5.1.4.1.1.4"
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CEcho: func(req netdicom.CEchoRequest) dimse.Status { return dimse.Success },
+		AcceptTransferSyntax: func(sopClassUID, transferSyntaxUID string) bool {
+			return sopClassUID != mrImageStorage
+		},
+	})
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "testclient", sopclass.VerificationClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Implicit VR LE is always accepted, so propose only explicit VR LE to
+	// let the provider reject MR.
+	params.ExtraPresentationContexts = []netdicom.PresentationContext{
+		{AbstractSyntaxUID: ctImageStorage, TransferSyntaxUIDs: []string{dicomuid.ExplicitVRLittleEndian}},
+		{AbstractSyntaxUID: mrImageStorage, TransferSyntaxUIDs: []string{dicomuid.ExplicitVRLittleEndian}},
+	}
+	su := netdicom.NewServiceUser(params)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	if uids := su.SupportedStorageClasses(); len(uids) != 1 || uids[0] != ctImageStorage {
+		t.Errorf("Wrong storage classes: %v", uids)
+	}
+}
+
+type tenantKey struct{}
+
+func TestAssociationContext(t *testing.T) {
+	tenantCh := make(chan interface{}, 2)
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		OnAssociationOpen: func(info netdicom.AssociationInfo) context.Context {
+			return context.WithValue(info.Context, tenantKey{}, "tenant-"+info.CallingAETitle)
+		},
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			tenantCh <- req.Info.Context.Value(tenantKey{})
+			return dimse.Success
+		},
+		OnAssociationClose: func(info netdicom.AssociationInfo, summary netdicom.AssociationSummary) {
+			tenantCh <- info.Context.Value(tenantKey{})
+		},
+	})
+	su := newServiceUser(t, sp, "clinic1", sopclass.StorageClasses)
+	if err := su.CStore(readDICOMFile("testdata/IM-0001-0003.dcm")); err != nil {
+		t.Fatal(err)
+	}
+	su.Release()
+	for i := 0; i < 2; i++ {
+		if tenant := <-tenantCh; tenant != "tenant-clinic1" {
+			t.Errorf("Wrong tenant: %v", tenant)
+		}
+	}
+}
+
+func TestAcceptAssociation(t *testing.T) {
+	contextsCh := make(chan []netdicom.PresentationContext, 2)
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CEcho: func(req netdicom.CEchoRequest) dimse.Status { return dimse.Success },
+		AcceptAssociation: func(callingAETitle, calledAETitle string, acceptedContexts []netdicom.PresentationContext) *netdicom.Rejection {
+			contextsCh <- acceptedContexts
+			if callingAETitle != "friend" {
+				return &netdicom.Rejection{
+					Result: pdu.ResultRejectedPermanent,
+					Source: pdu.SourceULServiceUser,
+					Reason: pdu.ReasonCallingAETitleNotRecognized,
+				}
+			}
+			return nil
+		},
+	})
+	echo := func(callingAETitle string) error {
+		su := newServiceUser(t, sp, callingAETitle, sopclass.VerificationClasses)
+		defer su.Release()
+		return su.CEcho()
+	}
+	if err := echo("friend"); err != nil {
+		t.Error(err)
+	}
+	if contexts := <-contextsCh; len(contexts) != 1 || contexts[0].AbstractSyntaxUID != dicomuid.VerificationSOPClass {
+		t.Errorf("Wrong accepted contexts: %v", contexts)
+	}
+	want := netdicom.Rejection{
+		Result: pdu.ResultRejectedPermanent,
+		Source: pdu.SourceULServiceUser,
+		Reason: pdu.ReasonCallingAETitleNotRecognized,
+	}
+	if err, ok := echo("stranger").(*netdicom.Rejection); !ok || *err != want {
+		t.Errorf("Expect %v, got %v", want, err)
+	}
+	<-contextsCh
+}
+
+func TestOnDIMSECommand(t *testing.T) {
+	var mu sync.Mutex
+	var commands []string
+	stored := 0
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CEcho: func(req netdicom.CEchoRequest) dimse.Status { return dimse.Success },
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			mu.Lock()
+			stored++
+			mu.Unlock()
+			return dimse.Success
+		},
+		OnDIMSECommand: func(info netdicom.AssociationInfo, cmd dimse.Message) error {
+			mu.Lock()
+			commands = append(commands, fmt.Sprintf("%T", cmd))
+			mu.Unlock()
+			if _, ok := cmd.(*dimse.C_STORE_RQ); ok && info.CallingAETitle == "readonly" {
+				return errors.New("read-only AE")
+			}
+			return nil
+		},
+	})
+	params, err := netdicom.NewServiceUserParams(
+		"dontcare", "readonly", sopclass.StorageClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.ProposeVerification = true
+	su := netdicom.NewServiceUser(params)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	if err := su.CEcho(); err != nil {
+		t.Error(err)
+	}
+	err = su.CStore(readDICOMFile("testdata/IM-0001-0003.dcm"))
+	if err == nil || !strings.Contains(err.Error(), "read-only AE") {
+		t.Errorf("Expect C-STORE to be refused, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if stored != 0 {
+		t.Error("Refused C-STORE reached the callback")
+	}
+	if want := "[*dimse.C_ECHO_RQ *dimse.C_STORE_RQ]"; fmt.Sprint(commands) != want {
+		t.Errorf("Got commands %v, want %v", commands, want)
+	}
+}
+
+func TestCFindSeriesAndImageLevels(t *testing.T) {
+	levelCh := make(chan string, 4)
+	sp := startServiceProvider(t, netdicom.ServiceProviderParams{
+		CFind: func(req netdicom.CFindRequest, ch chan netdicom.CFindResult) {
+			levelCh <- req.QRLevel
+			ch <- netdicom.CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(dicom.TagSeriesInstanceUID, "1.2.3.1")}}
+			close(ch)
+		},
+	})
+	su := newServiceUser(t, sp, "viewer", sopclass.QRFindClasses)
+	defer su.Release()
+	find := func(qrLevel netdicom.CFindQRLevel, filter ...*dicom.Element) (matches int, err error) {
+		for result := range su.CFind(qrLevel, filter) {
+			if result.Err != nil {
+				err = result.Err
+			} else {
+				matches++
+			}
+		}
+		return matches, err
+	}
+	studyUID := dicom.MustNewElement(dicom.TagStudyInstanceUID, "1.2.3")
+	if n, err := find(netdicom.CFindSeriesQRLevel, studyUID); err != nil || n != 1 {
+		t.Errorf("SERIES query: %d matches, %v", n, err)
+	}
+	if level := <-levelCh; level != "SERIES" {
+		t.Errorf("Callback got level %v", level)
+	}
+	if _, err := find(netdicom.CFindSeriesQRLevel,
+		dicom.MustNewElement(dicom.TagStudyInstanceUID, "1.2.*")); err == nil {
+		t.Error("SERIES query with a wildcard study UID should fail")
+	}
+	if _, err := find(netdicom.CFindImageQRLevel, studyUID); err == nil {
+		t.Error("IMAGE query without a series UID should fail")
+	}
+	if n, err := find(netdicom.CFindImageQRLevel, studyUID,
+		dicom.MustNewElement(dicom.TagSeriesInstanceUID, "1.2.3.1")); err != nil || n != 1 {
+		t.Errorf("IMAGE query: %d matches, %v", n, err)
+	}
+	if level := <-levelCh; level != "IMAGE" {
+		t.Errorf("Callback got level %v", level)
+	}
+	// Below the patient level of a Patient/Study Only query, the patient
+	// must be given too.
+	if _, err := find(netdicom.CFindPatientStudyOnlyStudyQRLevel, studyUID); err == nil {
+		t.Error("Patient/Study Only STUDY query without a patient ID should fail")
+	}
+	if n, err := find(netdicom.CFindPatientStudyOnlyStudyQRLevel,
+		dicom.MustNewElement(dicom.TagPatientID, "P1")); err != nil || n != 1 {
+		t.Errorf("Patient/Study Only STUDY query: %d matches, %v", n, err)
+	}
+	if level := <-levelCh; level != "STUDY" {
+		t.Errorf("Callback got level %v", level)
+	}
+}
@@ -0,0 +1,126 @@
+package netdicom
+
+// Implements SOP class extended negotiation (P3.7 D.3.3.5) for the
+// Query/Retrieve service class (P3.4 C.5), and SOP class common extended
+// negotiation (P3.7 D.3.3.6).
+
+import (
+	"github.com/yasushi-saito/go-netdicom/pdu"
+	"github.com/yasushi-saito/go-netdicom/sopclass"
+)
+
+// QRExtendedNegotiation lists the optional features of the Query/Retrieve
+// service class that are negotiated per SOP class during the association
+// handshake.
+type QRExtendedNegotiation struct {
+	// Relational queries for C-FIND (P3.4 C.5.1.1), or relational retrieval
+	// for C-MOVE and C-GET (P3.4 C.5.2.1, C.5.3.1).
+	Relational bool
+
+	// Combined date and time range matching (P3.4 C.5.1.1). Meaningful only
+	// for C-FIND.
+	DateTimeMatching bool
+}
+
+// CommonExtendedNegotiation describes a SOP class to the provider during the
+// association handshake, through SOP class common extended negotiation. It lets
+// the provider accept a specialized or private SOP class that it doesn't know,
+// e.g., by treating it as one of the related general SOP classes.
+type CommonExtendedNegotiation struct {
+	// The service class of the SOP class, e.g., "1.2.840.10008.4.2" for
+	// the storage service class.
+	ServiceClassUID string
+
+	// General SOP classes that the SOP class specializes. Optional.
+	RelatedGeneralSOPClassUIDs []string
+}
+
+func (n CommonExtendedNegotiation) encode(sopClassUID string) *pdu.SOPClassCommonExtendedNegotiationSubItem {
+	return &pdu.SOPClassCommonExtendedNegotiationSubItem{
+		SOPClassUID:                sopClassUID,
+		ServiceClassUID:            n.ServiceClassUID,
+		RelatedGeneralSOPClassUIDs: n.RelatedGeneralSOPClassUIDs,
+	}
+}
+
+func decodeCommonExtendedNegotiation(item *pdu.SOPClassCommonExtendedNegotiationSubItem) CommonExtendedNegotiation {
+	return CommonExtendedNegotiation{
+		ServiceClassUID:            item.ServiceClassUID,
+		RelatedGeneralSOPClassUIDs: item.RelatedGeneralSOPClassUIDs,
+	}
+}
+
+func isQRFindClass(uid string) bool {
+	return sopUIDListContains(sopclass.QRFindClasses, uid)
+}
+
+func isQRRetrieveClass(uid string) bool {
+	return sopUIDListContains(sopclass.QRMoveClasses, uid) ||
+		sopUIDListContains(sopclass.QRGetClasses, uid)
+}
+
+func sopUIDListContains(list []sopclass.SOPUID, uid string) bool {
+	for _, sop := range list {
+		if sop.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// Produce the SOPClassExtendedNegotiationSubItem for the given SOP class.
+// Returns nil if "n" enables no feature, or the SOP class is not a
+// Query/Retrieve class.
+func (n QRExtendedNegotiation) encode(sopClassUID string) *pdu.SOPClassExtendedNegotiationSubItem {
+	var info []byte
+	switch {
+	case isQRFindClass(sopClassUID):
+		if !n.Relational && !n.DateTimeMatching {
+			return nil
+		}
+		info = []byte{boolToByte(n.Relational), boolToByte(n.DateTimeMatching)}
+	case isQRRetrieveClass(sopClassUID):
+		if !n.Relational {
+			return nil
+		}
+		info = []byte{boolToByte(n.Relational)}
+	default:
+		return nil
+	}
+	return &pdu.SOPClassExtendedNegotiationSubItem{
+		SOPClassUID:                        sopClassUID,
+		ServiceClassApplicationInformation: info,
+	}
+}
+
+// Inverse of encode. Returns false if the item doesn't belong to a
+// Query/Retrieve class.
+func decodeQRExtendedNegotiation(item *pdu.SOPClassExtendedNegotiationSubItem) (QRExtendedNegotiation, bool) {
+	var n QRExtendedNegotiation
+	info := item.ServiceClassApplicationInformation
+	switch {
+	case isQRFindClass(item.SOPClassUID):
+		n.Relational = len(info) > 0 && info[0] == 1
+		n.DateTimeMatching = len(info) > 1 && info[1] == 1
+	case isQRRetrieveClass(item.SOPClassUID):
+		n.Relational = len(info) > 0 && info[0] == 1
+	default:
+		return n, false
+	}
+	return n, true
+}
+
+// Compute the features enabled on both sides.
+func (n QRExtendedNegotiation) intersect(other QRExtendedNegotiation) QRExtendedNegotiation {
+	return QRExtendedNegotiation{
+		Relational:       n.Relational && other.Relational,
+		DateTimeMatching: n.DateTimeMatching && other.DateTimeMatching,
+	}
+}
+
+func boolToByte(v bool) byte {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,163 @@
+package netdicom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yasushi-saito/go-dicom"
+	"github.com/yasushi-saito/go-dicom/dicomio"
+	"github.com/yasushi-saito/go-netdicom/dimse"
+	"v.io/x/lib/vlog"
+)
+
+// StoredInstance describes an instance received by C-STORE. It is passed to
+// FileStore.PathFunc.
+type StoredInstance struct {
+	TransferSyntaxUID string
+	SOPClassUID       string
+	SOPInstanceUID    string
+
+	// Copied from the dataset. Empty if the dataset lacks the element.
+	PatientID         string
+	StudyInstanceUID  string
+	SeriesInstanceUID string
+}
+
+// FileStore writes instances received by C-STORE as DICOM files under a
+// directory. Its CStore method can be used as ServiceProviderParams.CStore.
+type FileStore struct {
+	// Dir is the root of the directory tree.
+	Dir string
+
+	// PathFunc produces the path of the file for an instance, relative to
+	// Dir. Missing directories are created. If nil, HierarchicalPath is used.
+	PathFunc func(inst StoredInstance) string
+}
+
+// HierarchicalPath is the default FileStore.PathFunc. It stores an instance
+// in file "<patientID>/<studyUID>/<seriesUID>/<sopInstanceUID>.dcm". A
+// missing attribute becomes "unknown". Characters that are unsafe in a path
+// are replaced by '_'.
+func HierarchicalPath(inst StoredInstance) string {
+	return filepath.Join(
+		sanitizePathComponent(inst.PatientID),
+		sanitizePathComponent(inst.StudyInstanceUID),
+		sanitizePathComponent(inst.SeriesInstanceUID),
+		sanitizePathComponent(inst.SOPInstanceUID)+".dcm")
+}
+
+// FlatPath is a FileStore.PathFunc that stores all instances directly under
+// FileStore.Dir, in file "<sopInstanceUID>.dcm". The UID is sanitized as in
+// HierarchicalPath.
+func FlatPath(inst StoredInstance) string {
+	return sanitizePathComponent(inst.SOPInstanceUID) + ".dcm"
+}
+
+func sanitizePathComponent(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "unknown"
+	}
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+	if s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+// WriteFile writes "data", the dataset of a C-STORE request, to a DICOM file
+// with a file meta information header. The header's TransferSyntaxUID is
+// transferSyntaxUID, the syntax that "data" is encoded in, also if it is a
+// compressed one. It returns the path of the new file.
+func (fs *FileStore) WriteFile(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) (string, error) {
+	if _, err := ParseTransferSyntax(transferSyntaxUID); err != nil {
+		return "", fmt.Errorf("%s: %v", sopInstanceUID, err)
+	}
+	inst := StoredInstance{
+		TransferSyntaxUID: transferSyntaxUID,
+		SOPClassUID:       sopClassUID,
+		SOPInstanceUID:    sopInstanceUID,
+	}
+	if err := readHierarchyAttrs(data, &inst); err != nil {
+		// Store the instance nonetheless, under "unknown".
+		vlog.Errorf("%s: failed to read the patient, study, and series: %v", sopInstanceUID, err)
+	}
+	pathFunc := fs.PathFunc
+	if pathFunc == nil {
+		pathFunc = HierarchicalPath
+	}
+	path := filepath.Join(fs.Dir, pathFunc(inst))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	// The data is copied verbatim. Only the header is encoded, always in
+	// Explicit VR Little Endian.
+	e := dicomio.NewEncoder(out, binary.LittleEndian, dicomio.ExplicitVR)
+	dicom.WriteFileHeader(e,
+		[]*dicom.Element{
+			dicom.MustNewElement(dicom.TagTransferSyntaxUID, transferSyntaxUID),
+			dicom.MustNewElement(dicom.TagMediaStorageSOPClassUID, sopClassUID),
+			dicom.MustNewElement(dicom.TagMediaStorageSOPInstanceUID, sopInstanceUID),
+		})
+	e.WriteBytes(data)
+	if err := e.Error(); err != nil {
+		out.Close()
+		return "", fmt.Errorf("%s: write: %v", path, err)
+	}
+	if err := out.Close(); err != nil {
+		return "", fmt.Errorf("%s: close: %v", path, err)
+	}
+	return path, nil
+}
+
+// CStore writes the instance using WriteFile. It has the signature of
+// ServiceProviderParams.CStore.
+func (fs *FileStore) CStore(req CStoreRequest) dimse.Status {
+	path, err := fs.WriteFile(req.TransferSyntaxUID, req.SOPClassUID, req.SOPInstanceUID, req.Data)
+	if err != nil {
+		vlog.Errorf("C-STORE: %v", err)
+		return dimse.Status{Status: dimse.StatusNotAuthorized, ErrorComment: err.Error()}
+	}
+	vlog.VI(1).Infof("C-STORE: Created %v", path)
+	return dimse.Success
+}
+
+// Fill the PatientID, StudyInstanceUID, and SeriesInstanceUID of "inst" from
+// the dataset. The elements are sorted by tag, so stop reading once we pass
+// SeriesInstanceUID, long before the pixel data.
+func readHierarchyAttrs(data []byte, inst *StoredInstance) error {
+	decoder := dicomio.NewBytesDecoderWithTransferSyntax(data, inst.TransferSyntaxUID)
+	for decoder.Len() > 0 {
+		elem := dicom.ReadElement(decoder, dicom.ReadOptions{})
+		if decoder.Error() != nil {
+			return decoder.Error()
+		}
+		if elem.Tag.Group > dicom.TagSeriesInstanceUID.Group ||
+			(elem.Tag.Group == dicom.TagSeriesInstanceUID.Group && elem.Tag.Element > dicom.TagSeriesInstanceUID.Element) {
+			break
+		}
+		switch elem.Tag {
+		case dicom.TagPatientID:
+			inst.PatientID, _ = elem.GetString()
+		case dicom.TagStudyInstanceUID:
+			inst.StudyInstanceUID, _ = elem.GetString()
+		case dicom.TagSeriesInstanceUID:
+			inst.SeriesInstanceUID, _ = elem.GetString()
+		}
+	}
+	return nil
+}
@@ -19,10 +19,7 @@ func startServer(faults *netdicom.FaultInjector) net.Listener {
 	go func() {
 		// TODO(saito) test w/ small PDU.
 		params := netdicom.ServiceProviderParams{
-			CStore: func(transferSyntaxUID string,
-				sopClassUID string,
-				sopInstanceUID string,
-				data []byte) dimse.Status {
+			CStore: func(req netdicom.CStoreRequest) dimse.Status {
 				return dimse.Status{Status: dimse.StatusSuccess}
 			},
 		}
@@ -34,7 +31,8 @@ func startServer(faults *netdicom.FaultInjector) net.Listener {
 				break
 			}
 			log.Printf("Accepted connection %v", conn)
-			netdicom.RunProviderForConn(conn, params)
+			summary := netdicom.RunProviderForConn(conn, params)
+			log.Printf("Association done: %v, operations: %v", summary, summary.Operations)
 		}
 	}()
 	return listener
@@ -16,7 +16,15 @@ func init() {
 func Fuzz(data []byte) int {
 	in := bytes.NewBuffer(data)
 	if len(data) == 0 || data[0] <= 0xc0 {
-		pdu.ReadPDU(in, 4<<20)
+		v, err := pdu.ReadPDU(in, 4<<20)
+		if p, ok := v.(*pdu.P_DATA_TF); err == nil && ok {
+			// Decode the DIMSE message the way the state machine does.
+			var a dimse.CommandAssembler
+			_, command, _, err := a.AddDataPDU(p)
+			for err == nil && command != nil {
+				_, command, _, err = a.NextMessage()
+			}
+		}
 	} else {
 		d := dicomio.NewDecoder(in, int64(len(data)), binary.LittleEndian, dicomio.ExplicitVR)
 		dimse.ReadMessage(d)
@@ -0,0 +1,118 @@
+package netdicom
+
+// Readable dump of the association negotiation, for interoperability
+// debugging. See ServiceUserParams.LogNegotiation.
+
+import (
+	"fmt"
+
+	"github.com/yasushi-saito/go-dicom/dicomuid"
+	"github.com/yasushi-saito/go-netdicom/pdu"
+	"v.io/x/lib/vlog"
+)
+
+// Log "v", an A-ASSOCIATE-RQ, -AC, or -RJ PDU sent or received by sm, one
+// item per line, if the negotiation log is enabled. Other PDUs are ignored.
+// "direction" is "sent" or "received".
+func logNegotiation(sm *stateMachine, direction string, v pdu.PDU) {
+	if !sm.userParams.LogNegotiation && !sm.providerParams.LogNegotiation {
+		return
+	}
+	switch v.(type) {
+	case *pdu.A_ASSOCIATE, *pdu.A_ASSOCIATE_RJ:
+	default:
+		return
+	}
+	for _, line := range negotiationLines(v) {
+		vlog.Infof("%s: %s: %s", sm.label, direction, line)
+	}
+}
+
+// Describe an A-ASSOCIATE-RQ, -AC, or -RJ PDU in human-readable lines. The
+// nested items are indented.
+func negotiationLines(v pdu.PDU) []string {
+	var lines []string
+	var add = func(indent int, format string, args ...interface{}) {
+		line := fmt.Sprintf(format, args...)
+		for i := 0; i < indent; i++ {
+			line = "  " + line
+		}
+		lines = append(lines, line)
+	}
+	switch n := v.(type) {
+	case *pdu.A_ASSOCIATE_RJ:
+		result := "permanent"
+		if n.Result == pdu.ResultRejectedTransient {
+			result = "transient"
+		}
+		source := fmt.Sprintf("%d", n.Source)
+		switch n.Source {
+		case pdu.SourceULServiceUser:
+			source = "service user"
+		case pdu.SourceULServiceProviderACSE:
+			source = "service provider (ACSE)"
+		case pdu.SourceULServiceProviderPresentation:
+			source = "service provider (presentation)"
+		}
+		add(0, "A-ASSOCIATE-RJ: result %s, source %s, reason %d", result, source, n.Reason)
+	case *pdu.A_ASSOCIATE:
+		name := "A-ASSOCIATE-AC"
+		if n.Type == pdu.PDUTypeA_ASSOCIATE_RQ {
+			name = "A-ASSOCIATE-RQ"
+		}
+		add(0, "%s: called AE '%s', calling AE '%s', protocol version %d",
+			name, n.CalledAETitle, n.CallingAETitle, n.ProtocolVersion)
+		for _, item := range n.Items {
+			switch c := item.(type) {
+			case *pdu.ApplicationContextItem:
+				add(1, "application context: %s", c.Name)
+			case *pdu.PresentationContextItem:
+				if c.Type == pdu.ItemTypePresentationContextRequest {
+					add(1, "presentation context %d: proposed", c.ContextID)
+				} else {
+					add(1, "presentation context %d: %s", c.ContextID, c.Result.String())
+				}
+				for _, subItem := range c.Items {
+					switch s := subItem.(type) {
+					case *pdu.AbstractSyntaxSubItem:
+						add(2, "abstract syntax: %s", dicomuid.UIDString(s.Name))
+					case *pdu.TransferSyntaxSubItem:
+						add(2, "transfer syntax: %s", dicomuid.UIDString(s.Name))
+					default:
+						add(2, "%v", subItem)
+					}
+				}
+			case *pdu.UserInformationItem:
+				add(1, "user information:")
+				for _, subItem := range c.Items {
+					switch s := subItem.(type) {
+					case *pdu.UserInformationMaximumLengthItem:
+						add(2, "maximum PDU length: %d", s.MaximumLengthReceived)
+					case *pdu.ImplementationClassUIDSubItem:
+						add(2, "implementation class UID: %s", s.Name)
+					case *pdu.ImplementationVersionNameSubItem:
+						add(2, "implementation version name: %s", s.Name)
+					case *pdu.AsynchronousOperationsWindowSubItem:
+						add(2, "asynchronous operations window: invoked %d, performed %d",
+							s.MaxOpsInvoked, s.MaxOpsPerformed)
+					case *pdu.RoleSelectionSubItem:
+						add(2, "role selection: %s, SCU %d, SCP %d",
+							dicomuid.UIDString(s.SOPClassUID), s.SCURole, s.SCPRole)
+					case *pdu.SOPClassExtendedNegotiationSubItem:
+						add(2, "SOP class extended negotiation: %s, info %v",
+							dicomuid.UIDString(s.SOPClassUID), s.ServiceClassApplicationInformation)
+					case *pdu.SOPClassCommonExtendedNegotiationSubItem:
+						add(2, "SOP class common extended negotiation: %s, service class %s, related %v",
+							dicomuid.UIDString(s.SOPClassUID), dicomuid.UIDString(s.ServiceClassUID),
+							s.RelatedGeneralSOPClassUIDs)
+					default:
+						add(2, "%v", subItem)
+					}
+				}
+			default:
+				add(1, "%v", item)
+			}
+		}
+	}
+	return lines
+}
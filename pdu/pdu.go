@@ -42,17 +42,19 @@ type SubItem interface {
 
 // Possible Type field values for SubItem.
 const (
-	ItemTypeApplicationContext           = 0x10
-	ItemTypePresentationContextRequest   = 0x20
-	ItemTypePresentationContextResponse  = 0x21
-	ItemTypeAbstractSyntax               = 0x30
-	ItemTypeTransferSyntax               = 0x40
-	ItemTypeUserInformation              = 0x50
-	ItemTypeUserInformationMaximumLength = 0x51
-	ItemTypeImplementationClassUID       = 0x52
-	ItemTypeAsynchronousOperationsWindow = 0x53
-	ItemTypeRoleSelection                = 0x54
-	ItemTypeImplementationVersionName    = 0x55
+	ItemTypeApplicationContext                = 0x10
+	ItemTypePresentationContextRequest        = 0x20
+	ItemTypePresentationContextResponse       = 0x21
+	ItemTypeAbstractSyntax                    = 0x30
+	ItemTypeTransferSyntax                    = 0x40
+	ItemTypeUserInformation                   = 0x50
+	ItemTypeUserInformationMaximumLength      = 0x51
+	ItemTypeImplementationClassUID            = 0x52
+	ItemTypeAsynchronousOperationsWindow      = 0x53
+	ItemTypeRoleSelection                     = 0x54
+	ItemTypeImplementationVersionName         = 0x55
+	ItemTypeSOPClassExtendedNegotiation       = 0x56
+	ItemTypeSOPClassCommonExtendedNegotiation = 0x57
 )
 
 func decodeSubItem(d *dicomio.Decoder) SubItem {
@@ -82,6 +84,10 @@ func decodeSubItem(d *dicomio.Decoder) SubItem {
 		return decodeRoleSelectionSubItem(d, length)
 	case ItemTypeImplementationVersionName:
 		return decodeImplementationVersionNameSubItem(d, length)
+	case ItemTypeSOPClassExtendedNegotiation:
+		return decodeSOPClassExtendedNegotiationSubItem(d, length)
+	case ItemTypeSOPClassCommonExtendedNegotiation:
+		return decodeSOPClassCommonExtendedNegotiationSubItem(d, length)
 	default:
 		d.SetError(fmt.Errorf("Unknown item type: 0x%x", itemType))
 		return nil
@@ -236,6 +242,92 @@ func (v *ImplementationVersionNameSubItem) String() string {
 	return fmt.Sprintf("implementationversionname{name: \"%s\"}", v.Name)
 }
 
+// PS3.7 Annex D.3.3.5
+type SOPClassExtendedNegotiationSubItem struct {
+	SOPClassUID string
+	// Service-class specific flags. For the Query/Retrieve service class,
+	// see P3.4 C.5.
+	ServiceClassApplicationInformation []byte
+}
+
+func decodeSOPClassExtendedNegotiationSubItem(d *dicomio.Decoder, length uint16) *SOPClassExtendedNegotiationSubItem {
+	uidLen := d.ReadUInt16()
+	if int(uidLen)+2 > int(length) {
+		d.SetError(fmt.Errorf("SOPClassExtendedNegotiationSubItem: UID length %d exceeds item length %d", uidLen, length))
+		return nil
+	}
+	return &SOPClassExtendedNegotiationSubItem{
+		SOPClassUID:                        d.ReadString(int(uidLen)),
+		ServiceClassApplicationInformation: d.ReadBytes(int(length) - 2 - int(uidLen)),
+	}
+}
+
+func (v *SOPClassExtendedNegotiationSubItem) Write(e *dicomio.Encoder) {
+	encodeSubItemHeader(e, ItemTypeSOPClassExtendedNegotiation,
+		uint16(2+len(v.SOPClassUID)+len(v.ServiceClassApplicationInformation)))
+	e.WriteUInt16(uint16(len(v.SOPClassUID)))
+	e.WriteString(v.SOPClassUID)
+	e.WriteBytes(v.ServiceClassApplicationInformation)
+}
+
+func (v *SOPClassExtendedNegotiationSubItem) String() string {
+	return fmt.Sprintf("sopclassextendednegotiation{sopclassuid: %v, info: %v}",
+		v.SOPClassUID, v.ServiceClassApplicationInformation)
+}
+
+// PS3.7 Annex D.3.3.6. It appears only in A-ASSOCIATE-RQ; the acceptor doesn't
+// reply with it.
+type SOPClassCommonExtendedNegotiationSubItem struct {
+	SOPClassUID string
+	// The service class of SOPClassUID, e.g., "1.2.840.10008.4.2" for the
+	// storage service class.
+	ServiceClassUID string
+	// General SOP classes that SOPClassUID specializes, e.g.,
+	// "1.2.840.10008.5.1.4.1.1.88.11" (Basic Text SR) for a private
+	// structured report class.
+	RelatedGeneralSOPClassUIDs []string
+}
+
+func decodeSOPClassCommonExtendedNegotiationSubItem(d *dicomio.Decoder, length uint16) *SOPClassCommonExtendedNegotiationSubItem {
+	d.PushLimit(int64(length))
+	defer d.PopLimit()
+	v := &SOPClassCommonExtendedNegotiationSubItem{}
+	v.SOPClassUID = d.ReadString(int(d.ReadUInt16()))
+	v.ServiceClassUID = d.ReadString(int(d.ReadUInt16()))
+	relatedLen := d.ReadUInt16()
+	d.PushLimit(int64(relatedLen))
+	for d.Len() > 0 && d.Error() == nil {
+		v.RelatedGeneralSOPClassUIDs = append(v.RelatedGeneralSOPClassUIDs, d.ReadString(int(d.ReadUInt16())))
+	}
+	d.PopLimit()
+	// Skip fields added by a later revision of the standard, if any.
+	d.Skip(int(d.Len()))
+	return v
+}
+
+func (v *SOPClassCommonExtendedNegotiationSubItem) Write(e *dicomio.Encoder) {
+	relatedLen := 0
+	for _, uid := range v.RelatedGeneralSOPClassUIDs {
+		relatedLen += 2 + len(uid)
+	}
+	encodeSubItemHeader(e, ItemTypeSOPClassCommonExtendedNegotiation,
+		uint16(2+len(v.SOPClassUID)+2+len(v.ServiceClassUID)+2+relatedLen))
+	e.WriteUInt16(uint16(len(v.SOPClassUID)))
+	e.WriteString(v.SOPClassUID)
+	e.WriteUInt16(uint16(len(v.ServiceClassUID)))
+	e.WriteString(v.ServiceClassUID)
+	e.WriteUInt16(uint16(relatedLen))
+	for _, uid := range v.RelatedGeneralSOPClassUIDs {
+		e.WriteUInt16(uint16(len(uid)))
+		e.WriteString(uid)
+	}
+}
+
+func (v *SOPClassCommonExtendedNegotiationSubItem) String() string {
+	return fmt.Sprintf("sopclasscommonextendednegotiation{sopclassuid: %v, serviceclassuid: %v, related: %v}",
+		v.SOPClassUID, v.ServiceClassUID, v.RelatedGeneralSOPClassUIDs)
+}
+
 // Container for subitems that this package doesnt' support
 type SubItemUnsupported struct {
 	Type byte
@@ -405,7 +497,9 @@ func (v *PresentationContextItem) Write(e *dicomio.Encoder) {
 	itemBytes := itemEncoder.Bytes()
 	encodeSubItemHeader(e, v.Type, uint16(4+len(itemBytes)))
 	e.WriteByte(v.ContextID)
-	e.WriteZeros(3)
+	e.WriteZeros(1)
+	e.WriteByte(byte(v.Result)) // zero for a request.
+	e.WriteZeros(1)
 	e.WriteBytes(itemBytes)
 }
 
@@ -669,10 +763,21 @@ const (
 	SourceULServiceProviderPresentation = 3
 )
 
-// Possible values for A_ASSOCIATE_RJ.Reason
+// Possible values for A_ASSOCIATE_RJ.Reason. The meaning depends on
+// A_ASSOCIATE_RJ.Source. P3.8 9.3.4, table 9-21.
 const (
+	// For SourceULServiceUser
 	ReasonNone                               = 1
 	ReasonApplicationContextNameNotSupported = 2
+	ReasonCallingAETitleNotRecognized        = 3
+	ReasonCalledAETitleNotRecognized         = 7
+
+	// For SourceULServiceProviderACSE
+	ReasonProtocolVersionNotSupported = 2
+
+	// For SourceULServiceProviderPresentation
+	ReasonTemporaryCongestion = 1
+	ReasonLocalLimitExceeded  = 2
 )
 
 func decodeA_ASSOCIATE_RJ(d *dicomio.Decoder) *A_ASSOCIATE_RJ {
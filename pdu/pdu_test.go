@@ -0,0 +1,45 @@
+package pdu_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/yasushi-saito/go-netdicom/pdu"
+)
+
+func TestAAssociateACRoundTrip(t *testing.T) {
+	in := &pdu.A_ASSOCIATE{
+		Type:            pdu.PDUTypeA_ASSOCIATE_AC,
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		// AE titles are padded to 16 bytes on the wire.
+		CalledAETitle:  "calledae        ",
+		CallingAETitle: "callingae       ",
+		Items: []pdu.SubItem{
+			&pdu.ApplicationContextItem{Name: pdu.DICOMApplicationContextItemName},
+			&pdu.PresentationContextItem{
+				Type:      pdu.ItemTypePresentationContextResponse,
+				ContextID: 1,
+				Result:    pdu.PresentationContextAccepted,
+				Items:     []pdu.SubItem{&pdu.TransferSyntaxSubItem{Name: "1.2.840.10008.1.2"}},
+			},
+			&pdu.PresentationContextItem{
+				Type:      pdu.ItemTypePresentationContextResponse,
+				ContextID: 3,
+				Result:    pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported,
+				Items:     []pdu.SubItem{&pdu.TransferSyntaxSubItem{Name: "1.2.840.10008.1.2.1"}},
+			},
+		},
+	}
+	data, err := pdu.EncodePDU(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := pdu.ReadPDU(bytes.NewReader(data), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Round trip mismatch:\n got %v\nwant %v", out, in)
+	}
+}
@@ -0,0 +1,115 @@
+package netdicom
+
+// Validates the QueryRetrieveLevel (0008,0052) of C-FIND, C-MOVE and C-GET
+// requests against the information model of the SOP class. P3.4 C.6.
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yasushi-saito/go-dicom"
+)
+
+// The levels allowed by each Query/Retrieve information model. Each model is
+// identified by the UID prefix shared by its FIND, MOVE, and GET SOP classes.
+//
+// higherLevelKeys lists, for each level, the unique keys of the levels above
+// it in the model, which a hierarchical query at that level must specify.
+// P3.4 C.4.1.2.2.1.
+var qrInformationModels = []struct {
+	uidPrefix       string
+	levels          []string
+	higherLevelKeys map[string][]dicom.Tag
+}{
+	{ // Patient Root
+		"1.2.840.10008.5.1.4.1.2.1.",
+		[]string{"PATIENT", "STUDY", "SERIES", "IMAGE"},
+		map[string][]dicom.Tag{
+			"STUDY":  {dicom.TagPatientID},
+			"SERIES": {dicom.TagPatientID, dicom.TagStudyInstanceUID},
+			"IMAGE":  {dicom.TagPatientID, dicom.TagStudyInstanceUID, dicom.TagSeriesInstanceUID},
+		},
+	},
+	{ // Study Root
+		"1.2.840.10008.5.1.4.1.2.2.",
+		[]string{"STUDY", "SERIES", "IMAGE"},
+		map[string][]dicom.Tag{
+			"SERIES": {dicom.TagStudyInstanceUID},
+			"IMAGE":  {dicom.TagStudyInstanceUID, dicom.TagSeriesInstanceUID},
+		},
+	},
+	{ // Patient/Study Only
+		"1.2.840.10008.5.1.4.1.2.3.",
+		[]string{"PATIENT", "STUDY"},
+		map[string][]dicom.Tag{
+			"STUDY": {dicom.TagPatientID},
+		},
+	},
+}
+
+// Check that the QueryRetrieveLevel in "elems" is one allowed by the
+// information model of "sopClassUID", and return it, without padding. SOP
+// classes that don't belong to a Query/Retrieve information model (e.g.,
+// modality worklist) are not checked; the level is "" if the request lacks
+// one.
+func validateQRLevel(sopClassUID string, elems []*dicom.Element) (string, error) {
+	var levels []string
+	for _, model := range qrInformationModels {
+		if strings.HasPrefix(sopClassUID, model.uidPrefix) {
+			levels = model.levels
+			break
+		}
+	}
+	for _, elem := range elems {
+		if elem.Tag != dicom.TagQueryRetrieveLevel {
+			continue
+		}
+		level, err := elem.GetString()
+		if err != nil {
+			return "", err
+		}
+		level = strings.TrimSpace(level)
+		if levels == nil {
+			return level, nil
+		}
+		for _, l := range levels {
+			if l == level {
+				return level, nil
+			}
+		}
+		return "", fmt.Errorf("QueryRetrieveLevel '%s' not supported by SOP class %s; must be one of %v", level, sopClassUID, levels)
+	}
+	if levels == nil {
+		return "", nil
+	}
+	return "", fmt.Errorf("QueryRetrieveLevel missing in the request for SOP class %s", sopClassUID)
+}
+
+// Check that a hierarchical C-FIND at "level" of the information model of
+// "sopClassUID" specifies a single value for the unique key of each level
+// above it, e.g., StudyInstanceUID for a Study Root SERIES query. A relational
+// query (see QRExtendedNegotiation.Relational) may omit them, so it isn't
+// checked.
+func validateQRKeys(sopClassUID string, level string, elems []*dicom.Element) error {
+	var keys []dicom.Tag
+	for _, model := range qrInformationModels {
+		if strings.HasPrefix(sopClassUID, model.uidPrefix) {
+			keys = model.higherLevelKeys[level]
+			break
+		}
+	}
+	for _, tag := range keys {
+		var value string
+		for _, elem := range elems {
+			if elem.Tag == tag {
+				value, _ = elem.GetString()
+				break
+			}
+		}
+		value = strings.TrimRight(value, " \x00")
+		if value == "" || strings.ContainsAny(value, "*?\\") {
+			return fmt.Errorf("%s query must specify a single %s", level, dicom.TagString(tag))
+		}
+	}
+	return nil
+}
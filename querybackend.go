@@ -0,0 +1,78 @@
+package netdicom
+
+import (
+	"github.com/yasushi-saito/go-dicom"
+	"v.io/x/lib/vlog"
+)
+
+// QueryResult is a match, or an error, produced by QueryBackend.Find.
+type QueryResult struct {
+	// Elements of the matching dataset, including the return keys.
+	Elements []*dicom.Element
+
+	// Non-nil if the query failed. Ends the C-FIND with status
+	// dimse.CFindUnableToProcess.
+	Err error
+}
+
+// QueryBackend serves C-FIND requests from a database, an index, or another
+// archive, as an alternative to ServiceProviderParams.CFind. Set it in
+// ServiceProviderParams.QueryBackend.
+type QueryBackend interface {
+	// Find starts a query. "level" is the QueryRetrieveLevel of the request,
+	// e.g., "STUDY", or "" if the request lacks one. "filter" is the
+	// identifier of the request, including the QueryRetrieveLevel element.
+	//
+	// Find should return quickly, and stream the matches through the
+	// channel, which it must close after the last one. An error returned by
+	// Find fails the C-FIND. If the requestor cancels the query, the
+	// remaining results are read and discarded.
+	Find(level string, filter []*dicom.Element) (<-chan QueryResult, error)
+}
+
+// Return the callback that serves C-FIND requests, or nil if C-FIND isn't
+// supported.
+func (params *ServiceProviderParams) cfindCallback() CFindCallback {
+	if params.CFind != nil {
+		return params.CFind
+	}
+	if params.QueryBackend != nil {
+		return queryBackendCFind(params.QueryBackend)
+	}
+	return nil
+}
+
+// Adapt a QueryBackend to a CFindCallback.
+func queryBackendCFind(backend QueryBackend) CFindCallback {
+	return func(req CFindRequest, ch chan CFindResult) {
+		defer close(ch)
+		results, err := backend.Find(req.QRLevel, req.Filters)
+		if err != nil {
+			ch <- CFindResult{Err: err}
+			return
+		}
+		for {
+			select {
+			case result, ok := <-results:
+				if !ok {
+					return
+				}
+				ch <- CFindResult{Elements: result.Elements, Err: result.Err}
+				if result.Err != nil {
+					go drainQueryResults(results)
+					return
+				}
+			case <-req.Cancel:
+				vlog.VI(1).Infof("C-FIND: cancelled; discarding the remaining backend results")
+				go drainQueryResults(results)
+				return
+			}
+		}
+	}
+}
+
+// Read the rest of "results", so that the backend doesn't block forever.
+func drainQueryResults(results <-chan QueryResult) {
+	for _ = range results {
+	}
+}
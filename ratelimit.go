@@ -0,0 +1,95 @@
+package netdicom
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/yasushi-saito/go-netdicom/pdu"
+)
+
+// NewAERateLimiter creates a function suitable for
+// ServiceProviderParams.RateLimitPerAE. It runs one token bucket per calling
+// AE title: each AE may open up to "burst" associations at once, and the
+// bucket refills at "perSecond" associations per second. An association over
+// the limit is rejected as transient, with reason "temporary congestion". The
+// bucket of an AE that has been idle long enough to refill is discarded, so
+// that the memory use is bounded by the number of AEs seen recently, rather
+// than ever.
+//
+// The returned function is thread safe.
+func NewAERateLimiter(perSecond float64, burst int) func(callingAETitle string) *Rejection {
+	l := &aeRateLimiter{
+		perSecond: perSecond,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		now:       time.Now,
+	}
+	return func(callingAETitle string) *Rejection {
+		if l.allow(callingAETitle) {
+			return nil
+		}
+		return &Rejection{
+			Result: pdu.ResultRejectedTransient,
+			Source: pdu.SourceULServiceProviderPresentation,
+			Reason: pdu.ReasonTemporaryCongestion,
+		}
+	}
+}
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+type aeRateLimiter struct {
+	perSecond float64
+	burst     float64
+	now       func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket // keyed by AE title. Guarded by mu.
+	lastSweep time.Time               // Last call to sweep. Guarded by mu.
+}
+
+// Delete the buckets that have refilled. They are the same as new ones.
+//
+// REQUIRES: l.mu is held.
+func (l *aeRateLimiter) sweep(now time.Time) {
+	seconds := l.burst / l.perSecond
+	if l.perSecond <= 0 || seconds >= float64(math.MaxInt64/int64(time.Second)) {
+		return // The buckets never refill, in practice.
+	}
+	refill := time.Duration(seconds * float64(time.Second))
+	if now.Sub(l.lastSweep) < refill {
+		return
+	}
+	l.lastSweep = now
+	for ae, b := range l.buckets {
+		if now.Sub(b.lastRefill) >= refill {
+			delete(l.buckets, ae)
+		}
+	}
+}
+
+func (l *aeRateLimiter) allow(callingAETitle string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[callingAETitle]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, lastRefill: now}
+		l.buckets[callingAETitle] = b
+	}
+	b.tokens += now.Sub(b.lastRefill).Seconds() * l.perSecond
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.lastRefill = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,36 @@
+package netdicom
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAERateLimiterEvictsIdleBuckets(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := &aeRateLimiter{
+		perSecond: 1,
+		burst:     2,
+		buckets:   make(map[string]*tokenBucket),
+		now:       func() time.Time { return now },
+	}
+	for _, ae := range []string{"ae1", "ae2", "ae3"} {
+		if !l.allow(ae) {
+			t.Fatalf("%s: rejected", ae)
+		}
+	}
+	if !l.allow("ae1") || l.allow("ae1") {
+		t.Error("ae1 should be limited to a burst of 2")
+	}
+	if len(l.buckets) != 3 {
+		t.Errorf("Got %d buckets, want 3", len(l.buckets))
+	}
+
+	// The buckets refill in two seconds. Only ae1's is in use after that.
+	now = now.Add(3 * time.Second)
+	if !l.allow("ae1") {
+		t.Error("ae1 should be allowed after the refill")
+	}
+	if len(l.buckets) != 1 {
+		t.Errorf("Got %d buckets, want 1", len(l.buckets))
+	}
+}
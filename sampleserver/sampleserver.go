@@ -7,17 +7,18 @@ package main
 // It starts a DICOM server and serves files under <directory>.
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
-	"path"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/yasushi-saito/go-dicom"
-	"github.com/yasushi-saito/go-dicom/dicomio"
 	"github.com/yasushi-saito/go-dicom/dicomuid"
 	"github.com/yasushi-saito/go-netdicom"
 	"github.com/yasushi-saito/go-netdicom/dimse"
@@ -37,6 +38,12 @@ Defaults to '.'.`)
 	outputFlag = flag.String("output", "", `
 The directory to store files received by C-STORE.
 If empty, use <dir>/incoming, where <dir> is the value of the -dir flag.`)
+	flatFlag = flag.Bool("flat", false, `
+If true, store files received by C-STORE as <output>/<sopinstanceuid>.dcm.
+Otherwise, store them as <output>/<patientid>/<studyuid>/<seriesuid>/<sopinstanceuid>.dcm.`)
+	logNegotiationFlag = flag.Bool("log-negotiation", false, `
+If true, log the presentation contexts and user information items proposed by
+each client, and the results sent back.`)
 )
 
 type server struct {
@@ -46,8 +53,8 @@ type server struct {
 	// by mu.
 	datasets map[string]*dicom.DataSet
 
-	// For generating new unique path in C-STORE. Guarded by mu.
-	pathSeq int32
+	// Writes files received by C-STORE.
+	store *netdicom.FileStore
 }
 
 func (ss *server) onCStore(
@@ -55,44 +62,9 @@ func (ss *server) onCStore(
 	sopClassUID string,
 	sopInstanceUID string,
 	data []byte) dimse.Status {
-	ss.mu.Lock()
-	defer ss.mu.Unlock()
-	ss.pathSeq++
-	path := path.Join(*outputFlag, fmt.Sprintf("image%04d.dcm", ss.pathSeq))
-	out, err := os.Create(path)
+	path, err := ss.store.WriteFile(transferSyntaxUID, sopClassUID, sopInstanceUID, data)
 	if err != nil {
-		dirPath := filepath.Dir(path)
-		err := os.MkdirAll(dirPath, 0755)
-		if err != nil {
-			return dimse.Status{Status: dimse.StatusNotAuthorized, ErrorComment: err.Error()}
-		}
-		out, err = os.Create(path)
-		if err != nil {
-			vlog.Errorf("%s: create: %v", path, err)
-			return dimse.Status{Status: dimse.StatusNotAuthorized, ErrorComment: err.Error()}
-		}
-	}
-	defer func() {
-		if out != nil {
-			out.Close()
-		}
-	}()
-	e := dicomio.NewEncoderWithTransferSyntax(out, transferSyntaxUID)
-	dicom.WriteFileHeader(e,
-		[]*dicom.Element{
-			dicom.MustNewElement(dicom.TagTransferSyntaxUID, transferSyntaxUID),
-			dicom.MustNewElement(dicom.TagMediaStorageSOPClassUID, sopClassUID),
-			dicom.MustNewElement(dicom.TagMediaStorageSOPInstanceUID, sopInstanceUID),
-		})
-	e.WriteBytes(data)
-	if err := e.Error(); err != nil {
-		vlog.Errorf("%s: write: %v", path, err)
-		return dimse.Status{Status: dimse.StatusNotAuthorized, ErrorComment: err.Error()}
-	}
-	err = out.Close()
-	out = nil
-	if err != nil {
-		vlog.Errorf("%s: close %s", path, err)
+		vlog.Errorf("C-STORE: %v", err)
 		return dimse.Status{Status: dimse.StatusNotAuthorized, ErrorComment: err.Error()}
 	}
 	vlog.Infof("C-STORE: Created %v", path)
@@ -101,7 +73,9 @@ func (ss *server) onCStore(
 	if err != nil {
 		vlog.Errorf("%s: failed to parse dicom file: %v", path, err)
 	} else {
+		ss.mu.Lock()
 		ss.datasets[path] = ds
+		ss.mu.Unlock()
 	}
 	return dimse.Success
 }
@@ -118,12 +92,23 @@ func (ss *server) findMatchingFiles(filters []*dicom.Element) ([]filterMatch, er
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
 
+	// TimezoneOffsetFromUTC is not a matching key; it tells the timezone of
+	// the date and datetime keys.
+	var tzOffset string
+	var keys []*dicom.Element
+	for _, filter := range filters {
+		if filter.Tag == dicom.TagTimezoneOffsetFromUTC {
+			tzOffset, _ = filter.GetString()
+			continue
+		}
+		keys = append(keys, filter)
+	}
 	var matches []filterMatch
 	for path, ds := range ss.datasets {
 		allMatched := true
 		match := filterMatch{path: path}
-		for _, filter := range filters {
-			ok, elem, err := dicom.Query(ds, filter)
+		for _, filter := range keys {
+			ok, elem, err := queryDataSet(ds, filter, tzOffset)
 			if err != nil {
 				return matches, err
 			}
@@ -153,36 +138,55 @@ func (ss *server) findMatchingFiles(filters []*dicom.Element) ([]filterMatch, er
 	return matches, nil
 }
 
-func (ss *server) onCFind(
-	transferSyntaxUID string,
-	sopClassUID string,
-	filters []*dicom.Element,
-	ch chan netdicom.CFindResult) {
+// Wrapper for dicom.Query that matches DA and DT keys using their ranges and
+// the timezone of the query.
+func queryDataSet(ds *dicom.DataSet, filter *dicom.Element, tzOffset string) (bool, *dicom.Element, error) {
+	if filter.VR != "DA" && filter.VR != "DT" {
+		return dicom.Query(ds, filter)
+	}
+	key, err := filter.GetString()
+	if err != nil || key == "" {
+		return dicom.Query(ds, filter)
+	}
+	elem, err := ds.FindElementByTag(filter.Tag)
+	if err != nil {
+		return false, nil, nil
+	}
+	value, err := elem.GetString()
+	if err != nil {
+		return false, nil, err
+	}
+	return netdicom.MatchDateTimeRange(key, value, tzOffset), elem, nil
+}
+
+// Find implements netdicom.QueryBackend.
+func (ss *server) Find(level string, filters []*dicom.Element) (<-chan netdicom.QueryResult, error) {
 	for _, filter := range filters {
 		vlog.Infof("CFind: filter %v", filter)
 	}
-	vlog.Infof("CFind: transfersyntax: %v, classuid: %v",
-		dicomuid.UIDString(transferSyntaxUID),
-		dicomuid.UIDString(sopClassUID))
+	vlog.Infof("CFind: level: %v", level)
 	// Match the filter against every file. This is just for demonstration
 	matches, err := ss.findMatchingFiles(filters)
 	vlog.Infof("C-FIND: found %d matches, err %v", len(matches), err)
 	if err != nil {
-		ch <- netdicom.CFindResult{Err: err}
-	} else {
-		for _, match := range matches {
-			vlog.VI(1).Infof("C-FIND resp %s: %v", match.path, match.elems)
-			ch <- netdicom.CFindResult{Elements: match.elems}
-		}
+		return nil, err
+	}
+	ch := make(chan netdicom.QueryResult, len(matches))
+	for _, match := range matches {
+		vlog.VI(1).Infof("C-FIND resp %s: %v", match.path, match.elems)
+		ch <- netdicom.QueryResult{Elements: match.elems}
 	}
 	close(ch)
+	return ch, nil
 }
 
 func (ss *server) onCMoveOrCGet(
 	transferSyntaxUID string,
 	sopClassUID string,
 	filters []*dicom.Element,
+	cancel <-chan struct{},
 	ch chan netdicom.CMoveResult) {
+	defer close(ch)
 	vlog.Infof("C-MOVE: transfersyntax: %v, classuid: %v",
 		dicomuid.UIDString(transferSyntaxUID),
 		dicomuid.UIDString(sopClassUID))
@@ -196,6 +200,12 @@ func (ss *server) onCMoveOrCGet(
 		ch <- netdicom.CMoveResult{Err: err}
 	} else {
 		for i, match := range matches {
+			select {
+			case <-cancel:
+				vlog.Infof("C-MOVE: cancelled")
+				return
+			default:
+			}
 			vlog.VI(1).Infof("C-MOVE resp %d %s: %v", i, match.path, match.elems)
 			// Read the file; the one in ss.datasets lack the PixelData.
 			ds, err := dicom.ReadDataSetFromFile(match.path, dicom.ReadOptions{})
@@ -304,34 +314,46 @@ func main() {
 	ss := server{
 		mu:       &sync.Mutex{},
 		datasets: datasets,
+		store:    &netdicom.FileStore{Dir: *outputFlag},
+	}
+	if *flatFlag {
+		ss.store.PathFunc = netdicom.FlatPath
 	}
 	vlog.Infof("Listening on %s", port)
 	params := netdicom.ServiceProviderParams{
 		AETitle:   *aeFlag,
 		RemoteAEs: remoteAEs,
-		CEcho: func() dimse.Status {
+		CEcho: func(req netdicom.CEchoRequest) dimse.Status {
 			vlog.Info("Received C-ECHO")
 			return dimse.Success
 		},
-		CFind: func(transferSyntaxUID string, sopClassUID string, filter []*dicom.Element, ch chan netdicom.CFindResult) {
-			ss.onCFind(transferSyntaxUID, sopClassUID, filter, ch)
-		},
-		CMove: func(transferSyntaxUID string, sopClassUID string, filter []*dicom.Element, ch chan netdicom.CMoveResult) {
-			ss.onCMoveOrCGet(transferSyntaxUID, sopClassUID, filter, ch)
+		QueryBackend: &ss,
+		CMove: func(req netdicom.CMoveRequest, ch chan netdicom.CMoveResult) {
+			ss.onCMoveOrCGet(req.TransferSyntaxUID, req.SOPClassUID, req.Filters, req.Cancel, ch)
 		},
-		CGet: func(transferSyntaxUID string, sopClassUID string, filter []*dicom.Element, ch chan netdicom.CMoveResult) {
-			ss.onCMoveOrCGet(transferSyntaxUID, sopClassUID, filter, ch)
+		CGet: func(req netdicom.CMoveRequest, ch chan netdicom.CMoveResult) {
+			ss.onCMoveOrCGet(req.TransferSyntaxUID, req.SOPClassUID, req.Filters, req.Cancel, ch)
 		},
-		CStore: func(transferSyntaxUID string,
-			sopClassUID string,
-			sopInstanceUID string,
-			data []byte) dimse.Status {
-			return ss.onCStore(transferSyntaxUID, sopClassUID, sopInstanceUID, data)
+		CStore: func(req netdicom.CStoreRequest) dimse.Status {
+			return ss.onCStore(req.TransferSyntaxUID, req.SOPClassUID, req.SOPInstanceUID, req.Data)
 		},
 	}
+	params.LogNegotiation = *logNegotiationFlag
 	sp, err := netdicom.NewServiceProvider(params, port)
 	if err != nil {
 		panic(err)
 	}
+	// Stop the running C-FIND, C-MOVE, and C-GET requests on ^C.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		<-sigCh
+		vlog.Infof("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := sp.Shutdown(ctx); err != nil {
+			vlog.Errorf("Shutdown: %v", err)
+		}
+	}()
 	sp.Run()
 }
@@ -3,9 +3,13 @@
 package netdicom
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/yasushi-saito/go-dicom"
 	"github.com/yasushi-saito/go-dicom/dicomio"
@@ -18,9 +22,22 @@ import (
 type providerCommandDispatcher struct {
 	downcallCh chan stateEvent // for sending PDUs to the statemachine.
 	params     ServiceProviderParams
+	info       AssociationInfo // Set when the handshake completes.
+	tracer     Tracer
+	span       Span // Tracing span of the association. Set when the handshake completes.
+
+	// Closed by ServiceProvider.Shutdown. Nil if there is no
+	// ServiceProvider.
+	shutdownCh <-chan struct{}
 
 	mu             sync.Mutex
 	activeCommands map[uint16]*providerCommandState // guarded by mu
+	summary        AssociationSummary               // guarded by mu
+
+	// SOP instance UIDs stored, or being stored, on this association. Used
+	// only when params.DuplicateInstancePolicy != DuplicateInstanceStore.
+	// Guarded by mu.
+	storedInstances map[string]bool
 }
 
 func (dc *providerCommandDispatcher) findOrCreateCommand(
@@ -38,6 +55,7 @@ func (dc *providerCommandDispatcher) findOrCreateCommand(
 		cm:        cm,
 		context:   context,
 		upcallCh:  make(chan upcallEvent, 128),
+		cancelCh:  make(chan struct{}),
 	}
 	dc.activeCommands[messageID] = cs
 	vlog.VI(1).Infof("Start provider command %v", messageID)
@@ -54,6 +72,29 @@ func (dc *providerCommandDispatcher) deleteCommand(cs *providerCommandState) {
 	dc.mu.Unlock()
 }
 
+// Handle C-CANCEL-RQ. It carries no response. A request for a command that has
+// already finished is ignored.
+func (dc *providerCommandDispatcher) cancelCommand(c *dimse.C_CANCEL_RQ) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	cs, ok := dc.activeCommands[c.MessageIDBeingRespondedTo]
+	if !ok {
+		vlog.VI(1).Infof("C-CANCEL for inactive command %v; ignoring", c.MessageIDBeingRespondedTo)
+		return
+	}
+	cs.cancelLocked()
+}
+
+// Close cs.cancelCh, unless already closed.
+//
+// REQUIRES: cs.parent.mu is held.
+func (cs *providerCommandState) cancelLocked() {
+	if !cs.cancelled {
+		cs.cancelled = true
+		close(cs.cancelCh)
+	}
+}
+
 // Per-command-invocation state.
 type providerCommandState struct {
 	parent    *providerCommandDispatcher // parent dispatcher
@@ -63,17 +104,85 @@ type providerCommandState struct {
 
 	// upcallCh streams PROVIDER command+data for the given messageID.
 	upcallCh chan upcallEvent
+
+	// The status of the final response sent for the command, if any.
+	finalStatus *dimse.Status
+
+	// Closed when the requestor cancels the command, or the
+	// ServiceProvider shuts down. C-FIND, C-MOVE, and C-GET honor it.
+	cancelCh  chan struct{}
+	cancelled bool // guarded by parent.mu
+}
+
+// Checks if the instance was already stored on this association, per
+// params.DuplicateInstancePolicy. If it returns false, the caller must call
+// doneCStore once the instance is stored.
+func (dc *providerCommandDispatcher) isDuplicateCStore(sopInstanceUID string) bool {
+	if dc.params.DuplicateInstancePolicy == DuplicateInstanceStore {
+		return false
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.storedInstances[sopInstanceUID] {
+		return true
+	}
+	if dc.storedInstances == nil {
+		dc.storedInstances = make(map[string]bool)
+	}
+	dc.storedInstances[sopInstanceUID] = true
+	return false
+}
+
+// Record the outcome of a C-STORE that passed isDuplicateCStore. A failed
+// instance may be resent.
+func (dc *providerCommandDispatcher) doneCStore(sopInstanceUID string, status dimse.Status) {
+	if dc.params.DuplicateInstancePolicy == DuplicateInstanceStore || !isFailureStatus(status) {
+		return
+	}
+	dc.mu.Lock()
+	delete(dc.storedInstances, sopInstanceUID)
+	dc.mu.Unlock()
 }
 
 func (cs *providerCommandState) handleCStore(c *dimse.C_STORE_RQ, data []byte) {
 	status := dimse.Status{Status: dimse.StatusUnrecognizedOperation}
-	if cs.parent.params.CStore != nil {
-		status = cs.parent.params.CStore(
-			cs.context.transferSyntaxUID,
-			c.AffectedSOPClassUID,
-			c.AffectedSOPInstanceUID,
-			data)
+	duplicate := false
+	// Check the encoding first, so that a rejected instance isn't recorded
+	// as stored, and the requestor may resend it correctly encoded.
+	if err := CheckDataSetEncoding(data, cs.context.transferSyntaxUID); err != nil {
+		// Storing the data would archive an instance that can't be
+		// read back correctly.
+		vlog.Errorf("C-STORE: %v from %v: %v", c.AffectedSOPInstanceUID, cs.parent.info.CallingAETitle, err)
+		status = dimse.Status{Status: dimse.CStoreStatusCannotUnderstand, ErrorComment: err.Error()}
+	} else if cs.parent.isDuplicateCStore(c.AffectedSOPInstanceUID) {
+		vlog.Infof("C-STORE: duplicate SOP instance %v from %v", c.AffectedSOPInstanceUID, cs.parent.info.CallingAETitle)
+		duplicate = true
+		status = dimse.Success
+		if cs.parent.params.DuplicateInstancePolicy == DuplicateInstanceReject {
+			status = dimse.Status{
+				Status:       dimse.CStoreStatusDuplicateInstance,
+				ErrorComment: "SOP instance already stored on this association",
+			}
+		}
+	} else {
+		if cs.parent.params.CStore != nil {
+			status = cs.parent.params.CStore(CStoreRequest{
+				Info:              cs.parent.info,
+				TransferSyntaxUID: cs.context.transferSyntaxUID,
+				SOPClassUID:       c.AffectedSOPClassUID,
+				SOPInstanceUID:    c.AffectedSOPInstanceUID,
+				Data:              data,
+			})
+		}
+		cs.parent.doneCStore(c.AffectedSOPInstanceUID, status)
+	}
+	cs.parent.mu.Lock()
+	if duplicate {
+		cs.parent.summary.NumDuplicates++
+	} else {
+		cs.parent.summary.addCStore(c.AffectedSOPClassUID, len(data), status)
 	}
+	cs.parent.mu.Unlock()
 	resp := &dimse.C_STORE_RSP{
 		AffectedSOPClassUID:       c.AffectedSOPClassUID,
 		MessageIDBeingRespondedTo: c.MessageID,
@@ -85,7 +194,8 @@ func (cs *providerCommandState) handleCStore(c *dimse.C_STORE_RQ, data []byte) {
 }
 
 func (cs *providerCommandState) handleCFind(c *dimse.C_FIND_RQ, data []byte) {
-	if cs.parent.params.CFind == nil {
+	cfind := cs.parent.params.cfindCallback()
+	if cfind == nil {
 		cs.sendMessage(&dimse.C_FIND_RSP{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo: c.MessageID,
@@ -94,7 +204,7 @@ func (cs *providerCommandState) handleCFind(c *dimse.C_FIND_RQ, data []byte) {
 		}, nil)
 		return
 	}
-	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
+	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID, cs.parent.params.MaxSequenceDepth)
 	if err != nil {
 		cs.sendMessage(&dimse.C_FIND_RSP{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
@@ -105,13 +215,48 @@ func (cs *providerCommandState) handleCFind(c *dimse.C_FIND_RQ, data []byte) {
 		return
 	}
 	vlog.VI(1).Infof("C-FIND-RQ payload: %s", elementsString(elems))
+	qrLevel, err := validateQRLevel(c.AffectedSOPClassUID, elems)
+	if err == nil && !cs.parent.info.QRExtendedNegotiation(c.AffectedSOPClassUID).Relational {
+		err = validateQRKeys(c.AffectedSOPClassUID, qrLevel, elems)
+	}
+	if err != nil {
+		cs.sendMessage(&dimse.C_FIND_RSP{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    dimse.Status{Status: dimse.CFindIdentifierDoesNotMatchSOPClass, ErrorComment: err.Error()},
+		}, nil)
+		return
+	}
 
 	status := dimse.Status{Status: dimse.StatusSuccess}
 	responseCh := make(chan CFindResult, 128)
 	go func() {
-		cs.parent.params.CFind(cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
+		cfind(CFindRequest{
+			Info:              cs.parent.info,
+			TransferSyntaxUID: cs.context.transferSyntaxUID,
+			SOPClassUID:       c.AffectedSOPClassUID,
+			QRLevel:           qrLevel,
+			Filters:           elems,
+			Cancel:            cs.cancelCh,
+		}, responseCh)
 	}()
-	for resp := range responseCh {
+loop:
+	for {
+		var resp CFindResult
+		var ok bool
+		select {
+		case resp, ok = <-responseCh:
+		case <-cs.cancelCh:
+			// The requestor sent C-CANCEL-FIND-RQ (P3.4 C.4.1.3.2), or
+			// the provider is shutting down.
+			vlog.VI(1).Infof("C-FIND: cancelled")
+			status = dimse.Status{Status: dimse.StatusCancel}
+			break loop
+		}
+		if !ok {
+			break
+		}
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -119,6 +264,15 @@ func (cs *providerCommandState) handleCFind(c *dimse.C_FIND_RQ, data []byte) {
 			}
 			break
 		}
+		if len(resp.Elements) == 0 {
+			// A pending response must carry an identifier.
+			vlog.Errorf("C-FIND: callback produced an empty result")
+			status = dimse.Status{
+				Status:       dimse.CFindUnableToProcess,
+				ErrorComment: "C-FIND callback produced an empty result",
+			}
+			break
+		}
 		vlog.VI(1).Infof("C-FIND-RSP: %s", elementsString(resp.Elements))
 		payload, err := writeElementsToBytes(resp.Elements, cs.context.transferSyntaxUID)
 		if err != nil {
@@ -141,7 +295,7 @@ func (cs *providerCommandState) handleCFind(c *dimse.C_FIND_RQ, data []byte) {
 		MessageIDBeingRespondedTo: c.MessageID,
 		CommandDataSetType:        dimse.CommandDataSetTypeNull,
 		Status:                    status}, nil)
-	// Drain the responses in case of errors
+	// Drain the responses in case of errors or cancellation.
 	for _ = range responseCh {
 	}
 }
@@ -164,25 +318,58 @@ func (cs *providerCommandState) handleCMove(c *dimse.C_MOVE_RQ, data []byte) {
 		}, nil)
 		return
 	}
-	remoteHostPort, ok := cs.parent.params.RemoteAEs[c.MoveDestination]
-	if !ok {
-		sendError(fmt.Errorf("C-MOVE destination '%v' not registered in the server", c.MoveDestination))
+	remoteHostPort, tlsConfig, err := cs.parent.params.resolveMoveDestination(c.MoveDestination)
+	if err != nil {
+		vlog.Errorf("C-MOVE: %v", err)
+		cs.sendMessage(&dimse.C_MOVE_RSP{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    dimse.Status{Status: dimse.CMoveMoveDestinationUnknown, ErrorComment: err.Error()},
+		}, nil)
 		return
 	}
-	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
+	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID, cs.parent.params.MaxSequenceDepth)
 	if err != nil {
 		sendError(err)
 		return
 	}
 	vlog.VI(1).Infof("C-MOVE-RQ payload: %s", elementsString(elems))
+	if _, err := validateQRLevel(c.AffectedSOPClassUID, elems); err != nil {
+		cs.sendMessage(&dimse.C_MOVE_RSP{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    dimse.Status{Status: dimse.CFindIdentifierDoesNotMatchSOPClass, ErrorComment: err.Error()},
+		}, nil)
+		return
+	}
 	responseCh := make(chan CMoveResult, 128)
 	go func() {
-		cs.parent.params.CMove(cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
+		cs.parent.params.CMove(CMoveRequest{
+			Info:              cs.parent.info,
+			TransferSyntaxUID: cs.context.transferSyntaxUID,
+			SOPClassUID:       c.AffectedSOPClassUID,
+			Filters:           elems,
+			Cancel:            cs.cancelCh,
+		}, responseCh)
 	}()
-	// responseCh :=
 	status := dimse.Status{Status: dimse.StatusSuccess}
 	var numSuccesses, numFailures uint16
-	for resp := range responseCh {
+loop:
+	for {
+		var resp CMoveResult
+		var ok bool
+		select {
+		case resp, ok = <-responseCh:
+		case <-cs.cancelCh:
+			vlog.VI(1).Infof("C-MOVE: cancelled")
+			status = dimse.Status{Status: dimse.StatusCancel}
+			break loop
+		}
+		if !ok {
+			break
+		}
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -191,7 +378,7 @@ func (cs *providerCommandState) handleCMove(c *dimse.C_MOVE_RQ, data []byte) {
 			break
 		}
 		vlog.Infof("C-MOVE: Sending %v to %v(%s)", resp.Path, c.MoveDestination, remoteHostPort)
-		err := runCStoreOnNewAssociation(cs.parent.params.AETitle, c.MoveDestination, remoteHostPort, resp.DataSet)
+		err := runCStoreOnNewAssociation(cs.parent.params.AETitle, c.MoveDestination, remoteHostPort, tlsConfig, resp.DataSet)
 		if err != nil {
 			vlog.Errorf("C-MOVE: C-store of %v to %v(%v) failed: %v", resp.Path, c.MoveDestination, remoteHostPort, err)
 			numFailures++
@@ -238,19 +425,47 @@ func (cs *providerCommandState) handleCGet(c *dimse.C_GET_RQ, data []byte) {
 		}, nil)
 		return
 	}
-	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
+	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID, cs.parent.params.MaxSequenceDepth)
 	if err != nil {
 		sendError(err)
 		return
 	}
 	vlog.VI(1).Infof("C-GET-RQ payload: %s", elementsString(elems))
+	if _, err := validateQRLevel(c.AffectedSOPClassUID, elems); err != nil {
+		cs.sendMessage(&dimse.C_GET_RSP{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    dimse.Status{Status: dimse.CFindIdentifierDoesNotMatchSOPClass, ErrorComment: err.Error()},
+		}, nil)
+		return
+	}
 	responseCh := make(chan CMoveResult, 128)
 	go func() {
-		cs.parent.params.CGet(cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
+		cs.parent.params.CGet(CMoveRequest{
+			Info:              cs.parent.info,
+			TransferSyntaxUID: cs.context.transferSyntaxUID,
+			SOPClassUID:       c.AffectedSOPClassUID,
+			Filters:           elems,
+			Cancel:            cs.cancelCh,
+		}, responseCh)
 	}()
 	status := dimse.Status{Status: dimse.StatusSuccess}
 	var numSuccesses, numFailures uint16
-	for resp := range responseCh {
+loop:
+	for {
+		var resp CMoveResult
+		var ok bool
+		select {
+		case resp, ok = <-responseCh:
+		case <-cs.cancelCh:
+			vlog.VI(1).Infof("C-GET: cancelled")
+			status = dimse.Status{Status: dimse.StatusCancel}
+			break loop
+		}
+		if !ok {
+			break
+		}
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -263,7 +478,7 @@ func (cs *providerCommandState) handleCGet(c *dimse.C_GET_RQ, data []byte) {
 		if found {
 			panic(subCs)
 		}
-		err := runCStoreOnAssociation(subCs.upcallCh, subCs.parent.downcallCh, subCs.cm, subCs.messageID, resp.DataSet)
+		err := runCStoreOnAssociation(subCs.upcallCh, subCs.parent.downcallCh, subCs.cm, subCs.messageID, 0, resp.DataSet, 0)
 		vlog.Infof("C-GET: Done sending %v using subcommand wl id:%d: %v", resp.Path, subCs.messageID, err)
 		defer cs.parent.deleteCommand(subCs)
 		if err != nil {
@@ -298,7 +513,7 @@ func (cs *providerCommandState) handleCGet(c *dimse.C_GET_RQ, data []byte) {
 func (cs *providerCommandState) handleCEcho(c *dimse.C_ECHO_RQ) {
 	status := dimse.Status{Status: dimse.StatusUnrecognizedOperation}
 	if cs.parent.params.CEcho != nil {
-		status = cs.parent.params.CEcho()
+		status = cs.parent.params.CEcho(CEchoRequest{Info: cs.parent.info})
 	}
 	vlog.Infof("Received E-ECHO: context: %+v", cs.context)
 	resp := &dimse.C_ECHO_RSP{
@@ -309,10 +524,47 @@ func (cs *providerCommandState) handleCEcho(c *dimse.C_ECHO_RQ) {
 	cs.sendMessage(resp, nil)
 }
 
+func (cs *providerCommandState) handleNGet(c *dimse.N_GET_RQ) {
+	resp := &dimse.N_GET_RSP{
+		AffectedSOPClassUID:       c.RequestedSOPClassUID,
+		MessageIDBeingRespondedTo: c.MessageID,
+		CommandDataSetType:        dimse.CommandDataSetTypeNull,
+		AffectedSOPInstanceUID:    c.RequestedSOPInstanceUID,
+		Status:                    dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: "No callback found for N-GET"},
+	}
+	if cs.parent.params.NGet == nil {
+		cs.sendMessage(resp, nil)
+		return
+	}
+	elems, status := cs.parent.params.NGet(NGetRequest{
+		Info:           cs.parent.info,
+		SOPClassUID:    c.RequestedSOPClassUID,
+		SOPInstanceUID: c.RequestedSOPInstanceUID,
+		Attributes:     c.AttributeIdentifierList,
+	})
+	resp.Status = status
+	var payload []byte
+	if !isFailureStatus(status) && len(elems) > 0 {
+		var err error
+		if payload, err = writeElementsToBytes(elems, cs.context.transferSyntaxUID); err != nil {
+			vlog.Errorf("N-GET: encode error %v", err)
+			resp.Status = dimse.Status{Status: dimse.StatusProcessingFailure, ErrorComment: err.Error()}
+			payload = nil
+		} else {
+			resp.CommandDataSetType = dimse.CommandDataSetTypeNonNull
+		}
+	}
+	cs.sendMessage(resp, payload)
+}
+
 func (cs *providerCommandState) sendMessage(resp dimse.Message, data []byte) {
 	vlog.VI(1).Infof("Sending PROVIDER message: %v %v", resp, cs.parent)
+	if status, ok := responseStatus(resp); ok && !status.IsPending() {
+		cs.finalStatus = &status
+	}
 	payload := &stateEventDIMSEPayload{
 		abstractSyntaxName: cs.context.abstractSyntaxUID,
+		contextID:          cs.context.contextID,
 		command:            resp,
 		data:               data,
 	}
@@ -332,6 +584,13 @@ type ServiceProviderParams struct {
 	// map should be nonempty iff the server supports CMove.
 	RemoteAEs map[string]string
 
+	// If non-nil, called to resolve the destination AE title of a C-MOVE
+	// request, instead of looking it up in RemoteAEs. It returns the
+	// host:port of the destination, and the TLS configuration for the
+	// connection, or nil for plain TCP. If it returns an error, the
+	// C-MOVE fails with status dimse.CMoveMoveDestinationUnknown.
+	ResolveMoveDestination func(destinationAE string) (addr string, tlsConfig *tls.Config, err error)
+
 	// Called on C_ECHO request. If nil, a C-ECHO call will produce an error response.
 	//
 	// TODO(saito) Support a default C-ECHO callback?
@@ -341,6 +600,10 @@ type ServiceProviderParams struct {
 	// If CFindCallback=nil, a C-FIND call will produce an error response.
 	CFind CFindCallback
 
+	// If non-nil, and CFind is nil, C-FIND requests are served by querying
+	// the backend.
+	QueryBackend QueryBackend
+
 	// CMove is called on C_MOVE request.
 	CMove CMoveCallback
 
@@ -352,73 +615,409 @@ type ServiceProviderParams struct {
 
 	// If CStoreCallback=nil, a C-STORE call will produce an error response.
 	CStore CStoreCallback
+
+	// Called on N-GET request, e.g., for sopclass.DisplaySystemClasses and
+	// sopclass.PrinterClasses. If nil, an N-GET call will produce an error
+	// response.
+	NGet NGetCallback
+
+	// Socket options for accepted connections.
+	TCPOptions TCPOptions
+
+	// If non-nil, called with the remote address of each connection right
+	// after it is accepted, e.g., to implement an IP allow-list. If it
+	// returns false, the connection is closed before the association
+	// negotiation starts, without sending A-ASSOCIATE-RJ. Per-AE checks,
+	// e.g., RateLimitPerAE, come later, during the negotiation.
+	AcceptConnection func(remoteAddr net.Addr) bool
+
+	// If non-nil, called with the calling AE title of each association
+	// request. If it returns non-nil, the association is rejected with the
+	// given codes, before the presentation contexts are negotiated.
+	// NewAERateLimiter creates a token-bucket implementation, which rejects
+	// the association as transient, with reason "temporary congestion", so
+	// that a well-behaved requestor retries later.
+	RateLimitPerAE func(callingAETitle string) *Rejection
+
+	// If non-nil, called for each association request that passes
+	// RateLimitPerAE, after the presentation contexts are negotiated.
+	// acceptedContexts is empty if none of the proposed contexts is
+	// acceptable. If it returns non-nil, the association is rejected with
+	// the given codes, e.g., permanent rejection by the service user with
+	// reason pdu.ReasonCallingAETitleNotRecognized for an unknown AE, or
+	// transient rejection for a temporary outage, so that the requestor
+	// retries later.
+	AcceptAssociation func(callingAETitle, calledAETitle string, acceptedContexts []PresentationContext) *Rejection
+
+	// Query/Retrieve features the provider supports. A feature is enabled
+	// for an association iff the requestor proposes it through SOP class
+	// extended negotiation and it is set here. The callbacks can find the
+	// outcome in AssociationInfo.QRExtendedNegotiation.
+	QRExtendedNegotiation QRExtendedNegotiation
+
+	// If non-nil, called during the association handshake to decide
+	// whether a transfer syntax proposed for a SOP class is acceptable,
+	// e.g., to refuse compressed syntaxes for structured reports while
+	// accepting them for images. The provider picks the first proposed
+	// syntax for which it returns true. If it returns false for all of
+	// them, Implicit VR Little Endian, the DICOM default that every AE must
+	// support (P3.5 10.1), is accepted if proposed. Otherwise the
+	// presentation context is rejected with "transfer syntaxes not
+	// supported". If nil, the first proposed syntax is accepted.
+	AcceptTransferSyntax func(sopClassUID, transferSyntaxUID string) bool
+
+	// If non-nil, called once an association is established, before any
+	// other callback for it. The context it returns, if non-nil, is passed
+	// to every later callback for the association in
+	// AssociationInfo.Context, e.g., to carry the tenant that the calling
+	// AE title resolves to, rather than resolve it on each C-STORE.
+	OnAssociationOpen func(info AssociationInfo) context.Context
+
+	// If non-nil, called for every DIMSE command received, including
+	// C-CANCEL, before it is dispatched to the callback for its type, e.g.,
+	// for audit logging, or per-operation authorization. If it returns an
+	// error, the command is not dispatched, and the request fails with
+	// status dimse.StatusNotAuthorized, with the error message as the error
+	// comment. A C-CANCEL that fails is ignored. It may run concurrently
+	// for the commands of an association.
+	OnDIMSECommand func(info AssociationInfo, cmd dimse.Message) error
+
+	// If non-nil, called when an association ends, either by release or
+	// abort, with a summary of the C-STOREs it carried. C-STOREs still
+	// running at that point may be missing from the summary.
+	OnAssociationClose func(info AssociationInfo, summary AssociationSummary)
+
+	// If true, a data PDV that arrives before the command of a DIMSE
+	// message, e.g., padding after the previous message, aborts the
+	// association. If false, such PDVs are discarded. Either way, a
+	// P_DATA_TF PDU may carry several messages.
+	StrictPDataTF bool
+
+	// The maximum nesting of sequences accepted in a DIMSE command, or in
+	// the identifier of a C-FIND, C-MOVE, or C-GET request. A request
+	// nested deeper fails before its elements are decoded. If zero,
+	// dimse.DefaultMaxSequenceDepth is used.
+	MaxSequenceDepth int
+
+	// If true, the A-ASSOCIATE-RQ received and the A-ASSOCIATE-AC or -RJ
+	// sent are logged, one presentation context and user information
+	// sub-item per line, with the UIDs spelled out.
+	LogNegotiation bool
+
+	// If non-nil, receives tracing spans for each association and DIMSE
+	// operation.
+	Tracer Tracer
+
+	// What to do with a C-STORE of a SOP instance that was already stored
+	// on the same association, e.g., by a sender that sends every image
+	// twice. Defaults to DuplicateInstanceStore.
+	DuplicateInstancePolicy DuplicateInstancePolicy
+
+	// If positive, the maximum total size of the DIMSE commands and
+	// datasets that the provider receives over an association. An
+	// association that sends more is aborted, and its summary reports the
+	// error. This bounds the cost of a runaway sender that keeps pushing
+	// instances.
+	MaxBytesPerAssociation int64
+
+	// Mints UIDs for the objects that the callbacks create, e.g., new SOP
+	// instances, or UIDs remapped by anonymization. The callbacks find it
+	// in AssociationInfo.UIDGenerator. If nil, a generator rooted at
+	// UUIDDerivedUIDRoot is used.
+	UIDGenerator UIDGenerator
+}
+
+// DuplicateInstancePolicy decides how a ServiceProvider handles a C-STORE
+// whose AffectedSOPInstanceUID was already stored on the same association.
+// An instance counts as stored once the CStore callback returns a non-failure
+// status for it. Duplicates across associations are not detected.
+type DuplicateInstancePolicy int
+
+const (
+	// Pass every C-STORE to the CStore callback.
+	DuplicateInstanceStore DuplicateInstancePolicy = iota
+	// Don't pass the duplicate to the callback, but report success, so
+	// that the sender carries on.
+	DuplicateInstanceIgnore
+	// Don't pass the duplicate to the callback, and respond with the warning
+	// status dimse.CStoreStatusDuplicateInstance.
+	DuplicateInstanceReject
+)
+
+// Find the address of the C-MOVE destination "ae", using ResolveMoveDestination
+// or RemoteAEs.
+func (params *ServiceProviderParams) resolveMoveDestination(ae string) (string, *tls.Config, error) {
+	if params.ResolveMoveDestination != nil {
+		return params.ResolveMoveDestination(ae)
+	}
+	addr, ok := params.RemoteAEs[ae]
+	if !ok {
+		return "", nil, fmt.Errorf("C-MOVE destination '%v' not registered in the server", ae)
+	}
+	return addr, nil, nil
+}
+
+// AssociationInfo describes an association established by a remote AE. It is
+// passed to the ServiceProvider callbacks.
+type AssociationInfo struct {
+	// AE title of the remote AE that initiated the association.
+	CallingAETitle string
+	// AE title of this server, as specified by the remote AE.
+	CalledAETitle string
+
+	// Per-association data set by ServiceProviderParams.OnAssociationOpen.
+	// It is context.Background() if OnAssociationOpen is nil or returns
+	// nil.
+	Context context.Context
+
+	// Scratch space that lives as long as the association. Every callback
+	// for the association, including OnAssociationClose, sees the same
+	// object. E.g., a CStore callback can group the received instances by
+	// study, and OnAssociationClose can commit each study in one batch.
+	Scratch *AssociationScratch
+
+	// Copied from ServiceProviderParams.UIDGenerator, or the default
+	// generator if it is nil.
+	UIDGenerator UIDGenerator
+
+	// Outcome of Query/Retrieve SOP class extended negotiation, keyed by
+	// SOP class UID.
+	qrExtendedNegotiation map[string]QRExtendedNegotiation
+
+	// SOP class common extended negotiation sent by the requestor, keyed
+	// by SOP class UID.
+	commonExtendedNegotiation map[string]CommonExtendedNegotiation
+}
+
+// Rejection holds the parameters of an A-ASSOCIATE-RJ PDU. See P3.8 9.3.4 for
+// the meaning of the codes, and the constants in the pdu package, e.g.,
+// pdu.ResultRejectedPermanent. ServiceProviderParams.AcceptAssociation and
+// RateLimitPerAE return it to reject an association, and ServiceUser methods
+// return it as an error when the provider rejects the association.
+type Rejection struct {
+	Result byte
+	Source byte
+	Reason byte
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("Association rejected by peer (result %d, source %d, reason %d)", r.Result, r.Source, r.Reason)
+}
+
+func newAssociationInfo(cm *contextManager) AssociationInfo {
+	return AssociationInfo{
+		CallingAETitle:            cm.callingAETitle,
+		CalledAETitle:             cm.calledAETitle,
+		Context:                   context.Background(),
+		Scratch:                   &AssociationScratch{},
+		qrExtendedNegotiation:     cm.qrExtendedNegotiation,
+		commonExtendedNegotiation: cm.commonExtendedNegotiation,
+	}
+}
+
+// AssociationScratch is a key-value store for the callbacks of one
+// association. Keys are compared as map keys. The callbacks for an
+// association may run concurrently, so AssociationScratch is thread safe.
+type AssociationScratch struct {
+	mu     sync.Mutex
+	values map[interface{}]interface{}
+}
+
+// Get returns the value for "key", or nil if none is set.
+func (s *AssociationScratch) Get(key interface{}) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+// Set sets the value for "key".
+func (s *AssociationScratch) Set(key, value interface{}) {
+	s.Update(key, func(interface{}) interface{} { return value })
+}
+
+// Update replaces the value for "key", nil if none is set, with f(value). It
+// is atomic with respect to other calls on "s", so concurrent callbacks can,
+// e.g., append to a list without losing elements. f must not call methods of
+// "s".
+func (s *AssociationScratch) Update(key interface{}, f func(value interface{}) interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[interface{}]interface{})
+	}
+	s.values[key] = f(s.values[key])
+}
+
+// QRExtendedNegotiation returns the Query/Retrieve features negotiated for the
+// given SOP class.  E.g., a CMove callback should perform relational
+// retrieval only when QRExtendedNegotiation(sopClassUID).Relational is true.
+func (info AssociationInfo) QRExtendedNegotiation(sopClassUID string) QRExtendedNegotiation {
+	return info.qrExtendedNegotiation[sopClassUID]
+}
+
+// CommonExtendedNegotiation returns the service class and the related general
+// SOP classes that the requestor sent for the given SOP class through SOP class
+// common extended negotiation. Returns false if it sent none.
+func (info AssociationInfo) CommonExtendedNegotiation(sopClassUID string) (CommonExtendedNegotiation, bool) {
+	n, ok := info.commonExtendedNegotiation[sopClassUID]
+	return n, ok
 }
 
 const DefaultMaxPDUSize = 4 << 20
 
-// CStoreCallback is called C-STORE request.  sopInstanceUID are the IDs of the
-// data.  sopClassUID is the data type requested
-// (e.g.,"1.2.840.10008.5.1.4.1.1.1.2"), and transferSyntaxUID is the data
-// encoding requested (e.g., "1.2.840.10008.1.2.1").  These args come from the
-// request packat.
+// CStoreRequest holds the arguments of CStoreCallback.
+type CStoreRequest struct {
+	// Info describes the association the request arrived on.
+	Info AssociationInfo
+	// TransferSyntaxUID is the data encoding, e.g., "1.2.840.10008.1.2.1".
+	TransferSyntaxUID string
+	// SOPClassUID is the data type, e.g., "1.2.840.10008.5.1.4.1.1.1.2".
+	SOPClassUID string
+	// SOPInstanceUID is the ID of the data.
+	SOPInstanceUID string
+	// Data is the payload. See CStoreCallback.
+	Data []byte
+}
+
+// CStoreCallback is called C-STORE request. The fields of "req" other than
+// Data come from the request packat, and the negotiated presentation context.
 //
-// "data" is the payload, i.e., a sequence of serialized
-// dicom.DataElement objects.  Note that "data" usually does not contain
+// req.Data is the payload, i.e., a sequence of serialized
+// dicom.DataElement objects.  Note that it usually does not contain
 // metadata elements (elements whose tag.group=2 -- those include
 // TransferSyntaxUID and MediaStorageSOPClassUID), since they are
 // stripped by the requstor (two key metadata are passed as
-// sop{Class,Instance)UID).
+// SOP{Class,Instance}UID).
+//
+// Data that is obviously encoded in another syntax than the negotiated one
+// (see CheckDataSetEncoding) is rejected with CStoreStatusCannotUnderstand,
+// and the callback isn't called. Otherwise, req.Data is exactly the
+// concatenation of the data PDVs received from the peer. The library never
+// transcodes it, and req.TransferSyntaxUID is the syntax negotiated for the
+// presentation context the data arrived on, so data is encoded in that syntax
+// byte-for-byte as the requestor sent it. Writing a file header that records
+// req.TransferSyntaxUID, followed by req.Data, therefore produces a lossless
+// copy that can later be retransmitted verbatim over a context with the same
+// transfer syntax. ParseTransferSyntax tells whether the syntax is explicit VR,
+// its byte order, and so on.
 //
-// The handler should store encode the sop{Class,InstanceUID} as the
-//DICOM header, followed by data. It should return either 0 on success,
-//or one of CStoreStatus* error codes.
-type CStoreCallback func(
-	transferSyntaxUID string,
-	sopClassUID string,
-	sopInstanceUID string,
-	data []byte) dimse.Status
-
-// CFindCallback implements a C-FIND handler.  sopClassUID is the data type
-// requested (e.g.,"1.2.840.10008.5.1.4.1.1.1.2"), and transferSyntaxUID is the
-// data encoding requested (e.g., "1.2.840.10008.1.2.1").  hese args come from
-// the request packat.
+// The handler should store encode the SOP{Class,InstanceUID} as the
+// DICOM header, followed by data. It should return either 0 on success,
+// or one of CStoreStatus* error codes.
+type CStoreCallback func(req CStoreRequest) dimse.Status
+
+// CFindRequest holds the arguments of CFindCallback.
+type CFindRequest struct {
+	// Info describes the association the request arrived on.
+	Info AssociationInfo
+	// TransferSyntaxUID is the data encoding, e.g., "1.2.840.10008.1.2.1".
+	TransferSyntaxUID string
+	// SOPClassUID is the data type, e.g., "1.2.840.10008.5.1.4.1.2.2.1".
+	SOPClassUID string
+	// QRLevel is the QueryRetrieveLevel of the request, e.g., "SERIES",
+	// without padding, or "" if the request lacks one.
+	QRLevel string
+	// Filters is the identifier of the request.
+	Filters []*dicom.Element
+	// Cancel is closed when the requestor cancels the query. See
+	// CFindCallback.
+	Cancel <-chan struct{}
+}
+
+// CFindCallback implements a C-FIND handler. The fields of "req" come from
+// the request packat. For the Query/Retrieve SOP classes, the provider has
+// checked that req.QRLevel is valid for the information model, and that a
+// hierarchical query specifies the unique keys of the levels above it, e.g.,
+// StudyInstanceUID for a Study Root SERIES query. The callback should return
+// the attributes of the entities at req.QRLevel.
 //
 // This function stream CFindResult objects through "ch". The function may
 // block.  To report a matched DICOM dataset, the callback should send one
 // CFindResult with nonempty Element field. To report multiple DICOM-dataset
 // matches, the callback should send multiple CFindResult objects, one for each
 // dataset.  The callback must close the channel after it produces all the
-// responses.
-type CFindCallback func(
-	transferSyntaxUID string,
-	sopClassUID string,
-	filters []*dicom.Element,
-	ch chan CFindResult)
-
-// CMoveCallback implements C-MOVE or C-GET handler.  sopClassUID is the data
-// type requested (e.g.,"1.2.840.10008.5.1.4.1.1.1.2"), and transferSyntaxUID is
-// the data encoding requested (e.g., "1.2.840.10008.1.2.1").  hese args come
-// from the request packat.
+// responses. A result with neither Err nor Elements set is treated as an error:
+// the request fails with status CFindUnableToProcess.
+//
+// req.Cancel is closed when the requestor cancels the query with
+// C-CANCEL-FIND-RQ, e.g., when a modality has found its worklist entry, or
+// when the ServiceProvider shuts down. The callback should then stop producing
+// results and close the channel promptly. Results sent after the cancellation
+// are discarded, and the final response carries status dimse.StatusCancel.
+type CFindCallback func(req CFindRequest, ch chan CFindResult)
+
+// CMoveRequest holds the arguments of CMoveCallback.
+type CMoveRequest struct {
+	// Info describes the association the request arrived on.
+	Info AssociationInfo
+	// TransferSyntaxUID is the data encoding, e.g., "1.2.840.10008.1.2.1".
+	TransferSyntaxUID string
+	// SOPClassUID is the data type, e.g., "1.2.840.10008.5.1.4.1.2.2.2".
+	SOPClassUID string
+	// Filters is the identifier of the request.
+	Filters []*dicom.Element
+	// Cancel is closed when the requestor cancels the retrieval. See
+	// CMoveCallback.
+	Cancel <-chan struct{}
+}
+
+// CMoveCallback implements C-MOVE or C-GET handler. The fields of "req" come
+// from the request packat. The callback should perform relational retrieval
+// only if req.Info.QRExtendedNegotiation(req.SOPClassUID).Relational is set.
 //
 // The callback must stream datasets or error to "ch". The callback may
 // block. The callback must close the channel after it produces all the
 // datasets.
-type CMoveCallback func(
-	transferSyntaxUID string,
-	sopClassUID string,
-	filters []*dicom.Element,
-	ch chan CMoveResult)
+//
+// req.Cancel is closed when the requestor sends C-CANCEL, or the
+// ServiceProvider shuts down. The callback should then stop and close the
+// channel promptly.
+type CMoveCallback func(req CMoveRequest, ch chan CMoveResult)
+
+// NGetRequest holds the arguments of NGetCallback.
+type NGetRequest struct {
+	// Info describes the association the request arrived on.
+	Info AssociationInfo
+	// SOPClassUID is the class of the requested SOP instance.
+	SOPClassUID string
+	// SOPInstanceUID is the requested SOP instance, e.g.,
+	// sopclass.PrinterSOPInstance.
+	SOPInstanceUID string
+	// Attributes lists the attributes requested. If it is empty, all of
+	// them are requested.
+	Attributes []dicom.Tag
+}
+
+// NGetCallback implements an N-GET handler. It returns the attributes of the
+// SOP instance req.SOPInstanceUID of class req.SOPClassUID, e.g., the printer
+// status of sopclass.PrinterSOPInstance. The elements are sent back only if
+// the status is not a failure.
+type NGetCallback func(req NGetRequest) ([]*dicom.Element, dimse.Status)
+
+// CEchoRequest holds the arguments of CEchoCallback.
+type CEchoRequest struct {
+	// Info describes the association the request arrived on.
+	Info AssociationInfo
+}
 
 // CEchoCallback implements C-ECHO callback. It typically just returns
 // dimse.Success.
-type CEchoCallback func() dimse.Status
+type CEchoCallback func(req CEchoRequest) dimse.Status
 
 // ServiceProvider encapsulates the state for DICOM server (provider).
 type ServiceProvider struct {
 	params   ServiceProviderParams
 	listener net.Listener
+
+	shutdownCh   chan struct{} // Closed by Shutdown.
+	shutdownOnce sync.Once
+
+	numAssociations int32 // Number of associations being served. Atomic.
 }
 
+// How often Shutdown checks whether the associations have ended.
+const shutdownPollInterval = 10 * time.Millisecond
+
 func writeElementsToBytes(elems []*dicom.Element, transferSyntaxUID string) ([]byte, error) {
 	dataEncoder := dicomio.NewBytesEncoderWithTransferSyntax(transferSyntaxUID)
 	for _, elem := range elems {
@@ -430,7 +1029,12 @@ func writeElementsToBytes(elems []*dicom.Element, transferSyntaxUID string) ([]b
 	return dataEncoder.Bytes(), nil
 }
 
-func readElementsInBytes(data []byte, transferSyntaxUID string) ([]*dicom.Element, error) {
+// Decode the dataset in "data". It fails if the dataset has sequences nested
+// deeper than maxDepth, see dimse.CheckSequenceDepth.
+func readElementsInBytes(data []byte, transferSyntaxUID string, maxDepth int) ([]*dicom.Element, error) {
+	if err := dimse.CheckSequenceDepth(data, transferSyntaxUID, maxDepth); err != nil {
+		return nil, err
+	}
 	decoder := dicomio.NewBytesDecoderWithTransferSyntax(data, transferSyntaxUID)
 	var elems []*dicom.Element
 	for decoder.Len() > 0 {
@@ -458,15 +1062,26 @@ func elementsString(elems []*dicom.Element) string {
 	return s + "]"
 }
 
-// Send "ds" to remoteHostPort using C-STORE. Called as part of C-MOVE.
-func runCStoreOnNewAssociation(myAETitle, remoteAETitle, remoteHostPort string, ds *dicom.DataSet) error {
+// Send "ds" to remoteHostPort using C-STORE. Called as part of C-MOVE. If
+// tlsConfig is non-nil, the connection uses TLS.
+func runCStoreOnNewAssociation(myAETitle, remoteAETitle, remoteHostPort string, tlsConfig *tls.Config, ds *dicom.DataSet) error {
 	params, err := NewServiceUserParams(remoteAETitle, myAETitle, sopclass.StorageClasses, nil)
 	if err != nil {
 		return err
 	}
+	var conn net.Conn
+	if tlsConfig != nil {
+		if conn, err = tls.Dial("tcp", remoteHostPort, tlsConfig); err != nil {
+			return err
+		}
+	}
 	su := NewServiceUser(params)
 	defer su.Release()
-	su.Connect(remoteHostPort)
+	if conn != nil {
+		su.SetConn(conn)
+	} else {
+		su.Connect(remoteHostPort)
+	}
 	err = su.CStore(ds)
 	vlog.VI(1).Infof("C-STORE subop done: %v", err)
 	return err
@@ -479,8 +1094,21 @@ func (dh *providerCommandDispatcher) handleEvent(event upcallEvent) {
 		dh.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
 		return
 	}
+	if c, ok := event.command.(*dimse.C_CANCEL_RQ); ok {
+		if err := dh.checkDIMSECommand(c); err == nil {
+			dh.cancelCommand(c)
+		}
+		return
+	}
 	messageID := event.command.GetMessageID()
 	dc, found := dh.findOrCreateCommand(messageID, event.cm, context)
+	operation := ""
+	if !found {
+		operation = dimseServiceName(event.command)
+	}
+	dh.mu.Lock()
+	dh.summary.addMessage(operation, len(event.data))
+	dh.mu.Unlock()
 	if found {
 		vlog.VI(1).Infof("Forwarding command to existing command: %+v", event.command, dc)
 		dc.upcallCh <- event
@@ -489,6 +1117,41 @@ func (dh *providerCommandDispatcher) handleEvent(event upcallEvent) {
 	}
 	go func() {
 		defer dh.deleteCommand(dc)
+		if dh.shutdownCh != nil {
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-dh.shutdownCh:
+					dh.mu.Lock()
+					dc.cancelLocked()
+					dh.mu.Unlock()
+				case <-done:
+				}
+			}()
+		}
+		span := dh.tracer.StartSpan(dh.span, dimseServiceName(event.command),
+			operationSpanAttrs(context.abstractSyntaxUID, messageID))
+		defer func() {
+			var attrs map[string]string
+			var err error
+			if dc.finalStatus != nil {
+				attrs = statusSpanAttrs(*dc.finalStatus)
+				if isFailureStatus(*dc.finalStatus) {
+					err = fmt.Errorf("%s failed: %v", dimseServiceName(event.command), *dc.finalStatus)
+				}
+			}
+			dh.tracer.EndSpan(span, attrs, err)
+		}()
+		if err := dh.checkDIMSECommand(event.command); err != nil {
+			if resp := failureResponse(event.command, dimse.Status{
+				Status:       dimse.StatusNotAuthorized,
+				ErrorComment: err.Error(),
+			}); resp != nil {
+				dc.sendMessage(resp, nil)
+			}
+			return
+		}
 		switch c := event.command.(type) {
 		case *dimse.C_STORE_RQ:
 			dc.handleCStore(c, event.data)
@@ -500,6 +1163,8 @@ func (dh *providerCommandDispatcher) handleEvent(event upcallEvent) {
 			dc.handleCGet(c, event.data)
 		case *dimse.C_ECHO_RQ:
 			dc.handleCEcho(c)
+		case *dimse.N_GET_RQ:
+			dc.handleNGet(c)
 		default:
 			// TODO: handle errors properly.
 			vlog.Fatalf("Unknown PROVIDER message type: %v", c)
@@ -507,12 +1172,75 @@ func (dh *providerCommandDispatcher) handleEvent(event upcallEvent) {
 	}()
 }
 
+// Run params.OnDIMSECommand, if any, on a command received.
+func (dh *providerCommandDispatcher) checkDIMSECommand(cmd dimse.Message) error {
+	if dh.params.OnDIMSECommand == nil {
+		return nil
+	}
+	err := dh.params.OnDIMSECommand(dh.info, cmd)
+	if err != nil {
+		vlog.Infof("Provider: rejecting %v from %v: %v", cmd, dh.info.CallingAETitle, err)
+	}
+	return err
+}
+
+// Create the final response to request "c" with the given failure status. It
+// returns nil if "c" isn't a request that the provider serves.
+func failureResponse(c dimse.Message, status dimse.Status) dimse.Message {
+	switch c := c.(type) {
+	case *dimse.C_STORE_RQ:
+		return &dimse.C_STORE_RSP{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			AffectedSOPInstanceUID:    c.AffectedSOPInstanceUID,
+			Status:                    status,
+		}
+	case *dimse.C_FIND_RQ:
+		return &dimse.C_FIND_RSP{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}
+	case *dimse.C_MOVE_RQ:
+		return &dimse.C_MOVE_RSP{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}
+	case *dimse.C_GET_RQ:
+		return &dimse.C_GET_RSP{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}
+	case *dimse.C_ECHO_RQ:
+		return &dimse.C_ECHO_RSP{
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}
+	case *dimse.N_GET_RQ:
+		return &dimse.N_GET_RSP{
+			AffectedSOPClassUID:       c.RequestedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			AffectedSOPInstanceUID:    c.RequestedSOPInstanceUID,
+			Status:                    status,
+		}
+	}
+	return nil
+}
+
 // NewServiceProvider creates a new DICOM server object.  "listenAddr" is the
 // TCP address to listen to. E.g., ":1234" will listen to port 1234 at all the
 // IP address that this machine can bind to.  Run() will actually start running
 // the service.
 func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProvider, error) {
-	sp := &ServiceProvider{params: params}
+	sp := &ServiceProvider{params: params, shutdownCh: make(chan struct{})}
 	var err error
 	sp.listener, err = net.Listen("tcp", port)
 	if err != nil {
@@ -521,22 +1249,69 @@ func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProv
 	return sp, nil
 }
 
-// RunProviderForConn starts threads for running a DICOM server on "conn". This
-// function returns immediately; "conn" will be cleaned up in the background.
-func RunProviderForConn(conn net.Conn, params ServiceProviderParams) {
+// RunProviderForConn runs a DICOM server on "conn". It blocks until the
+// association ends, and closes "conn". It returns the summary of the
+// association, also passed to ServiceProviderParams.OnAssociationClose. If the
+// handshake didn't complete, the summary has only Err set, if any. Like Run,
+// it consults ServiceProviderParams.AcceptConnection first.
+func RunProviderForConn(conn net.Conn, params ServiceProviderParams) AssociationSummary {
+	return runProviderForConn(conn, params, nil)
+}
+
+func runProviderForConn(conn net.Conn, params ServiceProviderParams, shutdownCh <-chan struct{}) AssociationSummary {
+	if params.AcceptConnection != nil && !params.AcceptConnection(conn.RemoteAddr()) {
+		vlog.Infof("Provider: rejecting connection from %v", conn.RemoteAddr())
+		conn.Close()
+		return AssociationSummary{Err: fmt.Errorf("Connection from %v rejected", conn.RemoteAddr())}
+	}
+	if err := applyTCPOptions(conn, params.TCPOptions); err != nil {
+		vlog.Errorf("Failed to set TCP options %+v on %v: %v", params.TCPOptions, conn.RemoteAddr(), err)
+	}
 	upcallCh := make(chan upcallEvent, 128)
 	dc := providerCommandDispatcher{
 		downcallCh:     make(chan stateEvent, 128),
 		params:         params,
+		tracer:         tracerOrNoop(params.Tracer),
+		shutdownCh:     shutdownCh,
 		activeCommands: make(map[uint16]*providerCommandState),
 	}
 
-	go runStateMachineForServiceProvider(conn, upcallCh, dc.downcallCh)
+	go runStateMachineForServiceProvider(conn, params, upcallCh, dc.downcallCh)
 	handshakeCompleted := false
 	for event := range upcallCh {
 		if event.eventType == upcallEventHandshakeCompleted {
 			doassert(!handshakeCompleted)
 			handshakeCompleted = true
+			dc.info = newAssociationInfo(event.cm)
+			dc.info.UIDGenerator = params.UIDGenerator
+			if dc.info.UIDGenerator == nil {
+				dc.info.UIDGenerator = defaultUIDGenerator
+			}
+			if params.OnAssociationOpen != nil {
+				if ctx := params.OnAssociationOpen(dc.info); ctx != nil {
+					dc.info.Context = ctx
+				}
+			}
+			dc.span = dc.tracer.StartSpan(nil, "association",
+				associationSpanAttrs(dc.info.CallingAETitle, dc.info.CalledAETitle))
+			dc.mu.Lock()
+			dc.summary.CallingAETitle = dc.info.CallingAETitle
+			dc.summary.CalledAETitle = dc.info.CalledAETitle
+			dc.summary.AcceptedContexts = event.cm.acceptedContexts()
+			dc.summary.Start = time.Now()
+			dc.mu.Unlock()
+			continue
+		}
+		if event.eventType == upcallEventAbort {
+			vlog.Infof("Provider: %v", event.err)
+			dc.mu.Lock()
+			dc.summary.Err = event.err
+			dc.mu.Unlock()
+			continue
+		}
+		if event.eventType == upcallEventDropped {
+			// A response to a request that was already handled. There
+			// is no operation left to fail.
 			continue
 		}
 		doassert(event.eventType == upcallEventData)
@@ -544,22 +1319,68 @@ func RunProviderForConn(conn net.Conn, params ServiceProviderParams) {
 		doassert(handshakeCompleted == true)
 		dc.handleEvent(event)
 	}
+	dc.mu.Lock()
+	summary := dc.summary
+	dc.mu.Unlock()
+	if handshakeCompleted {
+		summary.End = time.Now()
+		vlog.Infof("Provider: %v", summary)
+		if params.OnAssociationClose != nil {
+			params.OnAssociationClose(dc.info, summary)
+		}
+		dc.tracer.EndSpan(dc.span, nil, summary.Err)
+	}
 	vlog.VI(2).Info("Finished provider")
+	return summary
 }
 
 // Run listens to incoming connections, accepts them, and runs the DICOM
-// protocol. This function never returns.
+// protocol. This function returns only after Shutdown is called.
 func (sp *ServiceProvider) Run() {
 	for {
 		conn, err := sp.listener.Accept()
 		if err != nil {
+			select {
+			case <-sp.shutdownCh:
+				return
+			default:
+			}
 			vlog.Errorf("Accept error: %v", err)
 			continue
 		}
-		go func() { RunProviderForConn(conn, sp.params) }()
+		atomic.AddInt32(&sp.numAssociations, 1)
+		go func() {
+			defer atomic.AddInt32(&sp.numAssociations, -1)
+			runProviderForConn(conn, sp.params, sp.shutdownCh)
+		}()
 	}
 }
 
+// Shutdown stops accepting new associations, and makes Run return. The CFind,
+// CMove, and CGet callbacks still running are told to stop through the
+// Cancel channels of their requests, and their operations end with status
+// dimse.StatusCancel. Shutdown then waits for the peers to release the
+// associations already established. If ctx is done first, Shutdown returns
+// ctx.Err(), and the associations stay open until the peers release them.
+// Calling Shutdown more than once is harmless.
+func (sp *ServiceProvider) Shutdown(ctx context.Context) error {
+	var err error
+	sp.shutdownOnce.Do(func() {
+		close(sp.shutdownCh)
+		err = sp.listener.Close()
+	})
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&sp.numAssociations) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return err
+}
+
 // Return the TCP address that the server is listening on. It is the address
 // passed to the NewServiceProvider(), except that if value was of form
 // <name>:0, the ":0" part is replaced by the actual port numwber.
@@ -0,0 +1,69 @@
+package netdicom
+
+import (
+	"testing"
+
+	"github.com/yasushi-saito/go-dicom"
+	"github.com/yasushi-saito/go-dicom/dicomio"
+	"github.com/yasushi-saito/go-dicom/dicomuid"
+	"github.com/yasushi-saito/go-netdicom/dimse"
+)
+
+const ctImageStorage = "1.2.840.10008.5.1.4.1.1.2"
+
+// Send a C-STORE request to cs and return the status of its response.
+func runCStore(cs *providerCommandState, sopInstanceUID string, data []byte) dimse.Status {
+	cs.handleCStore(&dimse.C_STORE_RQ{
+		AffectedSOPClassUID:    ctImageStorage,
+		MessageID:              cs.messageID,
+		AffectedSOPInstanceUID: sopInstanceUID,
+	}, data)
+	event := <-cs.parent.downcallCh
+	return event.dimsePayload.command.(*dimse.C_STORE_RSP).Status
+}
+
+// An instance rejected for its encoding must not count as stored, so that
+// the requestor can resend it correctly encoded.
+func TestCStoreResendAfterEncodingFailure(t *testing.T) {
+	e := dicomio.NewBytesEncoderWithTransferSyntax(dicomuid.ExplicitVRLittleEndian)
+	dicom.WriteElement(e, dicom.MustNewElement(dicom.TagSOPClassUID, ctImageStorage))
+	if err := e.Error(); err != nil {
+		t.Fatal(err)
+	}
+	explicit := e.Bytes()
+	// SOPClassUID (0008,0016) in Implicit VR Little Endian.
+	implicit := append([]byte{0x08, 0x00, 0x16, 0x00, 0x1a, 0x00, 0x00, 0x00},
+		[]byte("1.2.840.10008.5.1.4.1.1.2\x00")...)
+
+	for _, policy := range []DuplicateInstancePolicy{DuplicateInstanceIgnore, DuplicateInstanceReject} {
+		nStored := 0
+		dc := &providerCommandDispatcher{
+			downcallCh: make(chan stateEvent, 1),
+			params: ServiceProviderParams{
+				CStore: func(req CStoreRequest) dimse.Status {
+					nStored++
+					return dimse.Success
+				},
+				DuplicateInstancePolicy: policy,
+			},
+		}
+		cs := &providerCommandState{
+			parent:    dc,
+			messageID: 1,
+			context: contextManagerEntry{
+				contextID:         1,
+				abstractSyntaxUID: ctImageStorage,
+				transferSyntaxUID: dicomuid.ExplicitVRLittleEndian,
+			},
+		}
+		if status := runCStore(cs, "1.2.3", implicit); status.Status != dimse.CStoreStatusCannotUnderstand {
+			t.Errorf("Policy %v: misencoded data got status %v", policy, status)
+		}
+		if status := runCStore(cs, "1.2.3", explicit); status.Status != dimse.StatusSuccess {
+			t.Errorf("Policy %v: resent data got status %v", policy, status)
+		}
+		if nStored != 1 {
+			t.Errorf("Policy %v: the callback stored %d instances, expect 1", policy, nStored)
+		}
+	}
+}
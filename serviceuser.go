@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/yasushi-saito/go-dicom"
 	"github.com/yasushi-saito/go-dicom/dicomio"
@@ -43,50 +44,127 @@ const (
 // methods concurrently - say two CStore requests - from two goroutines.  You
 // must wait for one CStore to finish before issuing another one.
 type ServiceUser struct {
+	params     ServiceUserParams
 	downcallCh chan stateEvent
 	upcallCh   chan upcallEvent
+	tracer     Tracer
 
-	mu   *sync.Mutex
-	cond *sync.Cond // Broadcast when status changes.
+	mu          *sync.Mutex
+	cond        *sync.Cond // Broadcast when status changes.
+	releaseOnce sync.Once
 
 	// Following fields are guarded by mu.
 	status         serviceUserStatus
 	cm             *contextManager              // Set only after the handshake completes.
 	activeCommands map[uint16]*userCommandState // List of commands running
+	abortErr       error                        // Set when the peer sends A-ABORT.
+	released       bool                         // Set when Release is called.
+	onCGetInstance CGetInstanceCallback         // Set while CGet runs.
+	span           Span                         // Tracing span of the association.
 }
 
-func (su *ServiceUser) createCommand(messageID uint16) *userCommandState {
+// AbortError is returned by ServiceUser methods when the peer aborts the
+// association, by sending an A-ABORT PDU, while the operation is in progress.
+type AbortError struct {
+	// Source and Reason are copied from the A-ABORT PDU. See P3.8 9.3.8.
+	Source byte
+	Reason byte
+}
+
+func (e *AbortError) Error() string {
+	return fmt.Sprintf("Association aborted by peer (source %d, reason %d)", e.Source, e.Reason)
+}
+
+func (su *ServiceUser) newMessageID() uint16 {
+	if su.params.MessageIDGenerator != nil {
+		return su.params.MessageIDGenerator()
+	}
+	return dimse.NewMessageID()
+}
+
+// Register a new request. qrSOPClassUID is the SOP class of a C-FIND, C-MOVE,
+// or C-GET request, which can be cancelled. It is "" for other requests.
+func (su *ServiceUser) createCommand(messageID uint16, qrSOPClassUID string) *userCommandState {
 	su.mu.Lock()
 	defer su.mu.Unlock()
 	if _, ok := su.activeCommands[messageID]; ok {
 		panic(messageID)
 	}
 	cs := &userCommandState{
-		parent:    su,
-		messageID: messageID,
-		upcallCh:  make(chan upcallEvent, 128),
+		parent:        su,
+		messageID:     messageID,
+		upcallCh:      make(chan upcallEvent, 128),
+		qrSOPClassUID: qrSOPClassUID,
+		cancelCh:      make(chan struct{}),
+		doneCh:        make(chan struct{}),
 	}
 	su.activeCommands[messageID] = cs
 	return cs
 }
 
-func (su *ServiceUser) findCommand(messageID uint16) *userCommandState {
+func (su *ServiceUser) deleteCommand(cs *userCommandState) {
 	su.mu.Lock()
 	defer su.mu.Unlock()
-	if cs, ok := su.activeCommands[messageID]; ok {
-		return cs
+	if _, ok := su.activeCommands[cs.messageID]; !ok {
+		// Already closed by closeCommands.
+		return
 	}
-	return nil
+	delete(su.activeCommands, cs.messageID)
+	cs.close()
 }
 
-func (su *ServiceUser) deleteCommand(cs *userCommandState) {
+// Close the upcall channels of all the running commands, so that they stop
+// waiting for a response.
+//
+// REQUIRES: su.mu is held.
+func (su *ServiceUser) closeCommands() {
+	for messageID, cs := range su.activeCommands {
+		cs.close()
+		delete(su.activeCommands, messageID)
+	}
+}
+
+// Fail the command that sent "msg", a request that was not sent, with "err".
+// Its upcall channel is closed, so that it stops waiting for a response.
+func (su *ServiceUser) failCommand(msg dimse.Message, err error) {
+	if _, ok := responseStatus(msg); ok {
+		// A response to a C-STORE sub-operation of C-GET. The C-GET
+		// itself fails when the association closes.
+		return
+	}
 	su.mu.Lock()
-	if _, ok := su.activeCommands[cs.messageID]; !ok {
-		panic(fmt.Sprintf("cs %+v", cs))
+	defer su.mu.Unlock()
+	cs, ok := su.activeCommands[msg.GetMessageID()]
+	if !ok {
+		return
 	}
+	cs.err = err
 	delete(su.activeCommands, cs.messageID)
+	cs.close()
+}
+
+// Create an error to be reported when the upcall channel of "cs" closes while
+// waiting for a response. It returns the error that failed cs, if any, or an
+// AbortError if the closure is due to A-ABORT.
+func (su *ServiceUser) closedError(cs *userCommandState, format string, args ...interface{}) error {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	if cs.err != nil {
+		return cs.err
+	}
+	if su.abortErr != nil {
+		return su.abortErr
+	}
+	return fmt.Errorf(format, args...)
+}
+
+// Start a tracing span for a DIMSE operation. The returned function ends it.
+func (su *ServiceUser) startOperationSpan(name, sopClassUID string, messageID uint16) func(err error) {
+	su.mu.Lock()
+	parent := su.span
 	su.mu.Unlock()
-	close(cs.upcallCh)
+	span := su.tracer.StartSpan(parent, name, operationSpanAttrs(sopClassUID, messageID))
+	return func(err error) { su.tracer.EndSpan(span, nil, err) }
 }
 
 // Per-command-invocation state.
@@ -97,6 +175,34 @@ type userCommandState struct {
 
 	// upcallCh streams PROVIDER command+data for the given messageID.
 	upcallCh chan upcallEvent
+
+	// SOP class of a C-FIND, C-MOVE, or C-GET request. "" for other
+	// requests, which can't be cancelled.
+	qrSOPClassUID string
+
+	// Closed by CancelOperation. Guarded by parent.mu.
+	cancelCh  chan struct{}
+	cancelled bool
+
+	// Closed when the command is deleted, to stop handleEvent from waiting
+	// for the command to read upcallCh. Guarded by parent.mu.
+	doneCh chan struct{}
+	// Counts handleEvent calls that are sending to upcallCh.
+	senders sync.WaitGroup
+
+	// Set when the command fails before its response arrives, e.g., with
+	// ErrReleased if its request was dropped. Guarded by parent.mu.
+	err error
+}
+
+// Close the upcall channel, once handleEvent has stopped sending to it.
+//
+// REQUIRES: parent.mu is held, and cs has been removed from
+// parent.activeCommands.
+func (cs *userCommandState) close() {
+	close(cs.doneCh)
+	cs.senders.Wait()
+	close(cs.upcallCh)
 }
 
 type ServiceUserParams struct {
@@ -114,7 +220,89 @@ type ServiceUserParams struct {
 	// TODO(saito) Support reencoding internally on C_STORE, etc. The DICOM
 	// spec is particularly moronic here, since we could just have specified
 	// the transfer syntax per data sent.
+	//
+	// Implicit VR Little Endian, the DICOM default (P3.5 10.1), is proposed
+	// last if missing, so that a provider that supports nothing else can
+	// still accept the contexts. It doesn't apply to
+	// ExtraPresentationContexts.
 	SupportedTransferSyntaxes []string
+
+	// Socket options for the connection made by Connect or passed to
+	// SetConn.
+	TCPOptions TCPOptions
+
+	// Query/Retrieve features to propose through SOP class extended
+	// negotiation, for the Query/Retrieve classes in RequiredServices. The
+	// provider may accept only a subset of them.
+	QRExtendedNegotiation QRExtendedNegotiation
+
+	// SOP class common extended negotiation to send, keyed by SOP class
+	// UID. An entry is sent only if its SOP class is proposed. Some
+	// providers need it to accept a SOP class they don't know, e.g., a
+	// private storage class.
+	CommonExtendedNegotiation map[string]CommonExtendedNegotiation
+
+	// If non-nil, called to generate the MessageID of each DIMSE request.
+	// It must not return an ID that is in use by another outstanding
+	// request. If nil, dimse.NewMessageID is used. Mainly for tests that
+	// need deterministic encodings.
+	MessageIDGenerator func() uint16
+
+	// If true, a data PDV that arrives before the command of a DIMSE
+	// message, e.g., padding after the previous message, aborts the
+	// association. If false, such PDVs are discarded. Either way, a
+	// P_DATA_TF PDU may carry several messages.
+	StrictPDataTF bool
+
+	// If true, the A-ASSOCIATE-RQ sent and the A-ASSOCIATE-AC or -RJ
+	// received are logged, one presentation context and user information
+	// sub-item per line, with the UIDs spelled out. Useful when the
+	// provider accepts the association with unexpected context results.
+	LogNegotiation bool
+
+	// If positive, bounds how long a DIMSE request (C-ECHO, C-STORE,
+	// C-FIND, C-MOVE, C-GET) waits for each response from the peer. On
+	// expiration, the request fails with ErrDIMSETimeout. Unlike socket
+	// deadlines, this catches a peer that accepts a request but never
+	// answers it. If zero, requests wait until the association closes.
+	DIMSETimeout time.Duration
+
+	// Presentation contexts to propose in addition to the ones generated
+	// from RequiredServices and SupportedTransferSyntaxes. A SOP class may
+	// appear multiple times, e.g., once with compressed and once with
+	// uncompressed transfer syntaxes. Use PresentationContextID and
+	// CStoreOnContext to pick one of them.
+	ExtraPresentationContexts []PresentationContext
+
+	// If non-nil, receives tracing spans for the association and each
+	// DIMSE operation.
+	Tracer Tracer
+
+	// If true, propose the Verification SOP class in addition to
+	// RequiredServices, so that CEcho works on the same association as,
+	// e.g., CStore. A tool can then check the connectivity before storing
+	// without opening another association.
+	ProposeVerification bool
+}
+
+// Produce the list of SOP classes to propose in the association request.
+func (params *ServiceUserParams) proposedServices() []sopclass.SOPUID {
+	services := params.RequiredServices
+	if params.ProposeVerification {
+		for _, sop := range sopclass.VerificationClasses {
+			if !sopUIDListContains(services, sop.UID) {
+				services = append(services[:len(services):len(services)], sop)
+			}
+		}
+	}
+	return services
+}
+
+// PresentationContext is a proposal of an abstract syntax (SOP class) and the
+// transfer syntaxes it may be encoded in.
+type PresentationContext struct {
+	AbstractSyntaxUID  string
+	TransferSyntaxUIDs []string
 }
 
 // NewServiceUserParams creates a ServiceUserParams.  requiredServices is the
@@ -133,6 +321,9 @@ func NewServiceUserParams(
 	if callingAETitle == "" {
 		return ServiceUserParams{}, errors.New("NewServiceUSerParams: Empty callingAETitle")
 	}
+	if err := checkPresentationContextCount(len(requiredServices)); err != nil {
+		return ServiceUserParams{}, err
+	}
 	if len(transferSyntaxUIDs) == 0 {
 		transferSyntaxUIDs = dicomio.StandardTransferSyntaxes
 	} else {
@@ -153,13 +344,30 @@ func NewServiceUserParams(
 }
 
 func (su *ServiceUser) handleEvent(event upcallEvent) {
+	if c, ok := event.command.(*dimse.C_STORE_RQ); ok {
+		su.handleCStoreRequest(event, c)
+		return
+	}
 	messageID := event.command.GetMessageID()
-	cs := su.findCommand(messageID)
-	if cs == nil {
+	su.mu.Lock()
+	cs, ok := su.activeCommands[messageID]
+	if !ok {
+		su.mu.Unlock()
 		vlog.Errorf("Dropping message for non-existent ID: %v", event.command)
 		return
 	}
-	cs.upcallCh <- event
+	// Send without holding mu; the command may not read the event for a
+	// while, e.g., if the caller of CFind has stopped reading results.
+	// Registering as a sender keeps deleteCommand from closing the channel
+	// under us.
+	cs.senders.Add(1)
+	su.mu.Unlock()
+	defer cs.senders.Done()
+	select {
+	case cs.upcallCh <- event:
+	case <-cs.doneCh:
+		vlog.Errorf("Dropping message for finished ID: %v", event.command)
+	}
 }
 
 // NewServiceUser creates a new ServiceUser. The caller must call either
@@ -168,8 +376,10 @@ func NewServiceUser(params ServiceUserParams) *ServiceUser {
 	mu := &sync.Mutex{}
 	su := &ServiceUser{
 		// sm: NewStateMachineForServiceUser(params, nil, nil),
+		params:     params,
 		downcallCh: make(chan stateEvent, 128),
 		upcallCh:   make(chan upcallEvent, 128),
+		tracer:     tracerOrNoop(params.Tracer),
 
 		mu:             mu,
 		cond:           sync.NewCond(mu),
@@ -186,9 +396,22 @@ func NewServiceUser(params ServiceUserParams) *ServiceUser {
 				su.cond.Broadcast()
 				su.cm = event.cm
 				doassert(su.cm != nil)
+				su.span = su.tracer.StartSpan(nil, "association",
+					associationSpanAttrs(params.CallingAETitle, params.CalledAETitle))
 				su.mu.Unlock()
 				continue
 			}
+			if event.eventType == upcallEventAbort {
+				vlog.Infof("Service user: %v", event.err)
+				su.mu.Lock()
+				su.abortErr = event.err
+				su.mu.Unlock()
+				continue
+			}
+			if event.eventType == upcallEventDropped {
+				su.failCommand(event.command, event.err)
+				continue
+			}
 			doassert(event.eventType == upcallEventData)
 			su.handleEvent(event)
 		}
@@ -196,6 +419,10 @@ func NewServiceUser(params ServiceUserParams) *ServiceUser {
 		su.mu.Lock()
 		su.cond.Broadcast()
 		su.status = serviceUserClosed
+		su.closeCommands()
+		if su.cm != nil {
+			su.tracer.EndSpan(su.span, nil, su.abortErr)
+		}
 		su.mu.Unlock()
 	}()
 	return su
@@ -207,9 +434,17 @@ func (su *ServiceUser) waitUntilReady() error {
 	for su.status <= serviceUserInitial {
 		su.cond.Wait()
 	}
+	if su.released {
+		return ErrReleased
+	}
 	if su.status != serviceUserAssociationActive {
 		// Will get an error when waiting for a response.
 		vlog.Errorf("Connection failed")
+		// E.g., a *Rejection, or the reason the association request
+		// couldn't be sent.
+		if su.abortErr != nil {
+			return su.abortErr
+		}
 		return fmt.Errorf("Connection failed")
 	}
 	return nil
@@ -224,7 +459,7 @@ func (su *ServiceUser) Connect(serverAddr string) {
 		vlog.Infof("Connect(%s): %v", serverAddr, err)
 		su.downcallCh <- stateEvent{event: evt17, pdu: nil, err: err}
 	} else {
-		su.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
+		su.SetConn(conn)
 	}
 }
 
@@ -232,18 +467,28 @@ func (su *ServiceUser) Connect(serverAddr string) {
 // the server. Either Connect or SetConn must be before calling CStore, etc.
 func (su *ServiceUser) SetConn(conn net.Conn) {
 	doassert(su.status == serviceUserInitial)
+	if err := applyTCPOptions(conn, su.params.TCPOptions); err != nil {
+		vlog.Errorf("Failed to set TCP options %+v on %v: %v", su.params.TCPOptions, conn.RemoteAddr(), err)
+	}
 	su.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
 }
 
 // Send a C-ECHO request to the remote AE. Returns nil iff the remote AE
 // responds ok.
-func (su *ServiceUser) CEcho() error {
-	err := su.waitUntilReady()
+func (su *ServiceUser) CEcho() (err error) {
+	err = su.waitUntilReady()
 	if err != nil {
 		return err
 	}
-	cs := su.createCommand(dimse.NewMessageID())
+	// Fail if the provider rejected the verification context, rather than
+	// send a request on it.
+	if _, err := su.cm.lookupByAbstractSyntaxUID(dicomuid.VerificationSOPClass); err != nil {
+		return err
+	}
+	cs := su.createCommand(su.newMessageID(), "")
 	defer su.deleteCommand(cs)
+	endSpan := su.startOperationSpan("C-ECHO", dicomuid.VerificationSOPClass, cs.messageID)
+	defer func() { endSpan(err) }()
 	su.downcallCh <- stateEvent{
 		event: evt09,
 		dimsePayload: &stateEventDIMSEPayload{
@@ -253,9 +498,12 @@ func (su *ServiceUser) CEcho() error {
 				CommandDataSetType: dimse.CommandDataSetTypeNull,
 			},
 			data: nil}}
-	event, ok := <-cs.upcallCh
+	event, ok, err := receiveUpcall(cs.upcallCh, su.params.DIMSETimeout)
+	if err != nil {
+		return err
+	}
 	if !ok {
-		return fmt.Errorf("Failed to receive C-ECHO response")
+		return su.closedError(cs, "Failed to receive C-ECHO response")
 	}
 	resp, ok := event.command.(*dimse.C_ECHO_RSP)
 	if !ok {
@@ -267,18 +515,140 @@ func (su *ServiceUser) CEcho() error {
 	return nil
 }
 
+// NGet issues an N-GET request for the attributes of the SOP instance
+// "sopInstanceUID" of class "sopClassUID", e.g., sopclass.DisplaySystemSOPInstance
+// of sopclass.DisplaySystemClasses. "attributes" lists the attributes to
+// retrieve. If it is empty, the provider returns all of them. The SOP class
+// must be in ServiceUserParams.RequiredServices. It blocks until the operation
+// finishes.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) NGet(sopClassUID, sopInstanceUID string, attributes []dicom.Tag) (elems []*dicom.Element, err error) {
+	err = su.waitUntilReady()
+	if err != nil {
+		return nil, err
+	}
+	context, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	if err != nil {
+		return nil, err
+	}
+	cs := su.createCommand(su.newMessageID(), "")
+	defer su.deleteCommand(cs)
+	endSpan := su.startOperationSpan("N-GET", sopClassUID, cs.messageID)
+	defer func() { endSpan(err) }()
+	su.downcallCh <- stateEvent{
+		event: evt09,
+		dimsePayload: &stateEventDIMSEPayload{
+			abstractSyntaxName: sopClassUID,
+			command: &dimse.N_GET_RQ{
+				RequestedSOPClassUID:    sopClassUID,
+				MessageID:               cs.messageID,
+				CommandDataSetType:      dimse.CommandDataSetTypeNull,
+				RequestedSOPInstanceUID: sopInstanceUID,
+				AttributeIdentifierList: attributes,
+			},
+			data: nil}}
+	event, ok, err := receiveUpcall(cs.upcallCh, su.params.DIMSETimeout)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, su.closedError(cs, "Failed to receive N-GET response")
+	}
+	resp, ok := event.command.(*dimse.N_GET_RSP)
+	if !ok {
+		return nil, fmt.Errorf("Invalid response for N-GET: %v", event.command)
+	}
+	if isFailureStatus(resp.Status) {
+		return nil, fmt.Errorf("Non-OK status in N-GET response: %v", resp.Status)
+	}
+	if !resp.HasData() {
+		return nil, nil
+	}
+	return readElementsInBytes(event.data, context.transferSyntaxUID, dimse.DefaultMaxSequenceDepth)
+}
+
 // CStore issues a C-STORE request to transfer "ds" in remove peer.  It blocks
 // until the operation finishes.
 //
 // REQUIRES: Connect() or SetConn has been called.
-func (su *ServiceUser) CStore(ds *dicom.DataSet) error {
-	err := su.waitUntilReady()
+func (su *ServiceUser) CStore(ds *dicom.DataSet) (err error) {
+	err = su.waitUntilReady()
 	if err != nil {
 		return err
 	}
 	doassert(su.cm != nil)
-	cs := su.createCommand(dimse.NewMessageID())
-	return runCStoreOnAssociation(cs.upcallCh, su.downcallCh, su.cm, cs.messageID, ds)
+	cs := su.createCommand(su.newMessageID(), "")
+	defer su.deleteCommand(cs)
+	endSpan := su.startOperationSpan("C-STORE", dataSetSOPClassUID(ds), cs.messageID)
+	defer func() { endSpan(err) }()
+	err = runCStoreOnAssociation(cs.upcallCh, su.downcallCh, su.cm, cs.messageID, 0, ds, su.params.DIMSETimeout)
+	if err == errCStoreConnectionClosed {
+		err = su.closedError(cs, "%v", err)
+	}
+	return err
+}
+
+// PresentationContextID returns the ID of a presentation context that the
+// provider accepted for the given SOP class and transfer syntax. It is for use
+// with CStoreOnContext.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) PresentationContextID(sopClassUID, transferSyntaxUID string) (byte, error) {
+	if err := su.waitUntilReady(); err != nil {
+		return 0, err
+	}
+	context, err := su.cm.lookupByAbstractAndTransferSyntaxUIDs(sopClassUID, transferSyntaxUID)
+	if err != nil {
+		return 0, err
+	}
+	return context.contextID, nil
+}
+
+// SupportedStorageClasses returns the UIDs of the storage SOP classes (those in
+// sopclass.StorageClasses) that the provider accepted, in the order of the
+// presentation context IDs. A sender can use it to skip instances that the
+// provider won't store, rather than fail each C-STORE. It returns an empty
+// list if the association couldn't be established.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) SupportedStorageClasses() []string {
+	var uids []string
+	if err := su.waitUntilReady(); err != nil {
+		return uids
+	}
+	for _, context := range su.cm.acceptedContexts() {
+		uid := context.AbstractSyntaxUID
+		if sopUIDListContains(sopclass.StorageClasses, uid) && !stringListContains(uids, uid) {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// CStoreOnContext is similar to CStore, but it sends the dataset on the given
+// presentation context, rather than the one picked by the SOP class of the
+// dataset. This is useful when the SOP class was negotiated under multiple
+// contexts (see ServiceUserParams.ExtraPresentationContexts), e.g., to send
+// a precompressed instance on a context with a compressed transfer syntax.
+// For a compressed transfer syntax, the pixel data in "ds" must already be
+// compressed accordingly.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStoreOnContext(contextID byte, ds *dicom.DataSet) (err error) {
+	err = su.waitUntilReady()
+	if err != nil {
+		return err
+	}
+	cs := su.createCommand(su.newMessageID(), "")
+	defer su.deleteCommand(cs)
+	endSpan := su.startOperationSpan("C-STORE", dataSetSOPClassUID(ds), cs.messageID)
+	defer func() { endSpan(err) }()
+	err = runCStoreOnAssociation(cs.upcallCh, su.downcallCh, su.cm, cs.messageID, contextID, ds, su.params.DIMSETimeout)
+	if err == errCStoreConnectionClosed {
+		err = su.closedError(cs, "%v", err)
+	}
+	return err
 }
 
 type CFindQRLevel int
@@ -286,12 +656,103 @@ type CFindQRLevel int
 const (
 	CFindPatientQRLevel CFindQRLevel = iota
 	CFindStudyQRLevel
+
+	// The PATIENT and STUDY levels of the retired Patient/Study Only
+	// information model, for legacy archives that support only it.
+	CFindPatientStudyOnlyPatientQRLevel
+	CFindPatientStudyOnlyStudyQRLevel
+
+	// The SERIES and IMAGE levels of the Study Root information model, to
+	// drill down from a study. The filter must specify the unique keys of
+	// the levels above, i.e., StudyInstanceUID, plus SeriesInstanceUID for
+	// IMAGE, unless relational queries are negotiated.
+	CFindSeriesQRLevel
+	CFindImageQRLevel
 )
 
+// SOP classes of the query/retrieve information model for a CFindQRLevel.
+type qrSOPClasses struct {
+	find, move, get string
+	level           string // QueryRetrieveLevel value
+}
+
+func qrLevelToSOPClasses(qrLevel CFindQRLevel) (qrSOPClasses, error) {
+	switch qrLevel {
+	case CFindPatientQRLevel:
+		return qrSOPClasses{
+			find:  dicomuid.PatientRootQRFind,
+			move:  dicomuid.PatientRootQRMove,
+			get:   dicomuid.PatientRootQRGet,
+			level: "PATIENT",
+		}, nil
+	case CFindStudyQRLevel, CFindSeriesQRLevel, CFindImageQRLevel:
+		level := "STUDY"
+		switch qrLevel {
+		case CFindSeriesQRLevel:
+			level = "SERIES"
+		case CFindImageQRLevel:
+			level = "IMAGE"
+		}
+		return qrSOPClasses{
+			find:  dicomuid.StudyRootQRFind,
+			move:  dicomuid.StudyRootQRMove,
+			get:   dicomuid.StudyRootQRGet,
+			level: level,
+		}, nil
+	case CFindPatientStudyOnlyPatientQRLevel, CFindPatientStudyOnlyStudyQRLevel:
+		level := "PATIENT"
+		if qrLevel == CFindPatientStudyOnlyStudyQRLevel {
+			level = "STUDY"
+		}
+		return qrSOPClasses{
+			find:  sopclass.PatientStudyOnlyQRFind,
+			move:  sopclass.PatientStudyOnlyQRMove,
+			get:   sopclass.PatientStudyOnlyQRGet,
+			level: level,
+		}, nil
+	}
+	return qrSOPClasses{}, fmt.Errorf("Invalid QR level: %d", qrLevel)
+}
+
+// Encode the payload of a C-{FIND,MOVE,GET} request. It contains the
+// QueryRetrieveLevel derived from qrLevel, followed by the filter.
+func (su *ServiceUser) encodeQRRequest(sopClassUID string, qrLevel CFindQRLevel, filter []*dicom.Element) (contextManagerEntry, []byte, error) {
+	sopClasses, err := qrLevelToSOPClasses(qrLevel)
+	if err != nil {
+		return contextManagerEntry{}, nil, err
+	}
+	context, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	if err != nil {
+		// This happens when the user passed a wrong sopclass list in
+		// A-ASSOCIATE handshake.
+		vlog.Errorf("Failed to lookup sopclass %v: %v", sopClassUID, err)
+		return contextManagerEntry{}, nil, err
+	}
+	// Encode the data payload containing the filtering conditions.
+	dataEncoder := dicomio.NewBytesEncoderWithTransferSyntax(context.transferSyntaxUID)
+	dicom.WriteElement(dataEncoder, dicom.MustNewElement(dicom.TagQueryRetrieveLevel, sopClasses.level))
+	for _, elem := range filter {
+		if elem.Tag == dicom.TagQueryRetrieveLevel {
+			// This tag is auto-computed from qrlevel.
+			return contextManagerEntry{}, nil, fmt.Errorf("%v: tag must not be in the QR payload (it is derived from qrLevel)", elem.Tag)
+		}
+		dicom.WriteElement(dataEncoder, elem)
+	}
+	if err := dataEncoder.Error(); err != nil {
+		return contextManagerEntry{}, nil, err
+	}
+	return context, dataEncoder.Bytes(), nil
+}
+
 type CFindResult struct {
 	// Exactly one of Err or Elements is set.
 	Err      error
 	Elements []*dicom.Element // Elements belonging to one dataset.
+
+	// MessageID of the C-FIND request, set in the results of
+	// ServiceUser.CFind. It can be passed to ServiceUser.CancelOperation.
+	// Ignored in the results of a CFindCallback.
+	MessageID uint16
 }
 
 type CMoveResult struct {
@@ -304,12 +765,26 @@ type CMoveResult struct {
 // CFind issues a C-FIND request. Returns a channel that streams sequence of
 // either an error or a dataset found. The caller MUST read all responses from
 // the channel before issuing any other DIMSE command (C-FIND, C-STORE, etc).
+// To stop early, use CFindWithCancel.
 //
 // The param sopClassUID is one of the UIDs defined in sopclass.QRFindClasses.
 // filter is the list of elements to match and retrieve.
 //
 // REQUIRES: Connect() or SetConn has been called.
 func (su *ServiceUser) CFind(qrLevel CFindQRLevel, filter []*dicom.Element) chan CFindResult {
+	return su.CFindWithCancel(qrLevel, filter, nil)
+}
+
+// CFindWithCancel is similar to CFind, but the caller may stop the query by
+// closing cancel, e.g., after reading the first page of the matches. It sends
+// C-CANCEL-RQ to the provider (P3.7 9.3.2.3), and the responses that follow,
+// including the final one with status Cancel, are discarded. The channel is
+// closed once the final response arrives, so that the next command may be
+// issued. The caller needn't read the channel after closing cancel.
+// CancelOperation with the MessageID of a result has the same effect.
+//
+// A nil cancel never fires.
+func (su *ServiceUser) CFindWithCancel(qrLevel CFindQRLevel, filter []*dicom.Element, cancel <-chan struct{}) chan CFindResult {
 	ch := make(chan CFindResult, 128)
 	err := su.waitUntilReady()
 	if err != nil {
@@ -317,53 +792,45 @@ func (su *ServiceUser) CFind(qrLevel CFindQRLevel, filter []*dicom.Element) chan
 		close(ch)
 		return ch
 	}
-	cs := su.createCommand(dimse.NewMessageID())
-	// Translate qrLevel to the sopclass and QRLevel elem.
-	var sopClassUID string
-	var qrLevelString string
-	switch qrLevel {
-	case CFindPatientQRLevel:
-		sopClassUID = dicomuid.PatientRootQRFind
-		qrLevelString = "PATIENT"
-	case CFindStudyQRLevel:
-		sopClassUID = dicomuid.StudyRootQRFind
-		qrLevelString = "STUDY"
-	default:
-		ch <- CFindResult{Err: fmt.Errorf("Invalid C-FIND QR lever: %d", qrLevel)}
-		close(ch)
-		return ch
-	}
-
-	// Encode the C-FIND DIMSE command.
-	context, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	sopClasses, err := qrLevelToSOPClasses(qrLevel)
 	if err != nil {
-		// This happens when the user passed a wrong sopclass list in
-		// A-ASSOCIATE handshake.
-		vlog.Errorf("Failed to lookup sopclass %v: %v", sopClassUID, err)
 		ch <- CFindResult{Err: err}
 		close(ch)
 		return ch
 	}
-	// Encode the data payload containing the filtering conditions.
-	dataEncoder := dicomio.NewBytesEncoderWithTransferSyntax(context.transferSyntaxUID)
-	dicom.WriteElement(dataEncoder, dicom.MustNewElement(dicom.TagQueryRetrieveLevel, qrLevelString))
-	for _, elem := range filter {
-		if elem.Tag == dicom.TagQueryRetrieveLevel {
-			// This tag is auto-computed from qrlevel.
-			ch <- CFindResult{Err: fmt.Errorf("%v: tag must not be in the C-FIND payload (it is derived from qrLevel)", elem.Tag)}
-			close(ch)
-			return ch
-		}
-		dicom.WriteElement(dataEncoder, elem)
-	}
-	if err := dataEncoder.Error(); err != nil {
+	sopClassUID := sopClasses.find
+	context, payload, err := su.encodeQRRequest(sopClassUID, qrLevel, filter)
+	if err != nil {
 		ch <- CFindResult{Err: err}
 		close(ch)
 		return ch
 	}
+	cs := su.createCommand(su.newMessageID(), sopClassUID)
+	endSpan := su.startOperationSpan("C-FIND", sopClassUID, cs.messageID)
 	go func() {
+		var spanErr error
+		defer func() { endSpan(spanErr) }()
 		defer close(ch)
 		defer su.deleteCommand(cs)
+		var cancelled = func() bool {
+			select {
+			case <-cs.cancelCh:
+				return true
+			default:
+				return false
+			}
+		}
+		var send = func(result CFindResult) {
+			if result.Err != nil {
+				spanErr = result.Err
+			}
+			result.MessageID = cs.messageID
+			select {
+			case ch <- result:
+			case <-cs.cancelCh:
+				// The caller has stopped reading.
+			}
+		}
 		su.downcallCh <- stateEvent{
 			event: evt09,
 			dimsePayload: &stateEventDIMSEPayload{
@@ -373,32 +840,52 @@ func (su *ServiceUser) CFind(qrLevel CFindQRLevel, filter []*dicom.Element) chan
 					MessageID:           cs.messageID,
 					CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
 				},
-				data: dataEncoder.Bytes()}}
+				data: payload}}
+		if cancel != nil {
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-cancel:
+					if err := su.CancelOperation(cs.messageID); err != nil {
+						vlog.Errorf("C-FIND: failed to cancel: %v", err)
+					}
+				case <-done:
+				}
+			}()
+		}
 		for {
-			event, ok := <-cs.upcallCh
+			event, ok, err := receiveUpcall(cs.upcallCh, su.params.DIMSETimeout)
+			if err != nil {
+				send(CFindResult{Err: err})
+				break
+			}
 			if !ok {
 				su.status = serviceUserClosed
-				ch <- CFindResult{Err: fmt.Errorf("Connection closed while waiting for C-FIND response")}
+				send(CFindResult{Err: su.closedError(cs, "Connection closed while waiting for C-FIND response")})
 				break
 			}
 			doassert(event.eventType == upcallEventData)
 			doassert(event.command != nil)
 			resp, ok := event.command.(*dimse.C_FIND_RSP)
 			if !ok {
-				ch <- CFindResult{Err: fmt.Errorf("Found wrong response for C-FIND: %v", event.command)}
+				send(CFindResult{Err: fmt.Errorf("Found wrong response for C-FIND: %v", event.command)})
 				break
 			}
-			elems, err := readElementsInBytes(event.data, context.transferSyntaxUID)
-			if err != nil {
-				vlog.Errorf("Failed to decode C-FIND response: %v %v", resp.String(), err)
-				ch <- CFindResult{Err: err}
-			} else {
-				ch <- CFindResult{Elements: elems}
+			// Pending responses carry a matched identifier. The
+			// final response usually doesn't.
+			if resp.HasData() && !cancelled() {
+				elems, err := readElementsInBytes(event.data, context.transferSyntaxUID, dimse.DefaultMaxSequenceDepth)
+				if err != nil {
+					vlog.Errorf("Failed to decode C-FIND response: %v %v", resp.String(), err)
+					send(CFindResult{Err: err})
+				} else {
+					send(CFindResult{Elements: elems})
+				}
 			}
-			if resp.Status.Status != dimse.StatusPending {
-				if resp.Status.Status != 0 {
-					// TODO: report error if status!= 0
-					panic(resp)
+			if !resp.Status.IsPending() {
+				if resp.Status.Status != dimse.StatusSuccess && !(resp.Status.IsCancel() && cancelled()) {
+					send(CFindResult{Err: fmt.Errorf("C-FIND failed: %v", resp.Status)})
 				}
 				break
 			}
@@ -407,17 +894,290 @@ func (su *ServiceUser) CFind(qrLevel CFindQRLevel, filter []*dicom.Element) chan
 	return ch
 }
 
-// Release shuts down the connection. It must be called exactly once.  After
-// Release(), no other operation can be performed on the ServiceUser object.
-func (su *ServiceUser) Release() {
-	su.waitUntilReady()
-	su.downcallCh <- stateEvent{event: evt11}
+// RetrieveProgress reports one C-MOVE or C-GET response received by
+// ServiceUser.CMove or CGet.
+type RetrieveProgress struct {
+	// A pending status (Status.IsPending) for all but the last response.
+	Status dimse.Status
+
+	// Sub-operation counts reported by the provider. A count that the
+	// provider omitted is reported as zero.
+	Remaining int
+	Completed int
+	Failed    int
+	Warning   int
+
+	// Identifier sent with the response, if any. The last response may carry
+	// FailedSOPInstanceUIDList (0008,0058) here.
+	Elements []*dicom.Element
+
+	// MessageID of the request. It can be passed to
+	// ServiceUser.CancelOperation.
+	MessageID uint16
+}
+
+// RetrieveProgressCallback is called by CMove and CGet for every response
+// from the provider, in the arrival order.
+type RetrieveProgressCallback func(progress RetrieveProgress)
+
+// CGetInstanceCallback is called by CGet for each instance sent back by the
+// provider. The args are the same as the fields of CStoreRequest. The
+// returned status is sent to the provider in the C-STORE response.
+type CGetInstanceCallback func(
+	transferSyntaxUID string,
+	sopClassUID string,
+	sopInstanceUID string,
+	data []byte) dimse.Status
+
+// CMove issues a C-MOVE request. The provider copies the instances matching
+// the filter to the AE named moveDestination. The provider reports the
+// progress after each copy, and onProgress, if non-nil, is called for each
+// report. Note that C-MOVE-RSP doesn't identify the instance copied; only the
+// counters. Blocks until the operation finishes. Returns nil iff the final
+// response reports success.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CMove(qrLevel CFindQRLevel, moveDestination string, filter []*dicom.Element,
+	onProgress RetrieveProgressCallback) (err error) {
+	if err := su.waitUntilReady(); err != nil {
+		return err
+	}
+	sopClasses, err := qrLevelToSOPClasses(qrLevel)
+	if err != nil {
+		return err
+	}
+	_, payload, err := su.encodeQRRequest(sopClasses.move, qrLevel, filter)
+	if err != nil {
+		return err
+	}
+	cs := su.createCommand(su.newMessageID(), sopClasses.move)
+	defer su.deleteCommand(cs)
+	endSpan := su.startOperationSpan("C-MOVE", sopClasses.move, cs.messageID)
+	defer func() { endSpan(err) }()
+	return su.runRetrieve(cs, sopClasses.move, &dimse.C_MOVE_RQ{
+		AffectedSOPClassUID: sopClasses.move,
+		MessageID:           cs.messageID,
+		MoveDestination:     moveDestination,
+		CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+	}, payload, onProgress)
+}
+
+// CGet issues a C-GET request. The provider sends the instances matching the
+// filter back over this association, and onInstance is called for each of
+// them. onProgress, if non-nil, is called for each C-GET response. Blocks
+// until the operation finishes. Returns nil iff the final response reports
+// success.
+//
+// The params given to NewServiceUser must list the SOP classes of the
+// instances to receive (e.g., sopclass.StorageClasses) in addition to the
+// C-GET class in RequiredServices. The user proposes the SCP role for those
+// classes.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CGet(qrLevel CFindQRLevel, filter []*dicom.Element,
+	onProgress RetrieveProgressCallback, onInstance CGetInstanceCallback) (err error) {
+	if err := su.waitUntilReady(); err != nil {
+		return err
+	}
+	sopClasses, err := qrLevelToSOPClasses(qrLevel)
+	if err != nil {
+		return err
+	}
+	_, payload, err := su.encodeQRRequest(sopClasses.get, qrLevel, filter)
+	if err != nil {
+		return err
+	}
+	su.mu.Lock()
+	su.onCGetInstance = onInstance
+	su.mu.Unlock()
+	defer func() {
+		su.mu.Lock()
+		su.onCGetInstance = nil
+		su.mu.Unlock()
+	}()
+	cs := su.createCommand(su.newMessageID(), sopClasses.get)
+	defer su.deleteCommand(cs)
+	endSpan := su.startOperationSpan("C-GET", sopClasses.get, cs.messageID)
+	defer func() { endSpan(err) }()
+	return su.runRetrieve(cs, sopClasses.get, &dimse.C_GET_RQ{
+		AffectedSOPClassUID: sopClasses.get,
+		MessageID:           cs.messageID,
+		CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+	}, payload, onProgress)
+}
+
+// Send a C-MOVE or C-GET request and wait for its responses.
+func (su *ServiceUser) runRetrieve(cs *userCommandState, sopClassUID string, command dimse.Message,
+	payload []byte, onProgress RetrieveProgressCallback) error {
+	su.downcallCh <- stateEvent{
+		event: evt09,
+		dimsePayload: &stateEventDIMSEPayload{
+			abstractSyntaxName: sopClassUID,
+			command:            command,
+			data:               payload,
+		}}
+	for {
+		event, ok, err := receiveUpcall(cs.upcallCh, su.params.DIMSETimeout)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return su.closedError(cs, "Connection closed while waiting for %v response", command)
+		}
+		progress := RetrieveProgress{MessageID: cs.messageID}
+		var remaining, completed, failed, warning uint16
+		switch resp := event.command.(type) {
+		case *dimse.C_MOVE_RSP:
+			progress.Status = resp.Status
+			remaining, completed, failed, warning = resp.NumberOfRemainingSuboperations,
+				resp.NumberOfCompletedSuboperations, resp.NumberOfFailedSuboperations, resp.NumberOfWarningSuboperations
+		case *dimse.C_GET_RSP:
+			progress.Status = resp.Status
+			remaining, completed, failed, warning = resp.NumberOfRemainingSuboperations,
+				resp.NumberOfCompletedSuboperations, resp.NumberOfFailedSuboperations, resp.NumberOfWarningSuboperations
+		default:
+			return fmt.Errorf("Found wrong response for %v: %v", command, event.command)
+		}
+		progress.Remaining, progress.Completed = int(remaining), int(completed)
+		progress.Failed, progress.Warning = int(failed), int(warning)
+		if event.command.HasData() {
+			context, err := event.cm.lookupByContextID(event.contextID)
+			if err != nil {
+				return err
+			}
+			elems, err := readElementsInBytes(event.data, context.transferSyntaxUID, dimse.DefaultMaxSequenceDepth)
+			if err != nil {
+				vlog.Errorf("Failed to decode %v: %v", event.command, err)
+				return err
+			}
+			progress.Elements = elems
+		}
+		if onProgress != nil {
+			onProgress(progress)
+		}
+		if !progress.Status.IsPending() {
+			if progress.Status.Status != dimse.StatusSuccess {
+				return fmt.Errorf("%v failed: %v", command, event.command)
+			}
+			return nil
+		}
+	}
+}
+
+// CancelOperation asks the provider to stop the outstanding C-FIND, C-MOVE, or
+// C-GET request with the given message ID, by sending C-CANCEL-RQ (P3.7
+// 9.3.2.3). The other requests on the association are unaffected. The request
+// ends once the provider sends its final response, usually with status
+// Cancel: CFind discards the remaining results and closes its channel, and
+// CMove and CGet return an error that reports the status.
+//
+// The message ID is reported in CFindResult.MessageID and
+// RetrieveProgress.MessageID. Cancelling a request again is a no-op. It
+// returns an error if there is no such request, or it is of another type.
+func (su *ServiceUser) CancelOperation(messageID uint16) error {
+	su.mu.Lock()
+	if su.released {
+		su.mu.Unlock()
+		return ErrReleased
+	}
+	cs, ok := su.activeCommands[messageID]
+	if !ok {
+		su.mu.Unlock()
+		return fmt.Errorf("No outstanding request with message ID %d", messageID)
+	}
+	if cs.qrSOPClassUID == "" {
+		su.mu.Unlock()
+		return fmt.Errorf("Request with message ID %d is not C-FIND, C-MOVE, or C-GET; it can't be cancelled", messageID)
+	}
+	if cs.cancelled {
+		su.mu.Unlock()
+		return nil
+	}
+	cs.cancelled = true
+	close(cs.cancelCh)
+	su.mu.Unlock()
+	su.downcallCh <- stateEvent{
+		event: evt09,
+		dimsePayload: &stateEventDIMSEPayload{
+			abstractSyntaxName: cs.qrSOPClassUID,
+			command: &dimse.C_CANCEL_RQ{
+				MessageIDBeingRespondedTo: messageID,
+				CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			},
+		}}
+	return nil
+}
+
+// Handle a C-STORE sub-operation sent by the provider during C-GET.
+func (su *ServiceUser) handleCStoreRequest(event upcallEvent, c *dimse.C_STORE_RQ) {
+	su.mu.Lock()
+	onInstance := su.onCGetInstance
+	su.mu.Unlock()
+	status := dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: "No C-GET in progress"}
+	context, err := event.cm.lookupByContextID(event.contextID)
+	if err != nil {
+		vlog.Errorf("C-STORE sub-operation for invalid context %d: %v", event.contextID, err)
+		return
+	}
+	if err := CheckDataSetEncoding(event.data, context.transferSyntaxUID); err != nil {
+		vlog.Errorf("C-STORE sub-operation for %v: %v", c.AffectedSOPInstanceUID, err)
+		status = dimse.Status{Status: dimse.CStoreStatusCannotUnderstand, ErrorComment: err.Error()}
+	} else if onInstance != nil {
+		status = onInstance(context.transferSyntaxUID, c.AffectedSOPClassUID, c.AffectedSOPInstanceUID, event.data)
+	}
+	su.downcallCh <- stateEvent{
+		event: evt09,
+		dimsePayload: &stateEventDIMSEPayload{
+			abstractSyntaxName: context.abstractSyntaxUID,
+			command: &dimse.C_STORE_RSP{
+				AffectedSOPClassUID:       c.AffectedSOPClassUID,
+				MessageIDBeingRespondedTo: c.MessageID,
+				CommandDataSetType:        dimse.CommandDataSetTypeNull,
+				AffectedSOPInstanceUID:    c.AffectedSOPInstanceUID,
+				Status:                    status,
+			},
+		}}
+}
+
+// Release shuts down the connection. After Release(), no other operation can
+// be performed on the ServiceUser object.
+//
+// An operation started after Release fails with ErrReleased. So does one
+// running in another goroutine whose request comes after A-RELEASE-RQ, since
+// no data may follow it; the request is not sent. Other running operations
+// fail once the association closes.
+//
+// Release may be called more than once, e.g., both explicitly and in a defer
+// statement. Only the first call does the work; the later ones return nil. The
+// first call returns an error if the association was never established, e.g.,
+// the connection failed or the provider rejected it. It returns nil if the
+// association was already aborted.
+func (su *ServiceUser) Release() error {
+	var err error
+	su.releaseOnce.Do(func() { err = su.release() })
+	return err
+}
+
+func (su *ServiceUser) release() error {
+	err := su.waitUntilReady()
+	su.mu.Lock()
+	su.released = true
+	established := su.cm != nil
+	// After an abort or a connection failure, the state machine has
+	// finished, and nobody reads the A-RELEASE request.
+	active := su.status == serviceUserAssociationActive
+	su.mu.Unlock()
+	if active {
+		su.downcallCh <- stateEvent{event: evt11}
+	}
 
 	su.mu.Lock()
 	defer su.mu.Unlock()
 	su.status = serviceUserClosed
 	su.cond.Broadcast()
-	for _, cs := range su.activeCommands {
-		close(cs.upcallCh)
+	su.closeCommands()
+	if !established {
+		return err
 	}
+	return nil
 }
@@ -134,18 +134,42 @@ var StorageClasses = []SOPUID{
 	SOPUID{"ImplantTemplateGroupStorage", "1.2.840.10008.5.1.4.45.1"},
 }
 
+// SOP classes for display and printer QA, served with N-GET. P3.4 EE, H.4.
+var DisplaySystemClasses = []SOPUID{
+	SOPUID{"DisplaySystemSOPClass", "1.2.840.10008.5.1.1.40"}}
+
+var PrinterClasses = []SOPUID{
+	SOPUID{"PrinterSOPClass", "1.2.840.10008.5.1.1.16"},
+	SOPUID{"PrinterConfigurationRetrievalSOPClass", "1.2.840.10008.5.1.1.16.376"}}
+
+// Well-known SOP instances of the classes above. Each class has exactly one
+// instance, which is the target of N-GET.
+const (
+	DisplaySystemSOPInstance                 = "1.2.840.10008.5.1.1.40.1"
+	PrinterSOPInstance                       = "1.2.840.10008.5.1.1.17"
+	PrinterConfigurationRetrievalSOPInstance = "1.2.840.10008.5.1.1.17.376"
+)
+
+// SOP classes of the Patient/Study Only Query/Retrieve information model. The
+// model is retired, so go-dicom's dicomuid doesn't define them.
+const (
+	PatientStudyOnlyQRFind = "1.2.840.10008.5.1.4.1.2.3.1"
+	PatientStudyOnlyQRMove = "1.2.840.10008.5.1.4.1.2.3.2"
+	PatientStudyOnlyQRGet  = "1.2.840.10008.5.1.4.1.2.3.3"
+)
+
 var QRFindClasses = []SOPUID{
 	SOPUID{"PatientRootQueryRetrieveInformationModelFind", "1.2.840.10008.5.1.4.1.2.1.1"},
 	SOPUID{"StudyRootQueryRetrieveInformationModelFind", "1.2.840.10008.5.1.4.1.2.2.1"},
-	SOPUID{"PatientStudyOnlyQueryRetrieveInformationModelFind", "1.2.840.10008.5.1.4.1.2.3.1"},
+	SOPUID{"PatientStudyOnlyQueryRetrieveInformationModelFind", PatientStudyOnlyQRFind},
 	SOPUID{"ModalityWorklistInformationFind", "1.2.840.10008.5.1.4.31"}}
 
 var QRMoveClasses = []SOPUID{
 	SOPUID{"PatientRootQueryRetrieveInformationModelMove", "1.2.840.10008.5.1.4.1.2.1.2"},
 	SOPUID{"StudyRootQueryRetrieveInformationModelMove", "1.2.840.10008.5.1.4.1.2.2.2"},
-	SOPUID{"PatientStudyOnlyQueryRetrieveInformationModelMove", "1.2.840.10008.5.1.4.1.2.3.2"}}
+	SOPUID{"PatientStudyOnlyQueryRetrieveInformationModelMove", PatientStudyOnlyQRMove}}
 
 var QRGetClasses = []SOPUID{
 	SOPUID{"PatientRootQueryRetrieveInformationModelGet", "1.2.840.10008.5.1.4.1.2.1.3"},
 	SOPUID{"StudyRootQueryRetrieveInformationModelGet", "1.2.840.10008.5.1.4.1.2.2.3"},
-	SOPUID{"PatientStudyOnlyQueryRetrieveInformationModelGet", "1.2.840.10008.5.1.4.1.2.3.3"}}
+	SOPUID{"PatientStudyOnlyQueryRetrieveInformationModelGet", PatientStudyOnlyQRGet}}
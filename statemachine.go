@@ -164,9 +164,24 @@ var actionAe2 = &stateAction{"AE-2", "Connection established on the user side. S
 		doassert(event.conn != nil)
 		sm.conn = event.conn
 		go networkReaderThread(sm.netCh, event.conn, DefaultMaxPDUSize, sm.label)
-		items := sm.contextManager.generateAssociateRequest(
-			sm.userParams.RequiredServices,
-			sm.userParams.SupportedTransferSyntaxes)
+		sm.contextManager.callingAETitle = sm.userParams.CallingAETitle
+		sm.contextManager.calledAETitle = sm.userParams.CalledAETitle
+		items, err := sm.contextManager.generateAssociateRequest(
+			sm.userParams.proposedServices(),
+			sm.userParams.SupportedTransferSyntaxes,
+			sm.userParams.QRExtendedNegotiation,
+			sm.userParams.CommonExtendedNegotiation,
+			sm.userParams.ExtraPresentationContexts)
+		if err != nil {
+			// The request can't be encoded, e.g., it has too many
+			// presentation contexts. Report why the association
+			// failed, then close the connection.
+			vlog.Errorf("%s: %v; closing connection %v", sm.label, err, sm.conn)
+			sm.upcallCh <- upcallEvent{eventType: upcallEventAbort, err: err}
+			sm.conn.Close()
+			sm.errorCh <- stateEvent{event: evt17, err: err}
+			return sta05
+		}
 		pdu := &pdu.A_ASSOCIATE{
 			Type:            pdu.PDUTypeA_ASSOCIATE_RQ,
 			ProtocolVersion: pdu.CurrentProtocolVersion,
@@ -184,6 +199,7 @@ var actionAe3 = &stateAction{"AE-3", "Issue A-ASSOCIATE confirmation (accept) pr
 		stopTimer(sm)
 		v := event.pdu.(*pdu.A_ASSOCIATE)
 		doassert(v.Type == pdu.PDUTypeA_ASSOCIATE_AC)
+		logNegotiation(sm, "received", v)
 		err := sm.contextManager.onAssociateResponse(v.Items)
 		if err == nil {
 			sm.upcallCh <- upcallEvent{
@@ -199,6 +215,12 @@ var actionAe3 = &stateAction{"AE-3", "Issue A-ASSOCIATE confirmation (accept) pr
 
 var actionAe4 = &stateAction{"AE-4", "Issue A-ASSOCIATE confirmation (reject) primitive and close transport connection",
 	func(sm *stateMachine, event stateEvent) stateType {
+		logNegotiation(sm, "received", event.pdu)
+		rj := event.pdu.(*pdu.A_ASSOCIATE_RJ)
+		sm.upcallCh <- upcallEvent{
+			eventType: upcallEventAbort,
+			err:       &Rejection{Result: rj.Result, Source: rj.Source, Reason: rj.Reason},
+		}
 		closeConnection(sm)
 		return sta01
 	}}
@@ -229,6 +251,7 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 	func(sm *stateMachine, event stateEvent) stateType {
 		stopTimer(sm)
 		v := event.pdu.(*pdu.A_ASSOCIATE)
+		logNegotiation(sm, "received", v)
 		if v.ProtocolVersion != 0x0001 {
 			vlog.Infof("%s: Wrong remote protocol version 0x%x", sm.label, v.ProtocolVersion)
 			rj := pdu.A_ASSOCIATE_RJ{Result: 1, Source: 2, Reason: 2}
@@ -236,15 +259,35 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 			startTimer(sm)
 			return sta13
 		}
-		responses, err := sm.contextManager.onAssociateRequest(v.Items)
-		if err != nil {
-			// TODO(saito) set proper error code.
-			sm.downcallCh <- stateEvent{
-				event: evt08,
-				pdu: &pdu.A_ASSOCIATE_RJ{
+		// AE titles are space-padded to 16 bytes on the wire. The padding
+		// is not significant. P3.5 6.2.
+		sm.contextManager.callingAETitle = strings.TrimSpace(v.CallingAETitle)
+		sm.contextManager.calledAETitle = strings.TrimSpace(v.CalledAETitle)
+		var responses []pdu.SubItem
+		rejection := rateLimitAssociation(sm)
+		if rejection == nil {
+			var err error
+			responses, err = sm.contextManager.onAssociateRequest(v.Items, sm.providerParams.QRExtendedNegotiation,
+				sm.providerParams.AcceptTransferSyntax)
+			if err != nil {
+				// TODO(saito) set proper error code.
+				rejection = &Rejection{
 					Result: pdu.ResultRejectedPermanent,
 					Source: pdu.SourceULServiceProviderACSE,
 					Reason: 1,
+				}
+			} else {
+				rejection = acceptAssociation(sm)
+			}
+		}
+		if rejection != nil {
+			vlog.Infof("%s: Rejecting association from AE '%s': %v", sm.label, sm.contextManager.callingAETitle, rejection)
+			sm.downcallCh <- stateEvent{
+				event: evt08,
+				pdu: &pdu.A_ASSOCIATE_RJ{
+					Result: rejection.Result,
+					Source: rejection.Source,
+					Reason: rejection.Reason,
 				},
 			}
 		} else {
@@ -264,6 +307,26 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 		}
 		return sta03
 	}}
+
+// Run ServiceProviderParams.RateLimitPerAE, if any, on the calling AE title.
+// Returns nil if the association is within the limit.
+func rateLimitAssociation(sm *stateMachine) *Rejection {
+	if sm.providerParams.RateLimitPerAE == nil {
+		return nil
+	}
+	return sm.providerParams.RateLimitPerAE(sm.contextManager.callingAETitle)
+}
+
+// Run ServiceProviderParams.AcceptAssociation, if any, on the negotiated
+// association. Returns nil if the association is acceptable.
+func acceptAssociation(sm *stateMachine) *Rejection {
+	if sm.providerParams.AcceptAssociation == nil {
+		return nil
+	}
+	return sm.providerParams.AcceptAssociation(sm.contextManager.callingAETitle,
+		sm.contextManager.calledAETitle, sm.contextManager.acceptedContexts())
+}
+
 var actionAe7 = &stateAction{"AE-7", "Send A-ASSOCIATE-AC PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 		sendPDU(sm, event.pdu.(*pdu.A_ASSOCIATE))
@@ -281,19 +344,36 @@ var actionAe8 = &stateAction{"AE-8", "Send A-ASSOCIATE-RJ PDU and start ARTIM ti
 		return sta13
 	}}
 
+// Compute the max size of a PDV payload that fits in a P_DATA_TF PDU, given the
+// maximum length that the peer advertised in A-ASSOCIATE.
+func maxPDVPayloadSize(peerMaxPDUSize int) int {
+	// Zero means that the peer imposes no limit. P3.8 D.1.1. Use our own
+	// default then.
+	if peerMaxPDUSize == 0 {
+		peerMaxPDUSize = DefaultMaxPDUSize
+	}
+	// two byte header overhead.
+	//
+	// TODO(saito) move the magic number elsewhere.
+	return peerMaxPDUSize - 8
+}
+
 // Produce a list of P_DATA_TF PDUs that collective store "data".
-func splitDataIntoPDUs(sm *stateMachine, abstractSyntaxName string, command bool, data []byte) []pdu.P_DATA_TF {
+func splitDataIntoPDUs(sm *stateMachine, payload *stateEventDIMSEPayload, command bool, data []byte) []pdu.P_DATA_TF {
 	doassert(len(data) > 0)
-	context, err := sm.contextManager.lookupByAbstractSyntaxUID(abstractSyntaxName)
+	var context contextManagerEntry
+	var err error
+	if payload.contextID != 0 {
+		context, err = sm.contextManager.lookupByContextID(payload.contextID)
+	} else {
+		context, err = sm.contextManager.lookupByAbstractSyntaxUID(payload.abstractSyntaxName)
+	}
 	if err != nil {
 		// TODO(saito) Don't crash here.
-		vlog.Fatalf("%s: Illegal syntax name %s: %s", sm.label, dicomuid.UIDString(abstractSyntaxName), err)
+		vlog.Fatalf("%s: Illegal syntax name %s: %s", sm.label, dicomuid.UIDString(payload.abstractSyntaxName), err)
 	}
 	var pdus []pdu.P_DATA_TF
-	// two byte header overhead.
-	//
-	// TODO(saito) move the magic number elsewhere.
-	var maxChunkSize = sm.contextManager.peerMaxPDUSize - 8
+	maxChunkSize := maxPDVPayloadSize(sm.contextManager.peerMaxPDUSize)
 	for len(data) > 0 {
 		chunkSize := len(data)
 		if chunkSize > maxChunkSize {
@@ -327,38 +407,49 @@ var actionDt1 = &stateAction{"DT-1", "Send P-DATA-TF PDU",
 			vlog.Fatalf("Failed to encode DIMSE cmd %v: %v", command, e.Error())
 		}
 		vlog.Infof("Send DIMSE msg: %v", command)
-		pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, e.Bytes())
-		for _, pdu := range pdus {
-			sendPDU(sm, &pdu)
-		}
+		pdus := splitDataIntoPDUs(sm, event.dimsePayload, true /*command*/, e.Bytes())
 		if command.HasData() {
 			vlog.Infof("Send DIMSE data of %db, command: %v", len(event.dimsePayload.data), command)
-			pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
-			for _, pdu := range pdus {
-				sendPDU(sm, &pdu)
-			}
+			pdus = append(pdus, splitDataIntoPDUs(sm, event.dimsePayload, false /*data*/, event.dimsePayload.data)...)
 		} else if len(event.dimsePayload.data) > 0 {
 			vlog.Fatalf("Found DIMSE data of %db, command: %v", len(event.dimsePayload.data), command)
 		}
+		sendDIMSEPDUs(sm, command, pdus)
 		return sta06
 	}}
 
 var actionDt2 = &stateAction{"DT-2", "Send P-DATA indication primitive",
 	func(sm *stateMachine, event stateEvent) stateType {
-		contextID, command, data, err := sm.commandAssembler.AddDataPDU(event.pdu.(*pdu.P_DATA_TF))
+		pdata := event.pdu.(*pdu.P_DATA_TF)
+		for _, item := range pdata.Items {
+			sm.bytesReceived += int64(len(item.Value))
+		}
+		if limit := sm.providerParams.MaxBytesPerAssociation; limit > 0 && sm.bytesReceived > limit {
+			err := fmt.Errorf("Association received %d bytes, exceeding the limit of %d bytes", sm.bytesReceived, limit)
+			vlog.Errorf("%s: %v; aborting", sm.label, err)
+			sm.upcallCh <- upcallEvent{eventType: upcallEventAbort, err: err}
+			return actionAa8.Callback(sm, event)
+		}
+		contextID, command, data, err := sm.commandAssembler.AddDataPDU(pdata)
+		// The PDU may carry more than one message.
+		for err == nil && command != nil { // All fragments received
+			vlog.VI(2).Infof("%s: DIMSE request: %v", sm.label, command)
+			sm.upcallCh <- upcallEvent{
+				eventType: upcallEventData,
+				cm:        sm.contextManager,
+				contextID: contextID,
+				command:   command,
+				data:      data}
+			contextID, command, data, err = sm.commandAssembler.NextMessage()
+		}
 		if err == nil {
-			if command != nil { // All fragments received
-				vlog.VI(2).Infof("%s: DIMSE request: %v", sm.label, command)
-				sm.upcallCh <- upcallEvent{
-					eventType: upcallEventData,
-					cm:        sm.contextManager,
-					contextID: contextID,
-					command:   command,
-					data:      data}
-			}
 			return sta06
 		}
-		vlog.Infof("%s: Failed to assemble data: %v", sm.label, err) // TODO(saito)
+		// The peer sent a malformed message. Report the error, then
+		// abort, since the rest of the stream can't be trusted.
+		err = fmt.Errorf("Failed to decode DIMSE message: %v", err)
+		vlog.Errorf("%s: %v; aborting", sm.label, err)
+		sm.upcallCh <- upcallEvent{eventType: upcallEventAbort, err: err}
 		return actionAa8.Callback(sm, event)
 	}}
 
@@ -409,22 +500,35 @@ var actionAr7 = &stateAction{"AR-7", "Issue P-DATA-TF PDU",
 		if e.Error() != nil {
 			vlog.Fatalf("Failed to encode DIMSE cmd %v: %v", command, e.Error())
 		}
-		pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, e.Bytes())
-		for _, pdu := range pdus {
-			sendPDU(sm, &pdu)
-		}
+		pdus := splitDataIntoPDUs(sm, event.dimsePayload, true /*command*/, e.Bytes())
 		if command.HasData() {
-			pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
-			for _, pdu := range pdus {
-				sendPDU(sm, &pdu)
-			}
+			pdus = append(pdus, splitDataIntoPDUs(sm, event.dimsePayload, false /*data*/, event.dimsePayload.data)...)
 		} else {
 			doassert(len(event.dimsePayload.data) == 0)
 		}
+		if err := sendDIMSEPDUs(sm, command, pdus); err != nil {
+			return sta06
+		}
 		sm.downcallCh <- stateEvent{event: evt14}
 		return sta08
 	}}
 
+// P3.8 9.2 lists no P-DATA request (evt09) once the association release has
+// started, except in Sta08, since no data may follow A-RELEASE-RQ. Such a
+// request comes from an operation that raced with Release. Drop it instead of
+// sending it, and report it so that the operation fails with ErrReleased.
+var actionDropPData = &stateAction{"DROP-PDATA", "Discard a P-DATA request issued after A-RELEASE-RQ",
+	func(sm *stateMachine, event stateEvent) stateType {
+		doassert(event.dimsePayload != nil)
+		vlog.Errorf("%s: Dropping %v: the association is being released", sm.label, event.dimsePayload.command)
+		sm.upcallCh <- upcallEvent{
+			eventType: upcallEventDropped,
+			command:   event.dimsePayload.command,
+			err:       ErrReleased,
+		}
+		return sm.currentState
+	}}
+
 var actionAr8 = &stateAction{"AR-8", "Issue A-RELEASE indication (release collision): if association-requestor, next state is Sta09, if not next state is Sta10",
 	func(sm *stateMachine, event stateEvent) stateType {
 		if sm.isUser {
@@ -466,6 +570,12 @@ var actionAa2 = &stateAction{"AA-2", "Stop ARTIM timer if running. Close transpo
 
 var actionAa3 = &stateAction{"AA-3", "If (service-user initiated abort): issue A-ABORT indication and close transport connection, otherwise (service-dul initiated abort): issue A-P-ABORT indication and close transport connection",
 	func(sm *stateMachine, event stateEvent) stateType {
+		if abort, ok := event.pdu.(*pdu.A_ABORT); ok {
+			sm.upcallCh <- upcallEvent{
+				eventType: upcallEventAbort,
+				err:       &AbortError{Source: abort.Source, Reason: abort.Reason},
+			}
+		}
 		closeConnection(sm)
 		return sta01
 	}}
@@ -504,8 +614,18 @@ type upcallEventType int
 const (
 	upcallEventHandshakeCompleted = upcallEventType(100)
 	upcallEventData               = upcallEventType(101)
-	// Note: connection shutdown and any error will result in channel
-	// closure, so they don't have event types.
+	upcallEventAbort              = upcallEventType(102)
+	// A message that we were asked to send was dropped, since the
+	// association is being released. The message is in command, and the
+	// reason in err.
+	upcallEventDropped = upcallEventType(103)
+	// Note: connection shutdown and any other error will result in channel
+	// closure, so they don't have event types. upcallEventAbort is
+	// delivered just before the closure when the association ends
+	// abnormally, with the reason in err: an *AbortError if the peer sends
+	// A-ABORT (AA-3), a *Rejection if it rejects the association (AE-4),
+	// another error if we abort because of the peer's data (DT-2), or the
+	// reason we couldn't send the association request (AE-2).
 )
 
 func (e *upcallEventType) String() string {
@@ -515,6 +635,10 @@ func (e *upcallEventType) String() string {
 		description = "Handshake completed"
 	case upcallEventData:
 		description = "P_DATA_TF PDU received"
+	case upcallEventAbort:
+		description = "Association aborted or rejected"
+	case upcallEventDropped:
+		description = "P_DATA_TF request dropped"
 	default:
 		vlog.Fatalf("Unknown event type %v", int(*e))
 	}
@@ -541,12 +665,21 @@ type upcallEvent struct {
 
 	command dimse.Message
 	data    []byte
+
+	// Set only in upcallEventAbort and upcallEventDropped events.
+	err error
 }
 
 type stateEventDIMSEPayload struct {
 	// The syntax UID of the data to be sent.
 	abstractSyntaxName string
 
+	// If nonzero, the presentation context to send the message on.
+	// Otherwise, the context is looked up by abstractSyntaxName. It must
+	// be set when the peer may have negotiated abstractSyntaxName under
+	// multiple contexts, e.g., for a response to a request.
+	contextID byte
+
 	// Command to send. len(command) may exceed the max PDU size, in which case it
 	// will be split into multiple PresentationDataValueItems.
 	command dimse.Message
@@ -640,6 +773,7 @@ var stateTransitions = []stateTransition{
 	stateTransition{sta07, evt03, actionAa8},
 	stateTransition{sta07, evt04, actionAa8},
 	stateTransition{sta07, evt06, actionAa8},
+	stateTransition{sta07, evt09, actionDropPData},
 	stateTransition{sta07, evt10, actionAr6},
 	stateTransition{sta07, evt12, actionAr8},
 	stateTransition{sta07, evt13, actionAr3},
@@ -662,6 +796,7 @@ var stateTransitions = []stateTransition{
 	stateTransition{sta09, evt03, actionAa8},
 	stateTransition{sta09, evt04, actionAa8},
 	stateTransition{sta09, evt06, actionAa8},
+	stateTransition{sta09, evt09, actionDropPData},
 	stateTransition{sta09, evt10, actionAa8},
 	stateTransition{sta09, evt12, actionAa8},
 	stateTransition{sta09, evt13, actionAa8},
@@ -673,6 +808,7 @@ var stateTransitions = []stateTransition{
 	stateTransition{sta10, evt03, actionAa8},
 	stateTransition{sta10, evt04, actionAa8},
 	stateTransition{sta10, evt06, actionAa8},
+	stateTransition{sta10, evt09, actionDropPData},
 	stateTransition{sta10, evt10, actionAa8},
 	stateTransition{sta10, evt12, actionAa8},
 	stateTransition{sta10, evt13, actionAr10},
@@ -683,6 +819,7 @@ var stateTransitions = []stateTransition{
 	stateTransition{sta11, evt03, actionAa8},
 	stateTransition{sta11, evt04, actionAa8},
 	stateTransition{sta11, evt06, actionAa8},
+	stateTransition{sta11, evt09, actionDropPData},
 	stateTransition{sta11, evt10, actionAa8},
 	stateTransition{sta11, evt12, actionAa8},
 	stateTransition{sta11, evt13, actionAr3},
@@ -693,6 +830,7 @@ var stateTransitions = []stateTransition{
 	stateTransition{sta12, evt03, actionAa8},
 	stateTransition{sta12, evt04, actionAa8},
 	stateTransition{sta12, evt06, actionAa8},
+	stateTransition{sta12, evt09, actionDropPData},
 	stateTransition{sta12, evt10, actionAa8},
 	stateTransition{sta12, evt12, actionAa8},
 	stateTransition{sta12, evt13, actionAa8},
@@ -728,6 +866,9 @@ type stateMachine struct {
 	// userParams is set only for a client-side statemachine
 	userParams ServiceUserParams
 
+	// providerParams is set only for a server-side statemachine
+	providerParams ServiceProviderParams
+
 	// Manages mappings between one-byte contextID to the
 	// <abstractsyntaxUID, transfersyntaxuid> pair.  Filled during A_ACCEPT
 	// handshake.
@@ -758,6 +899,10 @@ type stateMachine struct {
 	// For assembling DIMSE command from multiple P_DATA_TF fragments.
 	commandAssembler dimse.CommandAssembler
 
+	// Total size of the PDVs received in P_DATA_TF PDUs. Checked against
+	// ServiceProviderParams.MaxBytesPerAssociation.
+	bytesReceived int64
+
 	// Only for testing.
 	faults *FaultInjector
 }
@@ -768,14 +913,16 @@ func closeConnection(sm *stateMachine) {
 	sm.conn.Close()
 }
 
-func sendPDU(sm *stateMachine, v pdu.PDU) {
+// Send a PDU to the peer. On error, it closes the connection, queues evt17,
+// and returns the error.
+func sendPDU(sm *stateMachine, v pdu.PDU) error {
 	doassert(sm.conn != nil)
 	data, err := pdu.EncodePDU(v)
 	if err != nil {
 		vlog.Infof("%s: Failed to encode: %v; closing connection %v", sm.label, err, sm.conn)
 		sm.conn.Close()
 		sm.errorCh <- stateEvent{event: evt17, err: err}
-		return
+		return err
 	}
 	if sm.faults != nil {
 		action := sm.faults.onSend(data)
@@ -788,10 +935,29 @@ func sendPDU(sm *stateMachine, v pdu.PDU) {
 	if n != len(data) || err != nil {
 		vlog.Infof("%s: Failed to write %d bytes. Actual %d bytes : %v; closing connection %v", sm.label, len(data), n, err, sm.conn)
 		sm.conn.Close()
+		if err == nil {
+			err = io.ErrShortWrite
+		}
 		sm.errorCh <- stateEvent{event: evt17, err: err}
-		return
+		return err
 	}
 	vlog.VI(2).Infof("%s: sendPDU: %v", sm.label, v.String())
+	logNegotiation(sm, "sent", v)
+	return nil
+}
+
+// Send "pdus", which carry "command" and its data. It stops at the first error:
+// the connection is gone, most likely because the peer aborted, and writing
+// the rest would just fail. The reason is reported by the event queued by
+// sendPDU or the network reader.
+func sendDIMSEPDUs(sm *stateMachine, command dimse.Message, pdus []pdu.P_DATA_TF) error {
+	for i := range pdus {
+		if err := sendPDU(sm, &pdus[i]); err != nil {
+			vlog.Infof("%s: Dropping %d of %d PDUs for %v: %v", sm.label, len(pdus)-i, len(pdus), command, err)
+			return err
+		}
+	}
+	return nil
 }
 
 func startTimer(sm *stateMachine) {
@@ -853,7 +1019,14 @@ func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smNa
 			continue
 		case *pdu.A_ABORT:
 			ch <- stateEvent{event: evt16, pdu: n, err: nil}
-			continue
+			// Nothing more will arrive from the peer. Closing the
+			// connection here unblocks a concurrent write in
+			// sendPDU, which would otherwise hang until TCP times
+			// out if the peer has stopped reading.
+			conn.Close()
+			close(ch)
+			vlog.VI(2).Infof("%s: Exiting network reader after A_ABORT", smName)
+			return
 		default:
 			err := fmt.Errorf("%s: Unknown PDU type: %v", v.String(), smName)
 			ch <- stateEvent{event: evt19, pdu: v, err: err}
@@ -867,6 +1040,16 @@ func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smNa
 func getNextEvent(sm *stateMachine) stateEvent {
 	var ok bool
 	var event stateEvent
+	// Deliver the pending events from the peer first. When an A-ABORT
+	// arrives in the middle of a write, the write fails only after evt16 is
+	// queued, and we want to act on the abort rather than on the write error.
+	select {
+	case event, ok = <-sm.netCh:
+		if !ok {
+			sm.netCh = nil
+		}
+	default:
+	}
 	for event.event == 0 {
 		select {
 		case event, ok = <-sm.netCh:
@@ -934,18 +1117,18 @@ func runStateMachineForServiceUser(
 	downcallCh chan stateEvent) {
 	doassert(params.CallingAETitle != "")
 	doassert(len(params.RequiredServices) > 0)
-	doassert(len(params.SupportedTransferSyntaxes) > 0)
 	label := fmt.Sprintf("sm(u)-%d", atomic.AddInt32(&smSeq, 1))
 	sm := &stateMachine{
-		label:          label,
-		isUser:         true,
-		contextManager: newContextManager(label),
-		userParams:     params,
-		netCh:          make(chan stateEvent, 128),
-		errorCh:        make(chan stateEvent, 128),
-		downcallCh:     downcallCh,
-		upcallCh:       upcallCh,
-		faults:         getUserFaultInjector(),
+		label:            label,
+		isUser:           true,
+		contextManager:   newContextManager(label),
+		userParams:       params,
+		commandAssembler: dimse.CommandAssembler{Strict: params.StrictPDataTF},
+		netCh:            make(chan stateEvent, 128),
+		errorCh:          make(chan stateEvent, 128),
+		downcallCh:       downcallCh,
+		upcallCh:         upcallCh,
+		faults:           getUserFaultInjector(),
 	}
 	event := stateEvent{event: evt01}
 	action := findAction(sta01, &event, sm.label)
@@ -958,19 +1141,22 @@ func runStateMachineForServiceUser(
 
 func runStateMachineForServiceProvider(
 	conn net.Conn,
+	params ServiceProviderParams,
 	upcallCh chan upcallEvent,
 	downcallCh chan stateEvent) {
 	label := fmt.Sprintf("sm(p)-%d", atomic.AddInt32(&smSeq, 1))
 	sm := &stateMachine{
-		label:          label,
-		isUser:         false,
-		contextManager: newContextManager(label),
-		conn:           conn,
-		netCh:          make(chan stateEvent, 128),
-		errorCh:        make(chan stateEvent, 128),
-		downcallCh:     downcallCh,
-		upcallCh:       upcallCh,
-		faults:         getProviderFaultInjector(),
+		label:            label,
+		isUser:           false,
+		contextManager:   newContextManager(label),
+		providerParams:   params,
+		commandAssembler: dimse.CommandAssembler{Strict: params.StrictPDataTF, MaxSequenceDepth: params.MaxSequenceDepth},
+		conn:             conn,
+		netCh:            make(chan stateEvent, 128),
+		errorCh:          make(chan stateEvent, 128),
+		downcallCh:       downcallCh,
+		upcallCh:         upcallCh,
+		faults:           getProviderFaultInjector(),
 	}
 	event := stateEvent{event: evt05, conn: conn}
 	action := findAction(sta01, &event, sm.label)
@@ -0,0 +1,222 @@
+package netdicom
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/yasushi-saito/go-dicom/dicomuid"
+	"github.com/yasushi-saito/go-netdicom/dimse"
+	"github.com/yasushi-saito/go-netdicom/pdu"
+	"github.com/yasushi-saito/go-netdicom/sopclass"
+)
+
+func TestSplitDataIntoPDUsUnlimitedPeerMaxPDUSize(t *testing.T) {
+	sm := &stateMachine{label: "test", contextManager: newContextManager("test")}
+	addContextMapping(sm.contextManager, dicomuid.VerificationSOPClass, dicomuid.ImplicitVRLittleEndian,
+		1, pdu.PresentationContextAccepted)
+	payload := &stateEventDIMSEPayload{abstractSyntaxName: dicomuid.VerificationSOPClass}
+	data := make([]byte, DefaultMaxPDUSize+100)
+
+	// A peer that advertises zero accepts PDUs of any size, so our own
+	// default applies.
+	sm.contextManager.peerMaxPDUSize = 0
+	pdus := splitDataIntoPDUs(sm, payload, false, data)
+	if len(pdus) != 2 {
+		t.Fatalf("Expect 2 PDUs, got %d", len(pdus))
+	}
+	if n := len(pdus[0].Items[0].Value); n != maxPDVPayloadSize(DefaultMaxPDUSize) {
+		t.Errorf("Wrong first PDU size %d", n)
+	}
+	if pdus[0].Items[0].Last || !pdus[1].Items[0].Last {
+		t.Errorf("Wrong last bits: %v", pdus)
+	}
+
+	sm.contextManager.peerMaxPDUSize = 16384
+	chunkSize := maxPDVPayloadSize(16384)
+	if n := len(splitDataIntoPDUs(sm, payload, false, data)); n != (len(data)+chunkSize-1)/chunkSize {
+		t.Errorf("Wrong number of PDUs: %d", n)
+	}
+}
+
+func TestGenerateAssociateRequestContextIDs(t *testing.T) {
+	var services []sopclass.SOPUID
+	for i := 0; i < maxPresentationContexts; i++ {
+		services = append(services, sopclass.SOPUID{Name: "test", UID: fmt.Sprintf("1.2.3.%d", i)})
+	}
+	items, err := newContextManager("test").generateAssociateRequest(
+		services, []string{dicomuid.ImplicitVRLittleEndian}, QRExtendedNegotiation{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[byte]bool)
+	for _, item := range items {
+		if c, ok := item.(*pdu.PresentationContextItem); ok {
+			if c.ContextID%2 != 1 || seen[c.ContextID] {
+				t.Errorf("Invalid or duplicate context ID %d", c.ContextID)
+			}
+			seen[c.ContextID] = true
+		}
+	}
+	if len(seen) != maxPresentationContexts {
+		t.Errorf("Expect %d contexts, got %d", maxPresentationContexts, len(seen))
+	}
+
+	// One more context would need a 129th ID.
+	if _, err := newContextManager("test").generateAssociateRequest(
+		services[:len(services)-1], []string{dicomuid.ImplicitVRLittleEndian}, QRExtendedNegotiation{}, nil,
+		[]PresentationContext{{"1.2.4", []string{dicomuid.ImplicitVRLittleEndian}}, {"1.2.5", []string{dicomuid.ImplicitVRLittleEndian}}}); err == nil {
+		t.Error("Expect an error for 129 contexts")
+	}
+}
+
+func TestNegotiationLines(t *testing.T) {
+	items, err := newContextManager("test").generateAssociateRequest(
+		sopclass.VerificationClasses, []string{dicomuid.ImplicitVRLittleEndian}, QRExtendedNegotiation{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq := &pdu.A_ASSOCIATE{
+		Type:            pdu.PDUTypeA_ASSOCIATE_RQ,
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "called",
+		CallingAETitle:  "calling",
+		Items:           items,
+	}
+	// Implicit VR LE would always be accepted, so propose only explicit VR
+	// LE to get a rejected context.
+	explicitItems := []pdu.SubItem{
+		&pdu.PresentationContextItem{
+			Type:      pdu.ItemTypePresentationContextRequest,
+			ContextID: 1,
+			Items: []pdu.SubItem{
+				&pdu.AbstractSyntaxSubItem{Name: dicomuid.VerificationSOPClass},
+				&pdu.TransferSyntaxSubItem{Name: dicomuid.ExplicitVRLittleEndian},
+			}},
+	}
+	responses, err := newContextManager("test").onAssociateRequest(explicitItems, QRExtendedNegotiation{},
+		func(sopClassUID, transferSyntaxUID string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := &pdu.A_ASSOCIATE{
+		Type:            pdu.PDUTypeA_ASSOCIATE_AC,
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "called",
+		CallingAETitle:  "calling",
+		Items:           responses,
+	}
+	rj := &pdu.A_ASSOCIATE_RJ{
+		Result: pdu.ResultRejectedTransient,
+		Source: pdu.SourceULServiceProviderPresentation,
+		Reason: pdu.ReasonTemporaryCongestion,
+	}
+	for _, test := range []struct {
+		v    pdu.PDU
+		want []string
+	}{
+		{rq, []string{
+			"A-ASSOCIATE-RQ: called AE 'called', calling AE 'calling', protocol version 1",
+			"  presentation context 1: proposed",
+			"    abstract syntax: " + dicomuid.UIDString(dicomuid.VerificationSOPClass),
+			"    transfer syntax: " + dicomuid.UIDString(dicomuid.ImplicitVRLittleEndian),
+			"  user information:",
+			fmt.Sprintf("    maximum PDU length: %d", DefaultMaxPDUSize),
+		}},
+		{ac, []string{
+			"A-ASSOCIATE-AC: called AE 'called', calling AE 'calling', protocol version 1",
+			"  presentation context 1: " + pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported.String(),
+		}},
+		{rj, []string{
+			"A-ASSOCIATE-RJ: result transient, source service provider (presentation), reason 1",
+		}},
+	} {
+		lines := negotiationLines(test.v)
+		for _, want := range test.want {
+			found := false
+			for _, line := range lines {
+				if line == want {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("Line %q not found in %q", want, lines)
+			}
+		}
+	}
+}
+
+func TestDefaultTransferSyntax(t *testing.T) {
+	items, err := newContextManager("test").generateAssociateRequest(
+		sopclass.VerificationClasses, []string{dicomuid.ExplicitVRLittleEndian}, QRExtendedNegotiation{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var proposed []string
+	for _, item := range items {
+		if c, ok := item.(*pdu.PresentationContextItem); ok {
+			for _, subItem := range c.Items {
+				if s, ok := subItem.(*pdu.TransferSyntaxSubItem); ok {
+					proposed = append(proposed, s.Name)
+				}
+			}
+		}
+	}
+	if !stringListContains(proposed, dicomuid.ImplicitVRLittleEndian) {
+		t.Errorf("Implicit VR LE not proposed in %v", proposed)
+	}
+
+	// A context without any transfer syntax is rejected, but doesn't fail
+	// the association.
+	responses, err := newContextManager("test").onAssociateRequest([]pdu.SubItem{
+		&pdu.PresentationContextItem{
+			Type:      pdu.ItemTypePresentationContextRequest,
+			ContextID: 1,
+			Items: []pdu.SubItem{
+				&pdu.AbstractSyntaxSubItem{Name: dicomuid.VerificationSOPClass},
+			}},
+	}, QRExtendedNegotiation{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range responses {
+		if c, ok := item.(*pdu.PresentationContextItem); ok {
+			if c.Result != pdu.PresentationContextProviderRejectionTransferSyntaxNotSupported {
+				t.Errorf("Context without transfer syntax: %v", c.Result)
+			}
+		}
+	}
+}
+
+// A request issued after A-RELEASE-RQ is dropped, and the operation that
+// issued it fails with ErrReleased instead of waiting for the association to
+// close.
+func TestDropPDataAfterRelease(t *testing.T) {
+	params, err := NewServiceUserParams("test", "test", sopclass.VerificationClasses, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	su := NewServiceUser(params)
+	cs := su.createCommand(5, "")
+	sm := &stateMachine{label: "test", currentState: sta07, upcallCh: make(chan upcallEvent, 1)}
+	next := actionDropPData.Callback(sm, stateEvent{
+		event: evt09,
+		dimsePayload: &stateEventDIMSEPayload{
+			abstractSyntaxName: dicomuid.VerificationSOPClass,
+			command:            &dimse.C_ECHO_RQ{MessageID: 5, CommandDataSetType: dimse.CommandDataSetTypeNull},
+		},
+	})
+	if next != sta07 {
+		t.Errorf("Got state %v, expect %v", next, sta07)
+	}
+	event := <-sm.upcallCh
+	if event.eventType != upcallEventDropped || event.err != ErrReleased {
+		t.Fatalf("Wrong upcall: %v %v", event.eventType, event.err)
+	}
+	su.failCommand(event.command, event.err)
+	if _, ok := <-cs.upcallCh; ok {
+		t.Fatal("The command is still waiting for a response")
+	}
+	if err := su.closedError(cs, "closed"); err != ErrReleased {
+		t.Errorf("Got %v, expect ErrReleased", err)
+	}
+}
@@ -0,0 +1,161 @@
+package netdicom
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yasushi-saito/go-netdicom/dimse"
+	"github.com/yasushi-saito/go-netdicom/sopclass"
+)
+
+// AssociationSummary describes an association that a ServiceProvider served,
+// and the C-STORE traffic that it received. It is passed to
+// ServiceProviderParams.OnAssociationClose, and returned by
+// RunProviderForConn.
+type AssociationSummary struct {
+	CallingAETitle string
+	CalledAETitle  string
+
+	// Presentation contexts accepted during the handshake, in the order of
+	// their IDs. TransferSyntaxUIDs lists the one syntax picked.
+	AcceptedContexts []PresentationContext
+
+	// Number of DIMSE requests received, keyed by the service name, e.g.,
+	// "C-STORE".
+	Operations map[string]int
+
+	// Total size of the datasets received with DIMSE messages, e.g.,
+	// C-STORE payloads and query identifiers.
+	BytesReceived int64
+
+	// Start is when the handshake completed. End is when the association
+	// was released or aborted.
+	Start, End time.Time
+
+	// Number of C-STOREs that succeeded (possibly with a warning), and their
+	// total payload size.
+	NumInstances int
+	NumBytes     int64
+
+	// Number of successful C-STOREs, keyed by SOP class UID.
+	PerSOPClass map[string]int
+
+	// Number of C-STOREs that the CStore callback failed, or that arrived
+	// when no CStore callback was set.
+	NumFailures int
+
+	// Number of C-STOREs of an instance already stored on the association,
+	// which ServiceProviderParams.DuplicateInstancePolicy kept from the
+	// CStore callback. They count in neither NumInstances nor NumFailures.
+	NumDuplicates int
+
+	// Non-nil if the association was aborted, rather than released.
+	Err error
+}
+
+// Duration returns the lifetime of the association.
+func (s AssociationSummary) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// String produces a one-line description of the summary, e.g., "received 342
+// instances (CT:200 MR:142), 1.2 GB in 48s from AE=SCANNER01".
+func (s AssociationSummary) String() string {
+	type classCount struct {
+		name string
+		n    int
+	}
+	var counts []classCount
+	for uid, n := range s.PerSOPClass {
+		counts = append(counts, classCount{sopClassShortName(uid), n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].n != counts[j].n {
+			return counts[i].n > counts[j].n
+		}
+		return counts[i].name < counts[j].name
+	})
+	var breakdown []string
+	for _, c := range counts {
+		breakdown = append(breakdown, fmt.Sprintf("%s:%d", c.name, c.n))
+	}
+	str := fmt.Sprintf("received %d instances", s.NumInstances)
+	if len(breakdown) > 0 {
+		str += " (" + strings.Join(breakdown, " ") + ")"
+	}
+	str += fmt.Sprintf(", %s in %v from AE=%s", formatByteSize(s.NumBytes),
+		s.Duration()/time.Second*time.Second, s.CallingAETitle)
+	if s.NumFailures > 0 {
+		str += fmt.Sprintf(", %d failed", s.NumFailures)
+	}
+	if s.NumDuplicates > 0 {
+		str += fmt.Sprintf(", %d duplicates", s.NumDuplicates)
+	}
+	if s.Err != nil {
+		str += fmt.Sprintf(", aborted: %v", s.Err)
+	}
+	return str
+}
+
+// Record a DIMSE message received. "name" is the service name of a request, or
+// "" for other messages.
+func (s *AssociationSummary) addMessage(name string, dataSize int) {
+	s.BytesReceived += int64(dataSize)
+	if name == "" {
+		return
+	}
+	if s.Operations == nil {
+		s.Operations = make(map[string]int)
+	}
+	s.Operations[name]++
+}
+
+// Record the outcome of a C-STORE request.
+func (s *AssociationSummary) addCStore(sopClassUID string, size int, status dimse.Status) {
+	if isFailureStatus(status) {
+		s.NumFailures++
+		return
+	}
+	if s.PerSOPClass == nil {
+		s.PerSOPClass = make(map[string]int)
+	}
+	s.NumInstances++
+	s.NumBytes += int64(size)
+	s.PerSOPClass[sopClassUID]++
+}
+
+// Checks if the status of a DIMSE response reports a failure, as opposed to
+// success, a warning, a pending response, or a cancellation. A status code of
+// unknown category counts as a failure.
+func isFailureStatus(status dimse.Status) bool {
+	return status.IsFailure() || status.IsUnknown()
+}
+
+// Produce an abbreviated name of a storage SOP class, e.g., "CT" for
+// CTImageStorage. Returns the UID itself for an unknown class.
+func sopClassShortName(uid string) string {
+	for _, sop := range sopclass.StorageClasses {
+		if sop.UID == uid {
+			name := strings.TrimSuffix(sop.Name, "Storage")
+			return strings.TrimSuffix(name, "Image")
+		}
+	}
+	return uid
+}
+
+func formatByteSize(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	v, suffix := float64(n)/unit, "KB"
+	for _, larger := range []string{"MB", "GB"} {
+		if v < unit {
+			break
+		}
+		v, suffix = v/unit, larger
+	}
+	return fmt.Sprintf("%.1f %s", v, suffix)
+}
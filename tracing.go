@@ -0,0 +1,104 @@
+package netdicom
+
+// Hooks for distributed tracing of associations and DIMSE operations.
+
+import (
+	"fmt"
+
+	"github.com/yasushi-saito/go-netdicom/dimse"
+)
+
+// Span is an opaque handle created by Tracer.StartSpan.
+type Span interface{}
+
+// Tracer receives the start and the end of associations and DIMSE operations,
+// so that they can be reported to a tracing system such as OpenTelemetry. Set
+// it in ServiceUserParams.Tracer or ServiceProviderParams.Tracer.
+//
+// Span names are "association" for an association, and the DIMSE service name,
+// e.g., "C-STORE", for an operation. An association span starts with
+// attributes "dicom.calling_ae" and "dicom.called_ae". An operation span starts
+// with "dicom.sop_class_uid" and "dicom.message_id", and it ends with
+// "dicom.status" (e.g., "0x0000") if the final status is known.
+//
+// The methods may be called concurrently.
+type Tracer interface {
+	// StartSpan starts a span. "parent" is the span of the enclosing
+	// association for an operation, or nil for an association.
+	StartSpan(parent Span, name string, attrs map[string]string) Span
+
+	// EndSpan ends a span returned by StartSpan. err is non-nil if the
+	// association was aborted, or the operation failed.
+	EndSpan(span Span, attrs map[string]string, err error)
+}
+
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(parent Span, name string, attrs map[string]string) Span { return nil }
+func (noopTracer) EndSpan(span Span, attrs map[string]string, err error)            {}
+
+func tracerOrNoop(t Tracer) Tracer {
+	if t == nil {
+		return noopTracer{}
+	}
+	return t
+}
+
+func associationSpanAttrs(callingAETitle, calledAETitle string) map[string]string {
+	return map[string]string{
+		"dicom.calling_ae": callingAETitle,
+		"dicom.called_ae":  calledAETitle,
+	}
+}
+
+func operationSpanAttrs(sopClassUID string, messageID uint16) map[string]string {
+	return map[string]string{
+		"dicom.sop_class_uid": sopClassUID,
+		"dicom.message_id":    fmt.Sprintf("%d", messageID),
+	}
+}
+
+func statusSpanAttrs(status dimse.Status) map[string]string {
+	return map[string]string{"dicom.status": fmt.Sprintf("0x%04x", uint16(status.Status))}
+}
+
+// Return the DIMSE service name of a request or response, e.g., "C-STORE".
+func dimseServiceName(msg dimse.Message) string {
+	switch msg.(type) {
+	case *dimse.C_STORE_RQ, *dimse.C_STORE_RSP:
+		return "C-STORE"
+	case *dimse.C_FIND_RQ, *dimse.C_FIND_RSP:
+		return "C-FIND"
+	case *dimse.C_MOVE_RQ, *dimse.C_MOVE_RSP:
+		return "C-MOVE"
+	case *dimse.C_GET_RQ, *dimse.C_GET_RSP:
+		return "C-GET"
+	case *dimse.C_ECHO_RQ, *dimse.C_ECHO_RSP:
+		return "C-ECHO"
+	case *dimse.C_CANCEL_RQ:
+		return "C-CANCEL"
+	case *dimse.N_GET_RQ, *dimse.N_GET_RSP:
+		return "N-GET"
+	}
+	return fmt.Sprintf("%T", msg)
+}
+
+// Extract the status from a DIMSE response. Returns false if msg is not a
+// response.
+func responseStatus(msg dimse.Message) (dimse.Status, bool) {
+	switch v := msg.(type) {
+	case *dimse.C_STORE_RSP:
+		return v.Status, true
+	case *dimse.C_FIND_RSP:
+		return v.Status, true
+	case *dimse.C_MOVE_RSP:
+		return v.Status, true
+	case *dimse.C_GET_RSP:
+		return v.Status, true
+	case *dimse.C_ECHO_RSP:
+		return v.Status, true
+	case *dimse.N_GET_RSP:
+		return v.Status, true
+	}
+	return dimse.Status{}, false
+}
@@ -0,0 +1,97 @@
+package netdicom
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/yasushi-saito/go-dicom/dicomio"
+	"github.com/yasushi-saito/go-dicom/dicomuid"
+)
+
+// TransferSyntax describes how a dataset is encoded under a transfer syntax.
+// Use ParseTransferSyntax to create one, e.g., from the transferSyntaxUID
+// passed to CStoreCallback.
+type TransferSyntax struct {
+	// UID is the transfer syntax UID as given to ParseTransferSyntax, e.g.,
+	// "1.2.840.10008.1.2.4.50" for JPEG baseline.
+	UID string
+
+	// IsExplicitVR is true if each element carries its VR. It is false only
+	// for Implicit VR Little Endian.
+	IsExplicitVR bool
+
+	// ByteOrder of the binary values. It is BigEndian only for Explicit VR
+	// Big Endian.
+	ByteOrder binary.ByteOrder
+
+	// IsDeflated is true if the dataset is compressed as a whole with
+	// deflate (P3.5 A.5).
+	IsDeflated bool
+
+	// IsEncapsulated is true if the pixel data is compressed, e.g., JPEG,
+	// and stored in fragments (P3.5 A.4). It is false for the native
+	// syntaxes, i.e., the little- and big-endian and deflated ones.
+	IsEncapsulated bool
+}
+
+// ParseTransferSyntax parses a transfer syntax UID. It returns an error if the
+// UID is not a known transfer syntax.
+func ParseTransferSyntax(uid string) (TransferSyntax, error) {
+	// The byte order and VR of an encapsulated syntax are those of its
+	// canonical syntax, Explicit VR Little Endian, but the UID itself tells
+	// whether the dataset is encapsulated or deflated.
+	bo, implicit, err := dicomio.ParseTransferSyntaxUID(uid)
+	if err != nil {
+		return TransferSyntax{}, err
+	}
+	ts := TransferSyntax{
+		UID:          uid,
+		IsExplicitVR: implicit != dicomio.ImplicitVR,
+		ByteOrder:    bo,
+	}
+	switch uid {
+	case dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian, dicomuid.ExplicitVRBigEndian:
+	case dicomuid.DeflatedExplicitVRLittleEndian:
+		ts.IsDeflated = true
+	default:
+		ts.IsEncapsulated = true
+	}
+	return ts, nil
+}
+
+// Value representations defined in P3.5 6.2.
+var knownVRs = map[string]bool{
+	"AE": true, "AS": true, "AT": true, "CS": true, "DA": true, "DS": true,
+	"DT": true, "FD": true, "FL": true, "IS": true, "LO": true, "LT": true,
+	"OB": true, "OD": true, "OF": true, "OL": true, "OV": true, "OW": true,
+	"PN": true, "SH": true, "SL": true, "SQ": true, "SS": true, "ST": true,
+	"SV": true, "TM": true, "UC": true, "UI": true, "UL": true, "UN": true,
+	"UR": true, "US": true, "UT": true, "UV": true,
+}
+
+// CheckDataSetEncoding probes the first element of "data", a dataset without
+// file meta information, e.g., the payload of a C-STORE request, and returns
+// an error if it is obviously not encoded in the transfer syntax. A sender
+// must encode the dataset in the syntax of the presentation context, but a
+// buggy one may send, say, Implicit VR data on an Explicit VR context, and the
+// data would be silently misread.
+//
+// For an explicit VR syntax, the first element must carry a valid VR. Data in
+// Implicit VR Little Endian carries no VR, so it is not checked. Neither is
+// data in the deflated syntax, or data shorter than one element header. Nor is
+// data in a transfer syntax unknown to go-dicom, e.g., a private one, as its
+// encoding can't be told.
+func CheckDataSetEncoding(data []byte, transferSyntaxUID string) error {
+	ts, err := ParseTransferSyntax(transferSyntaxUID)
+	if err != nil {
+		return nil
+	}
+	if !ts.IsExplicitVR || ts.IsDeflated || len(data) < 8 {
+		return nil
+	}
+	if vr := string(data[4:6]); !knownVRs[vr] {
+		return fmt.Errorf("Dataset is not encoded in %s: the first element has VR bytes %q; is it implicit VR?",
+			dicomuid.UIDString(ts.UID), vr)
+	}
+	return nil
+}
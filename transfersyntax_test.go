@@ -0,0 +1,62 @@
+package netdicom_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/yasushi-saito/go-dicom"
+	"github.com/yasushi-saito/go-dicom/dicomio"
+	"github.com/yasushi-saito/go-dicom/dicomuid"
+	"github.com/yasushi-saito/go-netdicom"
+)
+
+func TestParseTransferSyntax(t *testing.T) {
+	for _, test := range []netdicom.TransferSyntax{
+		{UID: dicomuid.ImplicitVRLittleEndian, ByteOrder: binary.LittleEndian},
+		{UID: dicomuid.ExplicitVRLittleEndian, IsExplicitVR: true, ByteOrder: binary.LittleEndian},
+		{UID: dicomuid.ExplicitVRBigEndian, IsExplicitVR: true, ByteOrder: binary.BigEndian},
+		{UID: dicomuid.DeflatedExplicitVRLittleEndian, IsExplicitVR: true, ByteOrder: binary.LittleEndian, IsDeflated: true},
+		{UID: "1.2.840.10008.1.2.4.50", IsExplicitVR: true, ByteOrder: binary.LittleEndian, IsEncapsulated: true}, // JPEG baseline
+	} {
+		ts, err := netdicom.ParseTransferSyntax(test.UID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts != test {
+			t.Errorf("%s: got %+v, want %+v", test.UID, ts, test)
+		}
+	}
+}
+
+func TestCheckDataSetEncoding(t *testing.T) {
+	e := dicomio.NewBytesEncoderWithTransferSyntax(dicomuid.ExplicitVRLittleEndian)
+	dicom.WriteElement(e, dicom.MustNewElement(dicom.TagSOPClassUID, "1.2.840.10008.5.1.4.1.1.2"))
+	dicom.WriteElement(e, dicom.MustNewElement(dicom.TagPatientName, "johndoe"))
+	if err := e.Error(); err != nil {
+		t.Fatal(err)
+	}
+	explicit := e.Bytes()
+	// SOPClassUID (0008,0016) in Implicit VR Little Endian: tag, 4-byte
+	// length, value.
+	implicit := append([]byte{0x08, 0x00, 0x16, 0x00, 0x1a, 0x00, 0x00, 0x00},
+		[]byte("1.2.840.10008.5.1.4.1.1.2\x00")...)
+	for _, test := range []struct {
+		data              []byte
+		transferSyntaxUID string
+		ok                bool
+	}{
+		{implicit, dicomuid.ImplicitVRLittleEndian, true},
+		{explicit, dicomuid.ExplicitVRLittleEndian, true},
+		{explicit, "1.2.840.10008.1.2.4.50", true},
+		{implicit, dicomuid.ExplicitVRLittleEndian, false},
+		{implicit, dicomuid.ExplicitVRBigEndian, false},
+		{implicit, "1.2.840.10008.1.2.4.50", false},
+		{nil, dicomuid.ExplicitVRLittleEndian, true},
+		{implicit, "1.2.3.4.5.6", true}, // Private syntax; not checked.
+	} {
+		err := netdicom.CheckDataSetEncoding(test.data, test.transferSyntaxUID)
+		if (err == nil) != test.ok {
+			t.Errorf("%s, %d bytes: got %v, want ok=%v", test.transferSyntaxUID, len(test.data), err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package netdicom
+
+// Generates UIDs for new objects. P3.5 9.
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// UIDGenerator mints UIDs for new objects, e.g., SOP instances, series, and
+// studies created by a workflow, or UIDs remapped by anonymization. The
+// methods may be called concurrently.
+type UIDGenerator interface {
+	NewUID() string
+}
+
+// UUIDDerivedUIDRoot is the root of UIDs derived from UUIDs (P3.5 B.2). It
+// can be used by organizations that haven't registered their own root.
+const UUIDDerivedUIDRoot = "2.25"
+
+// Maximum length of a UID. P3.5 9.1.
+const maxUIDLength = 64
+
+// A generated UID has at least this many random digits, so that collisions are
+// practically impossible.
+const minUIDRandomDigits = 20
+
+// A UUID is 128 bits, or at most 39 decimal digits.
+const maxUIDRandomDigits = 39
+
+type randomUIDGenerator struct {
+	root  string
+	limit *big.Int // 10^(number of random digits)
+}
+
+// NewUIDGenerator creates a UIDGenerator that produces UIDs of form
+// "<root>.<random number>". The random number fills the UID up to 64
+// characters, but it has at most 39 digits, the size of a UUID. It returns an
+// error if root isn't a valid UID, or is too long to leave room for 20 random
+// digits.
+func NewUIDGenerator(root string) (UIDGenerator, error) {
+	if err := ValidateUID(root); err != nil {
+		return nil, fmt.Errorf("Invalid UID root: %v", err)
+	}
+	digits := maxUIDLength - len(root) - 1
+	if digits < minUIDRandomDigits {
+		return nil, fmt.Errorf("UID root '%s' is too long; it must leave room for %d digits", root, minUIDRandomDigits)
+	}
+	if digits > maxUIDRandomDigits {
+		digits = maxUIDRandomDigits
+	}
+	limit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	return &randomUIDGenerator{root: root, limit: limit}, nil
+}
+
+func (g *randomUIDGenerator) NewUID() string {
+	n, err := rand.Int(rand.Reader, g.limit)
+	if err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	// The decimal form of an integer has no leading zeros.
+	return g.root + "." + n.String()
+}
+
+var defaultUIDGenerator = mustNewUIDGenerator(UUIDDerivedUIDRoot)
+
+func mustNewUIDGenerator(root string) UIDGenerator {
+	g, err := NewUIDGenerator(root)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// ValidateUID checks that uid is a valid DICOM UID: at most 64 characters of
+// dot-separated numeric components, each without leading zeros. P3.5 9.1.
+func ValidateUID(uid string) error {
+	if len(uid) > maxUIDLength {
+		return fmt.Errorf("UID '%s' is longer than %d characters", uid, maxUIDLength)
+	}
+	for _, c := range strings.Split(uid, ".") {
+		if c == "" {
+			return fmt.Errorf("UID '%s' has an empty component", uid)
+		}
+		for _, r := range c {
+			if r < '0' || r > '9' {
+				return fmt.Errorf("UID '%s' has a non-numeric component '%s'", uid, c)
+			}
+		}
+		if len(c) > 1 && c[0] == '0' {
+			return fmt.Errorf("UID '%s' has a component with a leading zero '%s'", uid, c)
+		}
+	}
+	return nil
+}
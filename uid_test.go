@@ -0,0 +1,50 @@
+package netdicom_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yasushi-saito/go-netdicom"
+)
+
+func TestValidateUID(t *testing.T) {
+	for _, uid := range []string{"1.2.840.10008.1.2", "2.25.0", "1.20.300"} {
+		if err := netdicom.ValidateUID(uid); err != nil {
+			t.Errorf("%s: %v", uid, err)
+		}
+	}
+	for _, uid := range []string{"", "1..2", "1.02", "1.2a", "1.2.", strings.Repeat("1.", 32) + "1"} {
+		if err := netdicom.ValidateUID(uid); err == nil {
+			t.Errorf("%s: should be invalid", uid)
+		}
+	}
+}
+
+func TestUIDGenerator(t *testing.T) {
+	for _, root := range []string{netdicom.UUIDDerivedUIDRoot, "1.2.826.0.1.3680043.10.543.1234567"} {
+		g, err := netdicom.NewUIDGenerator(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			uid := g.NewUID()
+			if !strings.HasPrefix(uid, root+".") {
+				t.Errorf("%s: wrong root", uid)
+			}
+			if err := netdicom.ValidateUID(uid); err != nil {
+				t.Error(err)
+			}
+			if seen[uid] {
+				t.Errorf("%s: duplicate", uid)
+			}
+			seen[uid] = true
+		}
+	}
+	if _, err := netdicom.NewUIDGenerator("1.02"); err == nil {
+		t.Error("Invalid root should be rejected")
+	}
+	if _, err := netdicom.NewUIDGenerator(strings.Repeat("1.", 22) + "1"); err == nil {
+		t.Error("Root that leaves no room should be rejected")
+	}
+}
@@ -1,7 +1,11 @@
 package netdicom
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/yasushi-saito/go-dicom"
 	"github.com/yasushi-saito/go-dicom/dicomio"
@@ -26,6 +30,119 @@ func GetTransferSyntaxUIDInBytes(bytes []byte) (string, error) {
 	return s, nil
 }
 
+// GetSOPUIDsInBytes parses just enough of "bytes", a DICOM file, to extract
+// the SOP class and instance UIDs of its dataset, e.g., to route a C-STORE by
+// SOP class without decoding a large image. It reads the file meta
+// information first, and falls back to the SOPClassUID (0008,0016) and
+// SOPInstanceUID (0008,0018) elements at the start of the dataset.
+func GetSOPUIDsInBytes(bytes []byte) (sopClassUID, sopInstanceUID string, err error) {
+	decoder := dicomio.NewBytesDecoder(bytes, nil, dicomio.UnknownVR)
+	meta := dicom.ParseFileHeader(decoder)
+	if decoder.Error() != nil {
+		return "", "", decoder.Error()
+	}
+	var getString = func(tag dicom.Tag) string {
+		elem, err := dicom.FindElementByTag(meta, tag)
+		if err != nil {
+			return ""
+		}
+		s, err := elem.GetString()
+		if err != nil {
+			return ""
+		}
+		return s
+	}
+	sopClassUID = getString(dicom.TagMediaStorageSOPClassUID)
+	sopInstanceUID = getString(dicom.TagMediaStorageSOPInstanceUID)
+	if sopClassUID != "" && sopInstanceUID != "" {
+		return sopClassUID, sopInstanceUID, nil
+	}
+	bo, implicit, err := dicomio.ParseTransferSyntaxUID(getString(dicom.TagTransferSyntaxUID))
+	if err != nil {
+		return "", "", err
+	}
+	decoder.PushTransferSyntax(bo, implicit)
+	defer decoder.PopTransferSyntax()
+	// The elements are sorted by tag, so stop reading once we pass
+	// SOPInstanceUID.
+	for decoder.Len() > 0 {
+		elem := dicom.ReadElement(decoder, dicom.ReadOptions{})
+		if decoder.Error() != nil {
+			return "", "", decoder.Error()
+		}
+		if elem.Tag.Group > dicom.TagSOPInstanceUID.Group ||
+			(elem.Tag.Group == dicom.TagSOPInstanceUID.Group && elem.Tag.Element > dicom.TagSOPInstanceUID.Element) {
+			break
+		}
+		switch elem.Tag {
+		case dicom.TagSOPClassUID:
+			if sopClassUID == "" {
+				sopClassUID, _ = elem.GetString()
+			}
+		case dicom.TagSOPInstanceUID:
+			if sopInstanceUID == "" {
+				sopInstanceUID, _ = elem.GetString()
+			}
+		}
+	}
+	if sopClassUID == "" || sopInstanceUID == "" {
+		return "", "", fmt.Errorf("SOP class or instance UID not found in the DICOM file")
+	}
+	return sopClassUID, sopInstanceUID, nil
+}
+
+// TCPOptions lists the socket options to set on the TCP connection of an
+// association, also when it runs under TLS. The zero value leaves the OS
+// defaults in place.
+type TCPOptions struct {
+	// If true, enable TCP keep-alive probes on the connection.
+	KeepAlive bool
+
+	// Interval between keep-alive probes. Used only when KeepAlive is
+	// true. If zero, the OS default is used.
+	KeepAlivePeriod time.Duration
+
+	// If true, disable Nagle's algorithm (i.e., set TCP_NODELAY). DIMSE
+	// commands are small and latency sensitive, so coalescing them with
+	// later writes only adds delay.
+	NoDelay bool
+}
+
+// The socket option setters of *net.TCPConn.
+type tcpOptionSetter interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+	SetNoDelay(noDelay bool) error
+}
+
+// Apply the options to "conn". A *tls.Conn is unwrapped to reach the
+// connection underneath. It is a noop unless that is a *net.TCPConn.
+func applyTCPOptions(conn net.Conn, options TCPOptions) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(tcpOptionSetter)
+	if !ok {
+		return nil
+	}
+	if options.KeepAlive {
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if options.KeepAlivePeriod > 0 {
+			if err := tcpConn.SetKeepAlivePeriod(options.KeepAlivePeriod); err != nil {
+				return err
+			}
+		}
+	}
+	if options.NoDelay {
+		if err := tcpConn.SetNoDelay(true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func doassert(cond bool, values ...interface{}) {
 	if !cond {
 		var s string
@@ -35,3 +152,28 @@ func doassert(cond bool, values ...interface{}) {
 		panic(s)
 	}
 }
+
+// ErrDIMSETimeout is returned when the peer doesn't respond to a DIMSE request
+// within ServiceUserParams.DIMSETimeout.
+var ErrDIMSETimeout = errors.New("Timed out waiting for a DIMSE response")
+
+// ErrReleased is returned by ServiceUser methods called after Release.
+var ErrReleased = errors.New("Association has been released")
+
+// Receive the next event from "ch". It returns false if ch is closed. If
+// timeout>0 and no event arrives within that period, it returns
+// ErrDIMSETimeout.
+func receiveUpcall(ch chan upcallEvent, timeout time.Duration) (upcallEvent, bool, error) {
+	if timeout <= 0 {
+		event, ok := <-ch
+		return event, ok, nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case event, ok := <-ch:
+		return event, ok, nil
+	case <-timer.C:
+		return upcallEvent{}, false, ErrDIMSETimeout
+	}
+}
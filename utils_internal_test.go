@@ -0,0 +1,64 @@
+package netdicom
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// A net.Conn that records the socket options set on it.
+type optionRecordingConn struct {
+	net.Conn
+	keepAlive       bool
+	keepAlivePeriod time.Duration
+	noDelay         bool
+}
+
+func (c *optionRecordingConn) SetKeepAlive(keepalive bool) error {
+	c.keepAlive = keepalive
+	return nil
+}
+
+func (c *optionRecordingConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.keepAlivePeriod = d
+	return nil
+}
+
+func (c *optionRecordingConn) SetNoDelay(noDelay bool) error {
+	c.noDelay = noDelay
+	return nil
+}
+
+func TestApplyTCPOptions(t *testing.T) {
+	options := TCPOptions{KeepAlive: true, KeepAlivePeriod: 30 * time.Second, NoDelay: true}
+	for _, wrap := range []bool{false, true} {
+		raw := &optionRecordingConn{}
+		var conn net.Conn = raw
+		if wrap {
+			// The options apply to the TCP connection under TLS.
+			conn = tls.Client(raw, &tls.Config{})
+		}
+		if err := applyTCPOptions(conn, options); err != nil {
+			t.Fatal(err)
+		}
+		if !raw.keepAlive || raw.keepAlivePeriod != options.KeepAlivePeriod || !raw.noDelay {
+			t.Errorf("TLS=%v: options not applied: %+v", wrap, raw)
+		}
+	}
+
+	// A real TCP connection accepts the options.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := applyTCPOptions(conn, options); err != nil {
+		t.Error(err)
+	}
+}
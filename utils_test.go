@@ -0,0 +1,61 @@
+package netdicom_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/yasushi-saito/go-dicom"
+	"github.com/yasushi-saito/go-dicom/dicomio"
+	"github.com/yasushi-saito/go-dicom/dicomuid"
+	"github.com/yasushi-saito/go-netdicom"
+)
+
+func TestGetSOPUIDsInBytes(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/IM-0001-0003.dcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := dicom.ReadDataSetInBytes(data, dicom.ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	getString := func(tag dicom.Tag) string {
+		elem, err := ds.FindElementByTag(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return elem.MustGetString()
+	}
+	sopClassUID, sopInstanceUID, err := netdicom.GetSOPUIDsInBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sopClassUID != getString(dicom.TagMediaStorageSOPClassUID) ||
+		sopInstanceUID != getString(dicom.TagMediaStorageSOPInstanceUID) {
+		t.Errorf("Wrong UIDs: %v %v", sopClassUID, sopInstanceUID)
+	}
+
+	// A file whose meta information has empty UIDs.
+	e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
+	dicom.WriteFileHeader(e, []*dicom.Element{
+		dicom.MustNewElement(dicom.TagTransferSyntaxUID, dicomuid.ExplicitVRLittleEndian),
+		dicom.MustNewElement(dicom.TagMediaStorageSOPClassUID, ""),
+		dicom.MustNewElement(dicom.TagMediaStorageSOPInstanceUID, ""),
+	})
+	e.PushTransferSyntax(binary.LittleEndian, dicomio.ExplicitVR)
+	dicom.WriteElement(e, dicom.MustNewElement(dicom.TagSOPClassUID, "1.2.3"))
+	dicom.WriteElement(e, dicom.MustNewElement(dicom.TagSOPInstanceUID, "4.5.6"))
+	dicom.WriteElement(e, dicom.MustNewElement(dicom.TagPatientName, "johndoe"))
+	e.PopTransferSyntax()
+	if err := e.Error(); err != nil {
+		t.Fatal(err)
+	}
+	sopClassUID, sopInstanceUID, err = netdicom.GetSOPUIDsInBytes(e.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sopClassUID != "1.2.3" || sopInstanceUID != "4.5.6" {
+		t.Errorf("Wrong UIDs: %v %v", sopClassUID, sopInstanceUID)
+	}
+}